@@ -0,0 +1,115 @@
+// Package critical implements the registry of handlers for the extension
+// header parameters that are listed in the "crit" header of JWS and JWE
+// messages, and the processing rules that the two specifications share.
+package critical
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/lestrrat/go-jwx/internal/debug"
+)
+
+var (
+	ErrInvalidCriticalHeader     = errors.New("invalid critical header")
+	ErrUnsupportedCriticalHeader = errors.New("unsupported critical header")
+)
+
+// Handler validates the value of an extension header parameter
+type Handler func(value interface{}) error
+
+// Registry holds the handlers for the extension header parameters that
+// are understood, and the names of the standard header parameters,
+// which must not appear in "crit"
+type Registry struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+	standard map[string]struct{}
+}
+
+// NewRegistry creates a new registry. `standard` are the names of the
+// header parameters defined by the specification
+func NewRegistry(standard ...string) *Registry {
+	r := &Registry{
+		handlers: map[string]Handler{},
+		standard: make(map[string]struct{}, len(standard)),
+	}
+	for _, name := range standard {
+		r.standard[name] = struct{}{}
+	}
+	return r
+}
+
+// IsStandard returns true if `name` is a standard header parameter
+func (r *Registry) IsStandard(name string) bool {
+	_, ok := r.standard[name]
+	return ok
+}
+
+// Register registers `h` as the handler for `name`. It panics if `name`
+// is a standard header parameter, as those can never be critical
+func (r *Registry) Register(name string, h Handler) {
+	if r.IsStandard(name) {
+		panic("can not register a critical header handler for the standard header parameter '" + name + "'")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[name] = h
+}
+
+// Unregister removes the handler for `name`
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.handlers, name)
+}
+
+// Lookup returns the handler for `name`
+func (r *Registry) Lookup(name string) (Handler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h, ok := r.handlers[name]
+	return h, ok && h != nil
+}
+
+// Check processes the "crit" header of a protected header. `crit` is the
+// value of "crit" (nil if it is not present), and `params` holds the
+// extension header parameters of the protected header. "crit" may not be
+// empty nor contain standard header parameters, and each of the listed
+// header parameters must be present in `params` and understood (i.e.
+// have a registered handler that accepts its value)
+func (r *Registry) Check(crit []string, params map[string]interface{}) error {
+	if crit == nil {
+		return nil
+	}
+
+	if len(crit) == 0 {
+		debug.Printf("'crit' is empty")
+		return ErrInvalidCriticalHeader
+	}
+
+	for _, name := range crit {
+		if r.IsStandard(name) {
+			debug.Printf("'crit' contains standard header '%s'", name)
+			return ErrInvalidCriticalHeader
+		}
+
+		value, ok := params[name]
+		if !ok {
+			debug.Printf("'%s' is listed in 'crit' but missing in protected header", name)
+			return ErrInvalidCriticalHeader
+		}
+
+		h, ok := r.Lookup(name)
+		if !ok {
+			debug.Printf("'%s' is not understood", name)
+			return ErrUnsupportedCriticalHeader
+		}
+
+		if err := h(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package critical
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry("alg", "crit")
+
+	if !assert.Panics(t, func() { r.Register("alg", func(interface{}) error { return nil }) }, "standard headers can not be registered") {
+		return
+	}
+
+	errInvalid := errors.New("invalid value")
+	r.Register("exp", func(v interface{}) error {
+		if _, ok := v.(float64); !ok {
+			return errInvalid
+		}
+		return nil
+	})
+
+	data := []struct {
+		name     string
+		crit     []string
+		params   map[string]interface{}
+		expected error
+	}{
+		{"no crit", nil, nil, nil},
+		{"understood", []string{"exp"}, map[string]interface{}{"exp": 1363284000.0}, nil},
+		{"empty", []string{}, nil, ErrInvalidCriticalHeader},
+		{"standard", []string{"alg"}, map[string]interface{}{"alg": "none"}, ErrInvalidCriticalHeader},
+		{"missing", []string{"exp"}, nil, ErrInvalidCriticalHeader},
+		{"not understood", []string{"foo"}, map[string]interface{}{"foo": "bar"}, ErrUnsupportedCriticalHeader},
+		{"rejected by handler", []string{"exp"}, map[string]interface{}{"exp": "tomorrow"}, errInvalid},
+	}
+	for _, d := range data {
+		if !assert.Equal(t, d.expected, r.Check(d.crit, d.params), "Check result matches (%s)", d.name) {
+			return
+		}
+	}
+
+	r.Unregister("exp")
+	if !assert.Equal(t, ErrUnsupportedCriticalHeader, r.Check([]string{"exp"}, map[string]interface{}{"exp": 1363284000.0}), "handler is unregistered") {
+		return
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"errors"
 	"reflect"
+	"strings"
 
 	"github.com/lestrrat/go-jwx/buffer"
 )
@@ -63,6 +64,60 @@ func MergeUnmarshal(data []byte, c Constructor, ext *map[string]interface{}) err
 	return nil
 }
 
+// FieldNames returns the names of the JSON object members that the
+// struct (or pointer to struct) `v` is encoded to and decoded from,
+// following the same rules as encoding/json. It returns nil if `v`
+// is not a struct
+func FieldNames(v interface{}) []string {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+	return fieldNames(rv.Type())
+}
+
+func fieldNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous { // unexported
+			continue
+		}
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name := strings.Split(tag, ",")[0]
+		if name == "" && f.Anonymous {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				names = append(names, fieldNames(ft)...)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
 // Hmap is used to parse through the JSON object from which to
 // construct the actual JWK's. The only reason this exists is to
 // allow the parser to decide which type of key to create based
@@ -82,4 +82,26 @@ func TestRoundTrip(t *testing.T) {
 	if !assert.Equal(t, d1, d2) {
 		return
 	}
-}
\ No newline at end of file
+}
+
+func TestFieldNames(t *testing.T) {
+	type Embedded struct {
+		Hoge string `json:"hoge"`
+	}
+
+	type Fields struct {
+		Embedded
+		Foo     string `json:"foo,omitempty"`
+		Bar     int
+		Ignored string `json:"-"`
+		private string
+	}
+
+	if !assert.Equal(t, []string{"hoge", "foo", "Bar"}, FieldNames(&Fields{}), "FieldNames matches") {
+		return
+	}
+
+	if !assert.Nil(t, FieldNames(map[string]interface{}{}), "FieldNames for non-struct is nil") {
+		return
+	}
+}
@@ -43,19 +43,22 @@ func (pb PadBuffer) Unpad(n int) (PadBuffer, error) {
 		return pb, errors.New("buffer should be multiple block size")
 	}
 
-	last := pb[pb.Len()-1]
-
-	count := 0
-	for i := pb.Len() - 1; i >= 0; i-- {
-		if pb[i] != last {
-			break
-		}
-		count++
+	if pb.Len() == 0 {
+		return pb, errors.New("invalid padding")
 	}
 
-	if count != int(last) {
+	last := pb[pb.Len()-1]
+	if last == 0 || int(last) > n || int(last) > pb.Len() {
 		return pb, errors.New("invalid padding")
 	}
 
+	// Only the last `last` bytes are padding. The plaintext itself may
+	// end with bytes that have the same value
+	for _, b := range pb[pb.Len()-int(last):] {
+		if b != last {
+			return pb, errors.New("invalid padding")
+		}
+	}
+
 	return PadBuffer(pb[:pb.Len()-int(last)]), nil
-}
\ No newline at end of file
+}
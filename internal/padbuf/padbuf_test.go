@@ -27,3 +27,22 @@ func TestPadBuffer(t *testing.T) {
 		}
 	}
 }
+
+func TestPadBuffer_TrailingPadValue(t *testing.T) {
+	// The plaintext ends with bytes that look like padding
+	buf := []byte{'a', 0x0d, 0x0d}
+	pb := PadBuffer(buf).Pad(16)
+
+	pb, err := pb.Unpad(16)
+	if !assert.NoError(t, err, "Unpad return successfully") {
+		return
+	}
+
+	if !assert.Equal(t, buf, []byte(pb), "Unpad should restore the buffer") {
+		return
+	}
+
+	if _, err := PadBuffer([]byte{1, 2, 3, 0}).Unpad(4); !assert.Error(t, err, "Unpad should fail with invalid padding") {
+		return
+	}
+}
@@ -0,0 +1,127 @@
+// Package streamutil provides utilities to read JWS and JWE messages
+// from streams
+package streamutil
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// ErrTooLarge is returned when a part of a message exceeds the maximum
+// size that is read into memory
+var ErrTooLarge = errors.New("message part exceeds the maximum size")
+
+// SegmentReader reads the next segment of a message in compact
+// serialization, i.e. everything up to (but not including) the next '.'
+type SegmentReader struct {
+	r     *bufio.Reader
+	buf   []byte
+	done  bool
+	found bool
+}
+
+// NewSegmentReader creates a new SegmentReader that reads from `r`. Once
+// the SegmentReader returns io.EOF, `r` is positioned right after the '.'
+func NewSegmentReader(r *bufio.Reader) *SegmentReader {
+	return &SegmentReader{r: r}
+}
+
+// Found returns true if the segment was terminated by a '.', as opposed
+// to the end of the stream
+func (s *SegmentReader) Found() bool {
+	return s.found
+}
+
+func (s *SegmentReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+
+		chunk, err := s.r.ReadSlice('.')
+		switch err {
+		case nil:
+			s.buf = chunk[:len(chunk)-1]
+			s.done = true
+			s.found = true
+		case bufio.ErrBufferFull:
+			s.buf = chunk
+		case io.EOF:
+			s.buf = chunk
+			s.done = true
+		default:
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// ReadBytes reads from `r` until the first occurrence of `delim` like
+// bufio.Reader.ReadBytes does, but fails with ErrTooLarge if more than
+// `max` bytes would have to be returned
+func ReadBytes(r *bufio.Reader, delim byte, max int) ([]byte, error) {
+	var buf []byte
+	for {
+		chunk, err := r.ReadSlice(delim)
+		if len(buf)+len(chunk) > max {
+			return nil, ErrTooLarge
+		}
+		buf = append(buf, chunk...)
+
+		if err != bufio.ErrBufferFull {
+			return buf, err
+		}
+	}
+}
+
+// ReadAll reads from `r` until EOF like ioutil.ReadAll does, but fails
+// with ErrTooLarge if there are more than `max` bytes to read
+func ReadAll(r io.Reader, max int64) ([]byte, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > max {
+		return nil, ErrTooLarge
+	}
+	return buf, nil
+}
+
+// LimitReader returns a reader that reads from `r`, but fails with
+// ErrTooLarge once more than `max` bytes would have to be read
+func LimitReader(r io.Reader, max int64) io.Reader {
+	return &limitReader{r: r, n: max}
+}
+
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Exactly `max` bytes have been read so far. That is only an
+		// error if the source has more to give
+		var probe [1]byte
+		for {
+			n, err := l.r.Read(probe[:])
+			if n > 0 {
+				return 0, ErrTooLarge
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
@@ -0,0 +1,111 @@
+package streamutil
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegmentReader(t *testing.T) {
+	// Use the smallest buffer possible, so that the segments are read
+	// in multiple chunks
+	r := bufio.NewReaderSize(strings.NewReader(strings.Repeat("a", 100)+"."+strings.Repeat("b", 20)), 16)
+
+	s := NewSegmentReader(r)
+	buf, err := ioutil.ReadAll(s)
+	if !assert.NoError(t, err, "ReadAll should succeed") {
+		return
+	}
+	if !assert.Equal(t, strings.Repeat("a", 100), string(buf), "first segment matches") {
+		return
+	}
+	if !assert.True(t, s.Found(), "segment is terminated by '.'") {
+		return
+	}
+
+	s = NewSegmentReader(r)
+	buf, err = ioutil.ReadAll(s)
+	if !assert.NoError(t, err, "ReadAll should succeed") {
+		return
+	}
+	if !assert.Equal(t, strings.Repeat("b", 20), string(buf), "last segment matches") {
+		return
+	}
+	if !assert.False(t, s.Found(), "last segment is terminated by the end of the stream") {
+		return
+	}
+}
+
+func TestReadBytes(t *testing.T) {
+	r := bufio.NewReaderSize(strings.NewReader(strings.Repeat("a", 100)+"."+strings.Repeat("b", 20)), 16)
+	buf, err := ReadBytes(r, '.', 101)
+	if !assert.NoError(t, err, "ReadBytes should succeed") {
+		return
+	}
+	if !assert.Equal(t, strings.Repeat("a", 100)+".", string(buf), "ReadBytes includes the delimiter") {
+		return
+	}
+
+	buf, err = ReadBytes(r, '.', 101)
+	if !assert.Equal(t, io.EOF, err, "ReadBytes returns io.EOF without the delimiter") {
+		return
+	}
+	if !assert.Equal(t, strings.Repeat("b", 20), string(buf), "ReadBytes returns what was read") {
+		return
+	}
+
+	r = bufio.NewReaderSize(strings.NewReader(strings.Repeat("a", 100)+"."), 16)
+	if _, err := ReadBytes(r, '.', 100); !assert.Equal(t, ErrTooLarge, err, "ReadBytes fails when the delimiter is too far") {
+		return
+	}
+}
+
+func TestReadAll(t *testing.T) {
+	buf, err := ReadAll(strings.NewReader("Lorem ipsum"), 11)
+	if !assert.NoError(t, err, "ReadAll should succeed") {
+		return
+	}
+	if !assert.Equal(t, "Lorem ipsum", string(buf), "ReadAll reads everything") {
+		return
+	}
+
+	if _, err := ReadAll(strings.NewReader("Lorem ipsum"), 10); !assert.Equal(t, ErrTooLarge, err, "ReadAll fails when there is too much to read") {
+		return
+	}
+}
+
+func TestLimitReader(t *testing.T) {
+	buf, err := ioutil.ReadAll(LimitReader(strings.NewReader("Lorem ipsum"), 20))
+	if !assert.NoError(t, err, "ReadAll should succeed") {
+		return
+	}
+	if !assert.Equal(t, "Lorem ipsum", string(buf), "ReadAll reads everything") {
+		return
+	}
+
+	if _, err := ioutil.ReadAll(LimitReader(strings.NewReader("Lorem ipsum"), 10)); !assert.Equal(t, ErrTooLarge, err, "ReadAll fails when there is too much to read") {
+		return
+	}
+
+	buf, err = ioutil.ReadAll(LimitReader(strings.NewReader("Lorem ipsum"), 11))
+	if !assert.NoError(t, err, "ReadAll with exactly max bytes should succeed") {
+		return
+	}
+	if !assert.Equal(t, "Lorem ipsum", string(buf), "ReadAll reads everything") {
+		return
+	}
+
+	// ...as well as when the source reports EOF along with the last bytes
+	buf, err = ioutil.ReadAll(LimitReader(iotest.DataErrReader(strings.NewReader("Lorem ipsum")), 11))
+	if !assert.NoError(t, err, "ReadAll with exactly max bytes should succeed") {
+		return
+	}
+	if !assert.Equal(t, "Lorem ipsum", string(buf), "ReadAll reads everything") {
+		return
+	}
+}
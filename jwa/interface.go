@@ -6,6 +6,7 @@ const (
 	EC       KeyType = "EC"  // Elliptic Curve
 	RSA      KeyType = "RSA" // RSA
 	OctetSeq KeyType = "oct" // Octet sequence (used to represent symmetric keys)
+	OKP      KeyType = "OKP" // Octet key pair (RFC 8037)
 )
 
 type EllipticCurveAlgorithm string
@@ -14,6 +15,12 @@ const (
 	P256 EllipticCurveAlgorithm = "P-256"
 	P384 EllipticCurveAlgorithm = "P-384"
 	P521 EllipticCurveAlgorithm = "P-521"
+
+	// The following curves are used with the "OKP" key type (RFC 8037)
+	Ed25519 EllipticCurveAlgorithm = "Ed25519"
+	Ed448   EllipticCurveAlgorithm = "Ed448"
+	X25519  EllipticCurveAlgorithm = "X25519"
+	X448    EllipticCurveAlgorithm = "X448"
 )
 
 // SignatureAlgorithm represents the various signature algorithms
@@ -34,6 +41,7 @@ const (
 	PS256       SignatureAlgorithm = "PS256" // RSASSA-PSS using SHA256 and MGF1-SHA256
 	PS384       SignatureAlgorithm = "PS384" // RSASSA-PSS using SHA384 and MGF1-SHA384
 	PS512       SignatureAlgorithm = "PS512" // RSASSA-PSS using SHA512 and MGF1-SHA512
+	EdDSA       SignatureAlgorithm = "EdDSA" // EdDSA using Ed25519 or Ed448 (RFC 8037)
 )
 
 // KeyEncryptionAlgorithm represents the various encryption
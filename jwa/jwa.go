@@ -33,6 +33,12 @@ func (crv EllipticCurveAlgorithm) Size() int {
 		return 48
 	case P521:
 		return 66
+	case Ed25519, X25519:
+		return 32
+	case Ed448:
+		return 57
+	case X448:
+		return 56
 	}
 	return 0
 }
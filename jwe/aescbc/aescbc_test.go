@@ -1,7 +1,10 @@
 package aescbc
 
 import (
+	"bytes"
 	"crypto/aes"
+	"crypto/rand"
+	"io/ioutil"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -58,3 +61,82 @@ func TestVectorsAESCBC128(t *testing.T) {
 		return
 	}
 }
+
+func TestStream(t *testing.T) {
+	key := make([]byte, 64)
+	nonce := make([]byte, NonceSize)
+	aad := []byte("additional authenticated data")
+	for _, b := range [][]byte{key, nonce} {
+		if _, err := rand.Read(b); !assert.NoError(t, err, "rand.Read") {
+			return
+		}
+	}
+
+	c, err := New(key, aes.NewCipher)
+	if !assert.NoError(t, err, "New") {
+		return
+	}
+
+	for _, size := range []int{0, 1, 15, 16, 17, chunkSize - 1, chunkSize, 3*chunkSize + 5} {
+		plaintext := make([]byte, size)
+		if _, err := rand.Read(plaintext); !assert.NoError(t, err, "rand.Read") {
+			return
+		}
+
+		var ciphertext bytes.Buffer
+		enc, err := c.NewStreamEncrypter(&ciphertext, nonce, aad)
+		if !assert.NoError(t, err, "NewStreamEncrypter") {
+			return
+		}
+		// Write in odd sized pieces
+		for p := plaintext; len(p) > 0; {
+			n := 7
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := enc.Write(p[:n]); !assert.NoError(t, err, "Write") {
+				return
+			}
+			p = p[n:]
+		}
+		if !assert.NoError(t, enc.Close(), "Close") {
+			return
+		}
+
+		// Must be the same as Seal
+		sealed := c.Seal(nil, nonce, plaintext, aad)
+		if !assert.Equal(t, sealed, append(ciphertext.Bytes(), enc.Tag()...), "ciphertext and tag should match (size = %d)", size) {
+			return
+		}
+
+		tag := func() ([]byte, error) { return enc.Tag(), nil }
+		dec, err := c.NewStreamDecrypter(bytes.NewReader(ciphertext.Bytes()), nonce, aad, tag)
+		if !assert.NoError(t, err, "NewStreamDecrypter") {
+			return
+		}
+		out, err := ioutil.ReadAll(dec)
+		if !assert.NoError(t, err, "ReadAll") {
+			return
+		}
+		if !assert.Equal(t, plaintext, out, "plaintext should match (size = %d)", size) {
+			return
+		}
+
+		badtag := func() ([]byte, error) { return make([]byte, NonceSize), nil }
+		dec, err = c.NewStreamDecrypter(bytes.NewReader(ciphertext.Bytes()), nonce, aad, badtag)
+		if !assert.NoError(t, err, "NewStreamDecrypter") {
+			return
+		}
+		if _, err := ioutil.ReadAll(dec); !assert.Error(t, err, "ReadAll should fail with an invalid tag") {
+			return
+		}
+
+		dec, err = c.NewStreamDecrypter(bytes.NewReader(ciphertext.Bytes()[1:]), nonce, aad, tag)
+		if !assert.NoError(t, err, "NewStreamDecrypter") {
+			return
+		}
+		if _, err := ioutil.ReadAll(dec); !assert.Error(t, err, "ReadAll should fail with a truncated ciphertext") {
+			return
+		}
+	}
+}
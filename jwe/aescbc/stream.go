@@ -0,0 +1,233 @@
+package aescbc
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/lestrrat/go-jwx/internal/debug"
+	"github.com/lestrrat/go-jwx/internal/padbuf"
+)
+
+// chunkSize is the amount of ciphertext that StreamDecrypter reads from
+// its source at once
+const chunkSize = 32 * 1024
+
+// StreamEncrypter encrypts the plaintext written to it, and writes the
+// ciphertext to the underlying writer. The result is the same as Seal,
+// except that the authentication tag is not appended to the ciphertext:
+// it is available through Tag once Close has been called.
+type StreamEncrypter struct {
+	dst     io.Writer
+	cbc     cipher.BlockMode
+	mac     hash.Hash
+	aadlen  int
+	tagsize int
+	pending []byte
+	tag     []byte
+	closed  bool
+}
+
+// StreamDecrypter reads the ciphertext from the underlying reader, and
+// returns the decrypted plaintext. The authentication tag is obtained
+// once all of the ciphertext has been read, and io.EOF is only returned
+// after the tag has been verified.
+//
+// Note that the plaintext is returned as it is decrypted, i.e. BEFORE
+// the tag has been verified. It must be discarded unless the reader
+// reaches io.EOF.
+type StreamDecrypter struct {
+	src     io.Reader
+	cbc     cipher.BlockMode
+	mac     hash.Hash
+	aadlen  int
+	tagsize int
+	tagfunc func() ([]byte, error)
+	pending []byte // ciphertext that has not been decrypted yet
+	out     []byte // plaintext that has not been returned yet
+	err     error
+}
+
+func (c AesCbcHmac) newMac(nonce, aad []byte) hash.Hash {
+	h := hmac.New(c.hash, c.integrityKey)
+	h.Write(aad)
+	h.Write(nonce)
+	return h
+}
+
+func computeStreamTag(h hash.Hash, aadlen, tagsize int) []byte {
+	var al [8]byte
+	binary.BigEndian.PutUint64(al[:], uint64(aadlen*8))
+	h.Write(al[:])
+	return h.Sum(nil)[:tagsize]
+}
+
+// NewStreamEncrypter creates a StreamEncrypter that writes the ciphertext
+// to `dst`, using `nonce` as the IV and `aad` as the additional
+// authenticated data
+func (c AesCbcHmac) NewStreamEncrypter(dst io.Writer, nonce, aad []byte) (*StreamEncrypter, error) {
+	if len(nonce) != c.blockCipher.BlockSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+
+	return &StreamEncrypter{
+		dst:     dst,
+		cbc:     cipher.NewCBCEncrypter(c.blockCipher, nonce),
+		mac:     c.newMac(nonce, aad),
+		aadlen:  len(aad),
+		tagsize: c.tagsize,
+	}, nil
+}
+
+// Write encrypts as many complete blocks as possible, and buffers the rest
+func (e *StreamEncrypter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encrypter")
+	}
+
+	bs := e.cbc.BlockSize()
+	n := len(p)
+	for len(p) > 0 {
+		// Fill the pending buffer up to chunkSize, so that we don't
+		// need to allocate a buffer as large as the input
+		l := chunkSize - len(e.pending)
+		if l > len(p) {
+			l = len(p)
+		}
+		e.pending = append(e.pending, p[:l]...)
+		p = p[l:]
+
+		if full := len(e.pending) - len(e.pending)%bs; full > 0 {
+			if err := e.flush(e.pending[:full]); err != nil {
+				return 0, err
+			}
+			e.pending = append(e.pending[:0], e.pending[full:]...)
+		}
+	}
+	return n, nil
+}
+
+func (e *StreamEncrypter) flush(buf []byte) error {
+	e.cbc.CryptBlocks(buf, buf)
+	e.mac.Write(buf)
+	_, err := e.dst.Write(buf)
+	return err
+}
+
+// Close pads and encrypts the remaining plaintext, and computes the
+// authentication tag. It does not close the underlying writer
+func (e *StreamEncrypter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+
+	last := padbuf.PadBuffer(e.pending).Pad(e.cbc.BlockSize())
+	if err := e.flush(last); err != nil {
+		return err
+	}
+	e.pending = nil
+	e.tag = computeStreamTag(e.mac, e.aadlen, e.tagsize)
+	return nil
+}
+
+// Tag returns the authentication tag. It is only available after Close
+// has been called
+func (e *StreamEncrypter) Tag() []byte {
+	return e.tag
+}
+
+// NewStreamDecrypter creates a StreamDecrypter that reads the ciphertext
+// from `src`, using `nonce` as the IV and `aad` as the additional
+// authenticated data. `tag` is called once `src` has been exhausted, and
+// should return the authentication tag
+func (c AesCbcHmac) NewStreamDecrypter(src io.Reader, nonce, aad []byte, tag func() ([]byte, error)) (*StreamDecrypter, error) {
+	if len(nonce) != c.blockCipher.BlockSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+
+	return &StreamDecrypter{
+		src:     src,
+		cbc:     cipher.NewCBCDecrypter(c.blockCipher, nonce),
+		mac:     c.newMac(nonce, aad),
+		aadlen:  len(aad),
+		tagsize: c.tagsize,
+		tagfunc: tag,
+	}, nil
+}
+
+func (d *StreamDecrypter) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.fill()
+	}
+
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// fill reads the next chunk of ciphertext, and decrypts all complete
+// blocks except for the last one, which may contain the padding
+func (d *StreamDecrypter) fill() error {
+	bs := d.cbc.BlockSize()
+
+	buf := make([]byte, chunkSize)
+	n, err := d.src.Read(buf)
+	if n > 0 {
+		d.mac.Write(buf[:n])
+		d.pending = append(d.pending, buf[:n]...)
+		if full := len(d.pending) - len(d.pending)%bs - bs; full > 0 {
+			out := make([]byte, full)
+			d.cbc.CryptBlocks(out, d.pending[:full])
+			d.pending = append(d.pending[:0], d.pending[full:]...)
+			d.out = out
+		}
+	}
+
+	switch err {
+	case nil:
+		return nil
+	case io.EOF:
+		return d.finish()
+	default:
+		return err
+	}
+}
+
+func (d *StreamDecrypter) finish() error {
+	bs := d.cbc.BlockSize()
+	if len(d.pending) != bs {
+		return fmt.Errorf("invalid ciphertext (invalid length: %d %% %d != 0)", len(d.pending), bs)
+	}
+
+	tag, err := d.tagfunc()
+	if err != nil {
+		return err
+	}
+
+	expectedTag := computeStreamTag(d.mac, d.aadlen, d.tagsize)
+	if subtle.ConstantTimeCompare(expectedTag, tag) != 1 {
+		debug.Printf("provided tag = %x\n", tag)
+		debug.Printf("expected tag = %x\n", expectedTag)
+		return errors.New("invalid ciphertext (tag mismatch)")
+	}
+
+	last := make([]byte, bs)
+	d.cbc.CryptBlocks(last, d.pending)
+	d.pending = nil
+
+	plaintext, err := padbuf.PadBuffer(last).Unpad(bs)
+	if err != nil {
+		return err
+	}
+	d.out = append(d.out, plaintext...)
+	return io.EOF
+}
@@ -0,0 +1,57 @@
+package jwe
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+
+	"github.com/lestrrat/go-jwx/jwa"
+)
+
+func compress(alg jwa.CompressionAlgorithm, plaintext []byte) ([]byte, error) {
+	switch alg {
+	case jwa.NoCompress:
+		return plaintext, nil
+	case jwa.Deflate:
+	default:
+		return nil, NewErrUnsupportedAlgorithm(string(alg), "compression")
+	}
+
+	output := bytes.Buffer{}
+	w, err := flate.NewWriter(&output, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
+
+// uncompress inflates the plaintext. To protect against decompression
+// bombs, it fails if the result would be larger than MaxDecompressedSize
+func uncompress(alg jwa.CompressionAlgorithm, plaintext []byte) ([]byte, error) {
+	switch alg {
+	case jwa.NoCompress:
+		return plaintext, nil
+	case jwa.Deflate:
+	default:
+		return nil, NewErrUnsupportedAlgorithm(string(alg), "compression")
+	}
+
+	r := flate.NewReader(bytes.NewReader(plaintext))
+	defer r.Close()
+
+	output := bytes.Buffer{}
+	n, err := io.Copy(&output, io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxDecompressedSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return output.Bytes(), nil
+}
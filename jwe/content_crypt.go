@@ -35,12 +35,14 @@ func NewAesCrypt(alg jwa.ContentEncryptionAlgorithm) (*GenericContentCrypt, erro
 	return &GenericContentCrypt{
 		alg:     alg,
 		cipher:  cipher,
-		cekgen:  NewRandomKeyGenerate(cipher.KeySize() * 2),
-		keysize: cipher.KeySize() * 2,
+		cekgen:  NewRandomKeyGenerate(cipher.KeySize()),
+		keysize: cipher.KeySize(),
 		tagsize: 16,
 	}, nil
 }
 
+// KeySize returns the size of the CEK required by this content encryption
+// algorithm (for AES-CBC-HMAC, this includes the MAC key)
 func (c GenericContentCrypt) KeySize() int {
 	return c.keysize
 }
@@ -0,0 +1,76 @@
+package jwe
+
+import (
+	"github.com/lestrrat/go-jwx/internal/critical"
+	"github.com/lestrrat/go-jwx/internal/debug"
+)
+
+// criticalHeaders holds the handlers for the extension header parameters
+// that may be listed in "crit". The header parameters defined in RFC 7516
+// and RFC 7518 must not appear in "crit"
+var criticalHeaders = critical.NewRegistry(
+	"alg",
+	"apu",
+	"apv",
+	"crit",
+	"cty",
+	"enc",
+	"epk",
+	"iv",
+	"jku",
+	"jwk",
+	"kid",
+	"p2c",
+	"p2s",
+	"tag",
+	"typ",
+	"x5c",
+	"x5t",
+	"x5t#S256",
+	"x5u",
+	"zip",
+)
+
+// RegisterCriticalHeader registers `h` as the handler for the extension
+// header parameter `name`. Messages that list `name` in their "crit"
+// header can only be decrypted if a handler has been registered for it,
+// and the handler accepts the value of the header parameter.
+// Header parameters defined in RFC 7516 and RFC 7518 can not be
+// registered, and attempting to do so panics.
+func RegisterCriticalHeader(name string, h CriticalHeaderHandler) {
+	criticalHeaders.Register(name, critical.Handler(h))
+}
+
+// UnregisterCriticalHeader removes the handler for `name`
+func UnregisterCriticalHeader(name string) {
+	criticalHeaders.Unregister(name)
+}
+
+// checkCritical processes the "crit" header as described in RFC 7516
+// Section 4.1.13. "crit" may only appear in the protected header, it
+// may not be empty nor contain header parameters defined by the RFCs,
+// and each of the listed header parameters must be present in the
+// protected header and understood (i.e. have a registered handler)
+func (m *Message) checkCritical() error {
+	if m.UnprotectedHeader != nil && m.UnprotectedHeader.EssentialHeader != nil && m.UnprotectedHeader.Critical != nil {
+		debug.Printf("'crit' found in shared unprotected header")
+		return ErrInvalidCriticalHeader
+	}
+	for _, recipient := range m.Recipients {
+		if recipient.Header != nil && recipient.Header.EssentialHeader != nil && recipient.Header.Critical != nil {
+			debug.Printf("'crit' found in per-recipient header")
+			return ErrInvalidCriticalHeader
+		}
+	}
+
+	if m.ProtectedHeader == nil || m.ProtectedHeader.Header == nil {
+		return nil
+	}
+
+	protected := m.ProtectedHeader.Header
+	if protected.EssentialHeader == nil {
+		return nil
+	}
+
+	return criticalHeaders.Check(protected.Critical, protected.PrivateParams)
+}
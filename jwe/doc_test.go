@@ -34,3 +34,45 @@ func ExampleEncrypt() {
 		return
 	}
 }
+
+func ExampleMultiEncrypt() {
+	alicekey := make([]byte, 16)
+	rand.Read(alicekey)
+	bobkey := make([]byte, 16)
+	rand.Read(bobkey)
+
+	contentcrypt, err := NewAesCrypt(jwa.A128CBC_HS256)
+	if err != nil {
+		log.Printf("failed to create content encrypter: %s", err)
+		return
+	}
+
+	alice, _ := NewAesKeyWrap(jwa.A128KW, alicekey)
+	alice.KeyID = "alice"
+	bob, _ := NewAesKeyWrap(jwa.A128KW, bobkey)
+	bob.KeyID = "bob"
+
+	enc := NewMultiEncrypt(contentcrypt, NewRandomKeyGenerate(contentcrypt.KeySize()), alice, bob)
+	msg, err := enc.Encrypt([]byte("Lorem Ipsum"))
+	if err != nil {
+		log.Printf("failed to encrypt payload: %s", err)
+		return
+	}
+
+	encrypted, err := JSONSerialize{}.Serialize(msg)
+	if err != nil {
+		log.Printf("failed to serialize message: %s", err)
+		return
+	}
+
+	decrypted, err := DecryptWithKeyID(encrypted, jwa.A128KW, "bob", bobkey)
+	if err != nil {
+		log.Printf("failed to decrypt: %s", err)
+		return
+	}
+
+	if string(decrypted) != "Lorem Ipsum" {
+		log.Printf("WHAT?!")
+		return
+	}
+}
@@ -1,6 +1,9 @@
 package jwe
 
-import "github.com/lestrrat/go-jwx/internal/debug"
+import (
+	"github.com/lestrrat/go-jwx/internal/debug"
+	"github.com/lestrrat/go-jwx/jwa"
+)
 
 // NewMultiEncrypt creates a new Encrypt struct. The caller is responsible
 // for instantiating valid inputs for ContentEncrypter, KeyGenerator,
@@ -16,18 +19,81 @@ func NewMultiEncrypt(cc ContentEncrypter, kg KeyGenerator, ke ...KeyEncrypter) *
 
 // Encrypt takes the plaintext and encrypts into a JWE message.
 func (e MultiEncrypt) Encrypt(plaintext []byte) (*Message, error) {
+	cek, msg, err := e.newMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	// The plaintext is compressed before encryption, and the recipients
+	// learn about it through the "zip" header
+	if compression := msg.ProtectedHeader.Compression; compression != jwa.NoCompress {
+		plaintext, err = compress(compression, plaintext)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	aad, err := computeAAD(msg.ProtectedHeader, msg.AuthenticatedData)
+	if err != nil {
+		return nil, err
+	}
+
+	// ...on the other hand, there's only one content cipher.
+	iv, ciphertext, tag, err := e.ContentEncrypter.Encrypt(cek, plaintext, aad)
+	if err != nil {
+		debug.Printf("Failed to encrypt: %s", err)
+		return nil, err
+	}
+
+	debug.Printf("Encrypt.Encrypt: cek        = %x (%d)", cek, len(cek))
+	debug.Printf("Encrypt.Encrypt: aad        = %x", aad)
+	debug.Printf("Encrypt.Encrypt: ciphertext = %x", ciphertext)
+	debug.Printf("Encrypt.Encrypt: iv         = %x", iv)
+	debug.Printf("Encrypt.Encrypt: tag        = %x", tag)
+
+	msg.CipherText = ciphertext
+	msg.InitializationVector = iv
+	msg.Tag = tag
+
+	return msg, nil
+}
+
+// newMessage generates the CEK, and creates a message with everything
+// but the content encryption results (i.e. the IV, the ciphertext and
+// the tag) filled in. If the plaintext needs to be compressed, the
+// "zip" parameter of the protected header is set
+func (e MultiEncrypt) newMessage() ([]byte, *Message, error) {
 	bk, err := e.KeyGenerator.KeyGenerate()
 	if err != nil {
 		debug.Printf("Failed to generate key: %s", err)
-		return nil, err
+		return nil, nil, err
 	}
 	cek := bk.Bytes()
 
 	debug.Printf("Encrypt: generated cek len = %d", len(cek))
 
 	protected := NewEncodedHeader()
+	if e.ProtectedHeader != nil {
+		if err := protected.Header.Copy(e.ProtectedHeader); err != nil {
+			return nil, nil, err
+		}
+	}
 	protected.Set("enc", e.ContentEncrypter.Algorithm())
 
+	compression := e.Compression
+	if compression == jwa.NoCompress {
+		compression = protected.Compression
+	}
+	if compression != jwa.NoCompress {
+		protected.Set("zip", compression)
+	}
+
+	// Key generators that perform key agreement (i.e. ECDH-ES) need to
+	// tell the recipients how to derive the same key
+	if hp, ok := bk.(HeaderPopulater); ok {
+		hp.HeaderPopulate(protected.Header)
+	}
+
 	// In JWE, multiple recipients may exist -- they receive an
 	// encrypted version of the CEK, using their key encryption
 	// algorithm of choice.
@@ -41,7 +107,7 @@ func (e MultiEncrypt) Encrypt(plaintext []byte) (*Message, error) {
 		enckey, err := enc.KeyEncrypt(cek)
 		if err != nil {
 			debug.Printf("Failed to encrypt key: %s", err)
-			return nil, err
+			return nil, nil, err
 		}
 		r.EncryptedKey = enckey.Bytes()
 		if hp, ok := enckey.(HeaderPopulater); ok {
@@ -52,39 +118,35 @@ func (e MultiEncrypt) Encrypt(plaintext []byte) (*Message, error) {
 	}
 
 	// If there's only one recipient, you want to include that in the
-	// protected header
+	// protected header, so that the message can be serialized in the
+	// compact format
 	if len(recipients) == 1 {
 		protected.Header, err = protected.Header.Merge(recipients[0].Header)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
+		recipients[0].Header = NewHeader()
 	}
 
-	aad, err := protected.Base64Encode()
-	if err != nil {
-		return nil, err
-	}
-
-	// ...on the other hand, there's only one content cipher.
-	iv, ciphertext, tag, err := e.ContentEncrypter.Encrypt(cek, plaintext, aad)
-	if err != nil {
-		debug.Printf("Failed to encrypt: %s", err)
-		return nil, err
+	unprotected := NewHeader()
+	if e.UnprotectedHeader != nil {
+		if err := unprotected.Copy(e.UnprotectedHeader); err != nil {
+			return nil, nil, err
+		}
+		if unprotected.Compression != jwa.NoCompress {
+			return nil, nil, ErrUnprotectedCompression
+		}
 	}
 
-	debug.Printf("Encrypt.Encrypt: cek        = %x (%d)", cek, len(cek))
-	debug.Printf("Encrypt.Encrypt: aad        = %x", aad)
-	debug.Printf("Encrypt.Encrypt: ciphertext = %x", ciphertext)
-	debug.Printf("Encrypt.Encrypt: iv         = %x", iv)
-	debug.Printf("Encrypt.Encrypt: tag        = %x", tag)
-
 	msg := NewMessage()
-	msg.AuthenticatedData.Base64Decode(aad)
-	msg.CipherText = ciphertext
-	msg.InitializationVector = iv
+	msg.AuthenticatedData = e.AuthenticatedData
 	msg.ProtectedHeader = protected
 	msg.Recipients = recipients
-	msg.Tag = tag
+	msg.UnprotectedHeader = unprotected
 
-	return msg, nil
+	if err := msg.checkDisjointHeaders(); err != nil {
+		return nil, nil, err
+	}
+
+	return cek, msg, nil
 }
@@ -2,25 +2,62 @@ package jwe
 
 import (
 	"crypto/cipher"
-	"crypto/ecdsa"
 	"crypto/rsa"
 	"errors"
 	"fmt"
 	"net/url"
 
 	"github.com/lestrrat/go-jwx/buffer"
+	"github.com/lestrrat/go-jwx/internal/critical"
+	"github.com/lestrrat/go-jwx/internal/streamutil"
 	"github.com/lestrrat/go-jwx/jwa"
 	"github.com/lestrrat/go-jwx/jwk"
 )
 
+// PBES2MinCount is the minimum PBES2 iteration count accepted when
+// encrypting. https://tools.ietf.org/html/rfc7518#section-4.8.1.2
+// recommends a minimum of 1000
+const PBES2MinCount = 1000
+
 var (
-	ErrInvalidBlockSize         = errors.New("keywrap input must be 8 byte blocks")
-	ErrInvalidCompactPartsCount = errors.New("compact JWE format must have five parts")
-	ErrInvalidHeaderValue       = errors.New("invalid value for header key")
-	ErrUnsupportedAlgorithm     = errors.New("unspported algorithm")
-	ErrMissingPrivateKey        = errors.New("missing private key")
+	// PBES2DefaultCount is the PBES2 iteration count used when none
+	// is specified
+	PBES2DefaultCount = 100000
+
+	// PBES2MaxCount is the maximum PBES2 iteration count accepted when
+	// decrypting. Messages with a larger "p2c" value are rejected, as
+	// they can be used to exhaust the CPU of the recipient
+	PBES2MaxCount = 1000000
+
+	// MaxDecompressedSize is the maximum size in bytes of the plaintext
+	// of a compressed ("zip":"DEF") message after it has been inflated
+	MaxDecompressedSize int64 = 10 * 1024 * 1024
+
+	// MaxBufferedCiphertextSize is the maximum size in bytes of the
+	// (base64url decoded) ciphertext that DecryptStream reads into
+	// memory when a JSON message has its "iv" member after "ciphertext"
+	MaxBufferedCiphertextSize int64 = 10 * 1024 * 1024
 )
 
+var (
+	ErrDuplicateHeaderParameter  = errors.New("header parameter must not appear in more than one header")
+	ErrInvalidBlockSize          = errors.New("keywrap input must be 8 byte blocks")
+	ErrInvalidCompactPartsCount  = errors.New("compact JWE format must have five parts")
+	ErrInvalidCriticalHeader     = critical.ErrInvalidCriticalHeader
+	ErrInvalidHeaderValue        = errors.New("invalid value for header key")
+	ErrUnprotectedCompression    = errors.New("'zip' must be in the protected header")
+	ErrUnsupportedAlgorithm      = errors.New("unspported algorithm")
+	ErrUnsupportedCriticalHeader = critical.ErrUnsupportedCriticalHeader
+	ErrMissingPrivateKey         = errors.New("missing private key")
+	ErrDecompressedTooLarge      = errors.New("decompressed payload exceeds the maximum size")
+	ErrTooLarge                  = streamutil.ErrTooLarge
+)
+
+// CriticalHeaderHandler validates the value of an extension header
+// parameter that is listed in the "crit" header. It should return an
+// error if the value is not acceptable
+type CriticalHeaderHandler func(value interface{}) error
+
 type errUnsupportedAlgorithm struct {
 	alg     string
 	purpose string
@@ -42,10 +79,14 @@ type EssentialHeader struct {
 	ContentType            string                         `json:"cty,omitempty"`
 	Compression            jwa.CompressionAlgorithm       `json:"zip,omitempty"`
 	Critical               []string                       `json:"crit,omitempty"`
-	EphemeralPublicKey     *jwk.EcdsaPublicKey            `json:"epk,omitempty"`
+	EphemeralPublicKey     jwk.Key                        `json:"epk,omitempty"`
+	InitializationVector   buffer.Buffer                  `json:"iv,omitempty"`  // AES-GCM key wrap
 	Jwk                    jwk.Key                        `json:"jwk,omitempty"` // public key
 	JwkSetURL              *url.URL                       `json:"jku,omitempty"`
 	KeyID                  string                         `json:"kid,omitempty"`
+	PBES2Count             int                            `json:"p2c,omitempty"`
+	PBES2Salt              buffer.Buffer                  `json:"p2s,omitempty"`
+	Tag                    buffer.Buffer                  `json:"tag,omitempty"` // AES-GCM key wrap
 	Type                   string                         `json:"typ,omitempty"` // e.g. "JWT"
 	X509Url                *url.URL                       `json:"x5u,omitempty"`
 	X509CertChain          []string                       `json:"x5c,omitempty"`
@@ -83,20 +124,36 @@ type KeyDecrypter interface {
 }
 
 type Recipient struct {
-	Header       *Header       `json:"header"`
-	EncryptedKey buffer.Buffer `json:"encrypted_key"`
+	Header       *Header       `json:"header,omitempty"`
+	EncryptedKey buffer.Buffer `json:"encrypted_key,omitempty"`
 }
 
+// Message represents a full JWE message. `AuthenticatedData` is the
+// optional "aad" value, which is only available in the JSON
+// serialization format
 type Message struct {
 	AuthenticatedData    buffer.Buffer  `json:"aad,omitempty"`
 	CipherText           buffer.Buffer  `json:"ciphertext"`
 	InitializationVector buffer.Buffer  `json:"iv,omitempty"`
-	ProtectedHeader      *EncodedHeader `json:"protected"`
+	ProtectedHeader      *EncodedHeader `json:"protected,omitempty"`
 	Recipients           []Recipient    `json:"recipients"`
 	Tag                  buffer.Buffer  `json:"tag,omitempty"`
 	UnprotectedHeader    *Header        `json:"unprotected,omitempty"`
 }
 
+// flattenedMessage is the JSON representation of a message with a
+// single recipient, in the flattened JSON serialization format
+type flattenedMessage struct {
+	AuthenticatedData    buffer.Buffer  `json:"aad,omitempty"`
+	CipherText           buffer.Buffer  `json:"ciphertext"`
+	EncryptedKey         buffer.Buffer  `json:"encrypted_key,omitempty"`
+	Header               *Header        `json:"header,omitempty"`
+	InitializationVector buffer.Buffer  `json:"iv,omitempty"`
+	ProtectedHeader      *EncodedHeader `json:"protected,omitempty"`
+	Tag                  buffer.Buffer  `json:"tag,omitempty"`
+	UnprotectedHeader    *Header        `json:"unprotected,omitempty"`
+}
+
 // Encrypter is the top level structure that encrypts the given
 // payload to a JWE message
 type Encrypter interface {
@@ -110,9 +167,13 @@ type ContentEncrypter interface {
 
 // MultiEncrypt is the default Encrypter implementation.
 type MultiEncrypt struct {
-	ContentEncrypter ContentEncrypter
-	KeyGenerator     KeyGenerator // KeyGenerator creates the random CEK.
-	KeyEncrypters    []KeyEncrypter
+	ContentEncrypter  ContentEncrypter
+	KeyGenerator      KeyGenerator // KeyGenerator creates the random CEK.
+	KeyEncrypters     []KeyEncrypter
+	ProtectedHeader   *Header                  // Extra parameters (e.g. "cty") to include in the protected header
+	UnprotectedHeader *Header                  // Parameters shared by all recipients, that are not integrity protected
+	AuthenticatedData []byte                   // Additional authenticated data ("aad"). Only available in JSON serialization
+	Compression       jwa.CompressionAlgorithm // Compression applied to the plaintext before encryption
 }
 
 type KeyWrapEncrypt struct {
@@ -121,18 +182,72 @@ type KeyWrapEncrypt struct {
 	sharedkey []byte
 }
 
+// AesGcmKeyWrap encrypts the CEK using AES-GCM (A128GCMKW, A192GCMKW
+// and A256GCMKW)
+type AesGcmKeyWrap struct {
+	alg       jwa.KeyEncryptionAlgorithm
+	KeyID     string
+	sharedkey []byte
+}
+
+// AesGcmKeyUnwrap decrypts the CEK using AES-GCM, with the "iv" and
+// "tag" header parameters that were populated by AesGcmKeyWrap
+type AesGcmKeyUnwrap struct {
+	alg       jwa.KeyEncryptionAlgorithm
+	sharedkey []byte
+	iv        []byte
+	tag       []byte
+}
+
+// Pbes2KeyWrap encrypts the CEK using a key derived from a password
+// (PBES2-HS256+A128KW, PBES2-HS384+A192KW and PBES2-HS512+A256KW)
+type Pbes2KeyWrap struct {
+	alg      jwa.KeyEncryptionAlgorithm
+	KeyID    string
+	password []byte
+	count    int
+}
+
+// Pbes2KeyUnwrap decrypts the CEK using a key derived from a password,
+// with the "p2s" and "p2c" header parameters that were populated by
+// Pbes2KeyWrap
+type Pbes2KeyUnwrap struct {
+	alg      jwa.KeyEncryptionAlgorithm
+	password []byte
+	salt     []byte
+	count    int
+}
+
 type EcdhesKeyWrapEncrypt struct {
 	algorithm jwa.KeyEncryptionAlgorithm
 	generator KeyGenerator
 	KeyID     string
 }
 
+// EcdhesDirectDecrypt derives the CEK using direct ECDH-ES key agreement
+type EcdhesDirectDecrypt struct {
+	enc     jwa.ContentEncryptionAlgorithm
+	keysize int
+	apu     []byte
+	apv     []byte
+	privkey interface{} // *ecdsa.PrivateKey or x25519.PrivateKey
+	pubkey  interface{} // *ecdsa.PublicKey or x25519.PublicKey
+}
+
+// DirectKeyEncrypt is the KeyEncrypter for key management modes where the
+// CEK is not transmitted (i.e. "dir" and "ECDH-ES"). The encrypted key
+// that it produces is always empty
+type DirectKeyEncrypt struct {
+	alg   jwa.KeyEncryptionAlgorithm
+	KeyID string
+}
+
 type EcdhesKeyWrapDecrypt struct {
 	algorithm jwa.KeyEncryptionAlgorithm
 	apu       []byte
 	apv       []byte
-	privkey   *ecdsa.PrivateKey
-	pubkey    *ecdsa.PublicKey
+	privkey   interface{} // *ecdsa.PrivateKey or x25519.PrivateKey
+	pubkey    interface{} // *ecdsa.PublicKey or x25519.PublicKey
 }
 
 type KeyDecoder interface {
@@ -147,7 +262,26 @@ type RsaOaepKeyDecode struct {
 type ByteKey []byte
 type ByteWithECPrivateKey struct {
 	ByteKey
-	PrivateKey *ecdsa.PrivateKey
+	PrivateKey interface{} // *ecdsa.PrivateKey or x25519.PrivateKey
+	PublicKey  jwk.Key     // public part of PrivateKey, stored in the "epk" header
+}
+
+// ByteWithIVAndTag is the encrypted key created by AesGcmKeyWrap. The
+// IV and the authentication tag are stored in the "iv" and "tag" header
+// parameters of the recipient
+type ByteWithIVAndTag struct {
+	ByteKey
+	IV  []byte
+	Tag []byte
+}
+
+// ByteWithSaltAndCount is the encrypted key created by Pbes2KeyWrap. The
+// salt and the iteration count are stored in the "p2s" and "p2c" header
+// parameters of the recipient
+type ByteWithSaltAndCount struct {
+	ByteKey
+	Salt  []byte
+	Count int
 }
 
 type HeaderPopulater interface {
@@ -182,8 +316,9 @@ type RandomKeyGenerate struct {
 
 type EcdhesKeyGenerate struct {
 	algorithm jwa.KeyEncryptionAlgorithm
+	algid     string // AlgorithmID used in the Concat KDF
 	keysize   int
-	pubkey    *ecdsa.PublicKey
+	pubkey    interface{} // *ecdsa.PublicKey or x25519.PublicKey
 }
 
 type DynamicKeyGenerate struct{}
@@ -197,9 +332,12 @@ type Serializer interface {
 type CompactSerialize struct{}
 
 // JSONSerialize serializes the message into JWE JSON serialized format. If you
-// set `Pretty` to true, `json.MarshalIndent` is used instead of `json.Marshal`
+// set `Pretty` to true, `json.MarshalIndent` is used instead of `json.Marshal`.
+// If you set `Flattened` to true, the flattened JSON serialization format is
+// used, which requires the message to have exactly one recipient
 type JSONSerialize struct {
-	Pretty bool
+	Pretty    bool
+	Flattened bool
 }
 
 type AeadFetcher interface {
@@ -7,22 +7,52 @@ import (
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
+	"fmt"
 
 	"github.com/lestrrat/go-jwx/buffer"
 	"github.com/lestrrat/go-jwx/internal/debug"
 	"github.com/lestrrat/go-jwx/jwa"
 	"github.com/lestrrat/go-jwx/jwk"
+	"github.com/lestrrat/go-jwx/x25519"
 )
 
 // Encrypt takes the plaintext payload and encrypts it in JWE compact format.
-func Encrypt(payload []byte, keyalg jwa.KeyEncryptionAlgorithm, key interface{}, contentalg jwa.ContentEncryptionAlgorithm, compressalg jwa.CompressionAlgorithm) ([]byte, error) {
+// If a header is given in `hdrs`, its parameters (for example "cty") are
+// included in the protected header of the resulting message.
+//
+// For the PBES2 family of algorithms `key` is the password as a []byte,
+// and the "p2c" parameter of the given header sets the iteration count.
+// PBES2DefaultCount is used if it is not set.
+//
+// If `compressalg` is jwa.Deflate, the payload is compressed before it
+// is encrypted, and the "zip" header is set accordingly.
+func Encrypt(payload []byte, keyalg jwa.KeyEncryptionAlgorithm, key interface{}, contentalg jwa.ContentEncryptionAlgorithm, compressalg jwa.CompressionAlgorithm, hdrs ...*Header) ([]byte, error) {
+	enc, err := newMultiEncrypt(keyalg, key, contentalg, compressalg, hdrs)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := enc.Encrypt(payload)
+	if err != nil {
+		debug.Printf("Encrypt: failed to encrypt: %s", err)
+		return nil, err
+	}
+
+	return CompactSerialize{}.Serialize(msg)
+}
+
+// newMultiEncrypt creates the MultiEncrypt used by Encrypt and
+// EncryptStream
+func newMultiEncrypt(keyalg jwa.KeyEncryptionAlgorithm, key interface{}, contentalg jwa.ContentEncryptionAlgorithm, compressalg jwa.CompressionAlgorithm, hdrs []*Header) (*MultiEncrypt, error) {
 	contentcrypt, err := NewAesCrypt(contentalg)
 	if err != nil {
 		return nil, err
 	}
 
+	// Unless the key management mode says otherwise, the CEK is a
+	// random key of the size required by the content encryption algorithm
+	var keygen KeyGenerator = NewRandomKeyGenerate(contentcrypt.KeySize())
 	var keyenc KeyEncrypter
-	var keysize int
 	switch keyalg {
 	case jwa.RSA1_5:
 		pubkey, ok := key.(*rsa.PublicKey)
@@ -33,7 +63,6 @@ func Encrypt(payload []byte, keyalg jwa.KeyEncryptionAlgorithm, key interface{},
 		if err != nil {
 			return nil, err
 		}
-		keysize = contentcrypt.KeySize() / 2
 	case jwa.RSA_OAEP, jwa.RSA_OAEP_256:
 		pubkey, ok := key.(*rsa.PublicKey)
 		if !ok {
@@ -43,7 +72,6 @@ func Encrypt(payload []byte, keyalg jwa.KeyEncryptionAlgorithm, key interface{},
 		if err != nil {
 			return nil, err
 		}
-		keysize = contentcrypt.KeySize() / 2
 	case jwa.A128KW, jwa.A192KW, jwa.A256KW:
 		sharedkey, ok := key.([]byte)
 		if !ok {
@@ -53,36 +81,72 @@ func Encrypt(payload []byte, keyalg jwa.KeyEncryptionAlgorithm, key interface{},
 		if err != nil {
 			return nil, err
 		}
-		keysize = contentcrypt.KeySize()
 	case jwa.ECDH_ES_A128KW, jwa.ECDH_ES_A192KW, jwa.ECDH_ES_A256KW:
-		pubkey, ok := key.(*ecdsa.PublicKey)
-		if !ok {
-			return nil, errors.New("invalid key: *ecdsa.PublicKey required")
+		switch key.(type) {
+		case *ecdsa.PublicKey, x25519.PublicKey:
+		default:
+			return nil, errors.New("invalid key: *ecdsa.PublicKey or x25519.PublicKey required")
 		}
-		keyenc, err = NewEcdhesKeyWrapEncrypt(keyalg, pubkey)
+		keyenc, err = NewEcdhesKeyWrapEncrypt(keyalg, key)
+		if err != nil {
+			return nil, err
+		}
+	case jwa.DIRECT:
+		sharedkey, err := directKey(key, contentcrypt.KeySize())
+		if err != nil {
+			return nil, err
+		}
+		// The shared key is the CEK, and is not transmitted
+		keygen = StaticKeyGenerate(sharedkey)
+		keyenc, err = NewDirectKeyEncrypt(keyalg)
 		if err != nil {
 			return nil, err
 		}
-		keysize = contentcrypt.KeySize()
 	case jwa.ECDH_ES:
-		fallthrough
+		// The CEK is derived from the key agreement, and is not transmitted
+		keygen, err = NewEcdhesDirectKeyGenerate(contentalg, key)
+		if err != nil {
+			return nil, err
+		}
+		keyenc, err = NewDirectKeyEncrypt(keyalg)
+		if err != nil {
+			return nil, err
+		}
 	case jwa.A128GCMKW, jwa.A192GCMKW, jwa.A256GCMKW:
-		fallthrough
+		sharedkey, ok := key.([]byte)
+		if !ok {
+			return nil, errors.New("invalid key: []byte required")
+		}
+		keyenc, err = NewAesGcmKeyWrap(keyalg, sharedkey)
+		if err != nil {
+			return nil, err
+		}
 	case jwa.PBES2_HS256_A128KW, jwa.PBES2_HS384_A192KW, jwa.PBES2_HS512_A256KW:
-		fallthrough
+		password, ok := key.([]byte)
+		if !ok {
+			return nil, errors.New("invalid key: []byte required")
+		}
+		// The iteration count may be specified through the "p2c"
+		// parameter of the given header
+		var count int
+		if len(hdrs) > 0 && hdrs[0] != nil {
+			count = hdrs[0].PBES2Count
+		}
+		keyenc, err = NewPbes2KeyWrap(keyalg, password, count)
+		if err != nil {
+			return nil, err
+		}
 	default:
 		debug.Printf("Encrypt: unknown key encryption algorithm: %s", keyalg)
 		return nil, ErrUnsupportedAlgorithm
 	}
 
-	enc := NewMultiEncrypt(contentcrypt, NewRandomKeyGenerate(keysize), keyenc)
-	msg, err := enc.Encrypt(payload)
-	if err != nil {
-		debug.Printf("Encrypt: failed to encrypt: %s", err)
-		return nil, err
+	enc := NewMultiEncrypt(contentcrypt, keygen, keyenc)
+	enc.Compression = compressalg
+	if len(hdrs) > 0 {
+		enc.ProtectedHeader = hdrs[0]
 	}
-
-	return CompactSerialize{}.Serialize(msg)
+	return enc, nil
 }
 
 // Decrypt takes the key encryption algorithm and the corresponding
@@ -97,6 +161,30 @@ func Decrypt(buf []byte, alg jwa.KeyEncryptionAlgorithm, key interface{}) ([]byt
 	return msg.Decrypt(alg, key)
 }
 
+// DecryptWithJWK decrypts the message using the keys in `keyset`.
+// See Message.DecryptWithJWK for how the keys are selected.
+func DecryptWithJWK(buf []byte, keyset *jwk.Set) ([]byte, error) {
+	msg, err := Parse(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.DecryptWithJWK(keyset)
+}
+
+// DecryptWithKeyID is the same as Decrypt, but only considers the
+// recipients whose "kid" header matches `kid`. Use this to pick the
+// right recipient when a message has been encrypted for multiple
+// recipients using the same algorithm.
+func DecryptWithKeyID(buf []byte, alg jwa.KeyEncryptionAlgorithm, kid string, key interface{}) ([]byte, error) {
+	msg, err := Parse(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.DecryptWithKeyID(alg, kid, key)
+}
+
 // Parse parses the JWE message into a Message object. The JWE message
 // can be either compact or full JSON format.
 func Parse(buf []byte) (*Message, error) {
@@ -126,7 +214,11 @@ func parseJSON(buf []byte) (*Message, error) {
 		return nil, err
 	}
 
-	// if the "signature" field exist, treat it as a flattened
+	if m.Message == nil {
+		return nil, errors.New("invalid message: empty json object")
+	}
+
+	// if the "header" or "encrypted_key" field exist, treat it as a flattened
 	if m.Recipient != nil {
 		if len(m.Message.Recipients) != 0 {
 			return nil, errors.New("invalid message: mixed flattened/full json serialization")
@@ -135,6 +227,22 @@ func parseJSON(buf []byte) (*Message, error) {
 		m.Message.Recipients = []Recipient{*m.Recipient}
 	}
 
+	// A flattened message may have neither, if all of the parameters
+	// are in the protected header (e.g. "dir")
+	if len(m.Message.Recipients) == 0 {
+		m.Message.Recipients = []Recipient{*NewRecipient()}
+	}
+
+	for i := range m.Message.Recipients {
+		if m.Message.Recipients[i].Header == nil {
+			m.Message.Recipients[i].Header = NewHeader()
+		}
+	}
+
+	if m.Message.UnprotectedHeader == nil {
+		m.Message.UnprotectedHeader = NewHeader()
+	}
+
 	return m.Message, nil
 }
 
@@ -156,11 +264,12 @@ func parseCompact(buf []byte) (*Message, error) {
 		return nil, err
 	}
 
-	// We need the protected header to contain the content encryption
-	// algorithm. XXX probably other headers need to go there too
+	// In the compact serialization, all of the header parameters are
+	// protected. The encoded header is kept as is, as it is used to
+	// compute the additional authenticated data
 	protected := NewEncodedHeader()
-	protected.ContentEncryption = hdr.ContentEncryption
-	hdr.ContentEncryption = ""
+	protected.Header = hdr
+	protected.encoded = buffer.Buffer(parts[0])
 
 	enckeybuf := buffer.Buffer{}
 	if err := enckeybuf.Base64Decode(parts[1]); err != nil {
@@ -183,14 +292,13 @@ func parseCompact(buf []byte) (*Message, error) {
 	}
 
 	m := NewMessage()
-	m.AuthenticatedData.SetBytes(hdrbuf.Bytes())
 	m.ProtectedHeader = protected
 	m.Tag = tagbuf
 	m.CipherText = ctbuf
 	m.InitializationVector = ivbuf
 	m.Recipients = []Recipient{
 		Recipient{
-			Header:       hdr,
+			Header:       NewHeader(),
 			EncryptedKey: enckeybuf,
 		},
 	}
@@ -221,7 +329,63 @@ func BuildKeyDecrypter(alg jwa.KeyEncryptionAlgorithm, h *Header, key interface{
 			return nil, errors.New("[]byte is required as the key to build this key decrypter")
 		}
 		return NewAesKeyWrap(alg, sharedkey)
-	case jwa.ECDH_ES_A128KW, jwa.ECDH_ES_A192KW, jwa.ECDH_ES_A256KW:
+	case jwa.DIRECT:
+		sharedkey, err := directKey(key, keysize)
+		if err != nil {
+			return nil, err
+		}
+		return NewDirectDecrypt(sharedkey), nil
+	case jwa.A128GCMKW, jwa.A192GCMKW, jwa.A256GCMKW:
+		sharedkey, ok := key.([]byte)
+		if !ok {
+			return nil, errors.New("[]byte is required as the key to build this key decrypter")
+		}
+
+		ivif, err := h.Get("iv")
+		if err != nil {
+			return nil, errors.New("'iv' key is required for this key decrypter")
+		}
+		iv, ok := ivif.(buffer.Buffer)
+		if !ok || iv.Len() == 0 {
+			return nil, errors.New("'iv' key is required for this key decrypter")
+		}
+
+		tagif, err := h.Get("tag")
+		if err != nil {
+			return nil, errors.New("'tag' key is required for this key decrypter")
+		}
+		tag, ok := tagif.(buffer.Buffer)
+		if !ok || tag.Len() == 0 {
+			return nil, errors.New("'tag' key is required for this key decrypter")
+		}
+
+		return NewAesGcmKeyUnwrap(alg, sharedkey, iv.Bytes(), tag.Bytes())
+	case jwa.PBES2_HS256_A128KW, jwa.PBES2_HS384_A192KW, jwa.PBES2_HS512_A256KW:
+		password, ok := key.([]byte)
+		if !ok {
+			return nil, errors.New("[]byte is required as the key to build this key decrypter")
+		}
+
+		saltif, err := h.Get("p2s")
+		if err != nil {
+			return nil, errors.New("'p2s' key is required for this key decrypter")
+		}
+		salt, ok := saltif.(buffer.Buffer)
+		if !ok {
+			return nil, errors.New("'p2s' key is required for this key decrypter")
+		}
+
+		countif, err := h.Get("p2c")
+		if err != nil {
+			return nil, errors.New("'p2c' key is required for this key decrypter")
+		}
+		count, ok := countif.(int)
+		if !ok {
+			return nil, errors.New("'p2c' key is required for this key decrypter")
+		}
+
+		return NewPbes2KeyUnwrap(alg, password, salt.Bytes(), count)
+	case jwa.ECDH_ES, jwa.ECDH_ES_A128KW, jwa.ECDH_ES_A192KW, jwa.ECDH_ES_A256KW:
 		epkif, err := h.Get("epk")
 		if err != nil {
 			return nil, err
@@ -230,20 +394,22 @@ func BuildKeyDecrypter(alg jwa.KeyEncryptionAlgorithm, h *Header, key interface{
 			return nil, errors.New("'epk' header is required as the key to build this key decrypter")
 		}
 
-		epk, ok := epkif.(*jwk.EcdsaPublicKey)
-		if !ok {
+		epk, ok := epkif.(jwk.Key)
+		if !ok || epk == nil {
 			return nil, errors.New("'epk' header is required as the key to build this key decrypter")
 		}
 
-		pubkey, err := epk.PublicKey()
+		pubkey, err := epk.Materialize()
 		if err != nil {
 			return nil, err
 		}
 
-		privkey, ok := key.(*ecdsa.PrivateKey)
-		if !ok {
-			return nil, errors.New("*rsa.PrivateKey is required as the key to build this key decrypter")
+		switch key.(type) {
+		case *ecdsa.PrivateKey, x25519.PrivateKey:
+		default:
+			return nil, errors.New("*ecdsa.PrivateKey or x25519.PrivateKey is required as the key to build this key decrypter")
 		}
+
 		apuif, err := h.Get("apu")
 		if err != nil {
 			return nil, errors.New("'apu' key is required for this key decrypter")
@@ -262,12 +428,34 @@ func BuildKeyDecrypter(alg jwa.KeyEncryptionAlgorithm, h *Header, key interface{
 			return nil, errors.New("'apv' key is required for this key decrypter")
 		}
 
-		return NewEcdhesKeyWrapDecrypt(alg, pubkey, apu.Bytes(), apv.Bytes(), privkey), nil
+		if alg == jwa.ECDH_ES {
+			return NewEcdhesDirectDecrypt(h.ContentEncryption, keysize, pubkey, apu.Bytes(), apv.Bytes(), key), nil
+		}
+		return NewEcdhesKeyWrapDecrypt(alg, pubkey, apu.Bytes(), apv.Bytes(), key), nil
 	}
 
 	return nil, NewErrUnsupportedAlgorithm(string(alg), "key decryption")
 }
 
+// directKey extracts the shared key for direct encryption, and checks
+// that its size matches the size of the CEK
+func directKey(key interface{}, keysize int) ([]byte, error) {
+	var sharedkey []byte
+	switch v := key.(type) {
+	case []byte:
+		sharedkey = v
+	case *jwk.SymmetricKey:
+		sharedkey = v.Octets()
+	default:
+		return nil, errors.New("invalid key: []byte or *jwk.SymmetricKey required")
+	}
+
+	if len(sharedkey) != keysize {
+		return nil, fmt.Errorf("invalid key size for direct encryption (expected %d, got %d)", keysize, len(sharedkey))
+	}
+	return sharedkey, nil
+}
+
 func BuildContentCipher(alg jwa.ContentEncryptionAlgorithm) (ContentCipher, error) {
 	switch alg {
 	case jwa.A128GCM, jwa.A192GCM, jwa.A256GCM, jwa.A128CBC_HS256, jwa.A192CBC_HS384, jwa.A256CBC_HS512:
@@ -1,20 +1,30 @@
 package jwe
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"testing"
 
+	"github.com/lestrrat/go-jwx/buffer"
 	"github.com/lestrrat/go-jwx/internal/rsautil"
 	"github.com/lestrrat/go-jwx/jwa"
+	"github.com/lestrrat/go-jwx/jwk"
+	"github.com/lestrrat/go-jwx/x25519"
 	"github.com/stretchr/testify/assert"
 )
 
 const examplePayload = `The true sign of intelligence is not knowledge but imagination.`
 
+// rfc7520Plaintext is the plaintext used in the examples in
+// https://tools.ietf.org/html/rfc7520#section-5
+const rfc7520Plaintext = "You can trust us to stick with you through thick and thin\u2013to the bitter end. And you can trust us to keep any secret of yours\u2013closer than you keep it yourself. But you cannot trust us to let you face trouble alone, and go off without a word. We are your friends, Frodo."
+
 var rsaPrivKey *rsa.PrivateKey
 
 func init() {
@@ -155,7 +165,6 @@ func TestLowLevelParts_A128KW_A128CBCHS256(t *testing.T) {
 
 	msg := NewMessage()
 	msg.ProtectedHeader = protected
-	msg.AuthenticatedData = aad
 	msg.CipherText = ciphertext
 	msg.InitializationVector = iv
 	msg.Tag = tag
@@ -353,3 +362,1017 @@ func TestEncode_ECDHES(t *testing.T) {
 	}
 	t.Logf("%s", decrypted)
 }
+
+func TestEncode_ECDHES_X25519(t *testing.T) {
+	plaintext := []byte("Lorem ipsum")
+	pubkey, privkey, err := x25519.GenerateKey(rand.Reader)
+	if !assert.NoError(t, err, "x25519 key generated") {
+		return
+	}
+
+	for _, alg := range []jwa.KeyEncryptionAlgorithm{jwa.ECDH_ES_A128KW, jwa.ECDH_ES_A192KW, jwa.ECDH_ES_A256KW} {
+		encrypted, err := Encrypt(plaintext, alg, pubkey, jwa.A128CBC_HS256, jwa.NoCompress)
+		if !assert.NoError(t, err, "Encrypt succeeds") {
+			return
+		}
+
+		msg, err := Parse(encrypted)
+		if !assert.NoError(t, err, "Parse succeeds") {
+			return
+		}
+
+		epk, ok := msg.ProtectedHeader.EphemeralPublicKey.(*jwk.OKPPublicKey)
+		if !assert.True(t, ok, "epk is an OKP key") {
+			return
+		}
+		if !assert.Equal(t, jwa.X25519, epk.Curve, "epk curve is X25519") {
+			return
+		}
+
+		decrypted, err := Decrypt(encrypted, alg, privkey)
+		if !assert.NoError(t, err, "Decrypt succeeds") {
+			return
+		}
+		if !assert.Equal(t, plaintext, decrypted, "Decrypted content matches") {
+			return
+		}
+	}
+
+	if _, err := Encrypt(plaintext, jwa.ECDH_ES_A128KW, privkey, jwa.A128CBC_HS256, jwa.NoCompress); !assert.Error(t, err, "Encrypt with a private key fails") {
+		return
+	}
+}
+
+// RFC 8037 has no JWE example, so this message was created for Bob's
+// key from Appendix A.6 using github.com/lestrrat-go/jwx/v2 (v2.1.6)
+func TestDecrypt_ECDHES_X25519(t *testing.T) {
+	const jwksrc = `{"kty":"OKP","crv":"X25519","kid":"Bob","x":"3p7bfXt9wbTTW2HC7OQ1Nz-DQ8hbeGdNrfx-FG-IK08","d":"XasIfmJKikt54X-Lg4AO5m87sSkmGLb9HC-LJ_-I4Os"}`
+	const encrypted = "eyJhbGciOiJFQ0RILUVTK0ExMjhLVyIsImVuYyI6IkExMjhHQ00iLCJlcGsiOnsiY3J2IjoiWDI1NTE5Iiwia3R5IjoiT0tQIiwieCI6ImRoX2luTlBySlJzbTFlOGZrNDgwVDRPUU9ralFpR09Xak03LUphU05UQlkifSwia2lkIjoiQm9iIn0" +
+		"." +
+		"yzLaazXfs7z91aVis7KhhhA_M8Es2CEU" +
+		"." +
+		"_Eb5KDYqOfzfVnvD" +
+		"." +
+		"wcHFKUio8EwKkZM" +
+		"." +
+		"4opKHKMDVQJKM16rionVXw"
+
+	set, err := jwk.ParseString(jwksrc)
+	if !assert.NoError(t, err, "Parsing JWK succeeds") {
+		return
+	}
+	privkey, err := set.Keys[0].Materialize()
+	if !assert.NoError(t, err, "Materialize succeeds") {
+		return
+	}
+
+	decrypted, err := Decrypt([]byte(encrypted), jwa.ECDH_ES_A128KW, privkey)
+	if !assert.NoError(t, err, "Decrypt succeeds") {
+		return
+	}
+	if !assert.Equal(t, []byte("Lorem ipsum"), decrypted, "Decrypted content matches") {
+		return
+	}
+}
+
+func TestEncode_ECDHES_Direct(t *testing.T) {
+	plaintext := []byte("Lorem ipsum")
+	ecpriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err, "ecdsa key generated") {
+		return
+	}
+	xpub, xpriv, err := x25519.GenerateKey(rand.Reader)
+	if !assert.NoError(t, err, "x25519 key generated") {
+		return
+	}
+
+	keys := []struct {
+		pubkey  interface{}
+		privkey interface{}
+	}{
+		{&ecpriv.PublicKey, ecpriv},
+		{xpub, xpriv},
+	}
+
+	for _, key := range keys {
+		for _, contentalg := range []jwa.ContentEncryptionAlgorithm{jwa.A128GCM, jwa.A256GCM, jwa.A128CBC_HS256, jwa.A256CBC_HS512} {
+			encrypted, err := Encrypt(plaintext, jwa.ECDH_ES, key.pubkey, contentalg, jwa.NoCompress)
+			if !assert.NoError(t, err, "Encrypt succeeds") {
+				return
+			}
+
+			parts := bytes.Split(encrypted, []byte{'.'})
+			if !assert.Len(t, parts, 5, "compact serialization has 5 parts") {
+				return
+			}
+			if !assert.Empty(t, parts[1], "encrypted key is empty") {
+				return
+			}
+
+			decrypted, err := Decrypt(encrypted, jwa.ECDH_ES, key.privkey)
+			if !assert.NoError(t, err, "Decrypt succeeds") {
+				return
+			}
+			if !assert.Equal(t, plaintext, decrypted, "Decrypted content matches") {
+				return
+			}
+		}
+	}
+}
+
+// TestDecrypt_ECDHES_KeyAgreement checks the key derived for direct
+// ECDH-ES against https://tools.ietf.org/html/rfc7518#appendix-C
+func TestDecrypt_ECDHES_KeyAgreement(t *testing.T) {
+	const jwksrc = `{"kty":"EC","crv":"P-256","x":"weNJy2HscCSM6AEDTDg04biOvhFhyyWvOHQfeF_PxMQ","y":"e8lnCO-AlStT-NJVX-crhB7QRYhiix03illJOVAOyck","d":"VEmDZpDXXK8p8N0Cndsxs924q6nS1RXFASRl6BfUqdw"}`
+	const hdrsrc = `{"alg":"ECDH-ES","enc":"A128GCM","apu":"QWxpY2U","apv":"Qm9i","epk":{"kty":"EC","crv":"P-256","x":"gI0GAILBdu7T53akrFmMyGcsF3n5dO7MmwNBHKW5SV0","y":"SLW_xSffzlPWrHEVI30DHM_4egVwt3NQqeUD7nMFpps"}}`
+
+	set, err := jwk.ParseString(jwksrc)
+	if !assert.NoError(t, err, "Parsing JWK succeeds") {
+		return
+	}
+	privkey, err := set.Keys[0].Materialize()
+	if !assert.NoError(t, err, "Materialize succeeds") {
+		return
+	}
+
+	h := NewHeader()
+	if !assert.NoError(t, json.Unmarshal([]byte(hdrsrc), h), "Parsing header succeeds") {
+		return
+	}
+
+	kd, err := BuildKeyDecrypter(h.Algorithm, h, privkey, 16)
+	if !assert.NoError(t, err, "BuildKeyDecrypter succeeds") {
+		return
+	}
+
+	key, err := kd.KeyDecrypt(nil)
+	if !assert.NoError(t, err, "KeyDecrypt succeeds") {
+		return
+	}
+
+	expected, err := buffer.FromBase64([]byte("VqqN6vgjbSBcIijNcacQGg"))
+	if !assert.NoError(t, err, "decoding expected key succeeds") {
+		return
+	}
+	if !assert.Equal(t, expected.Bytes(), key, "derived key matches") {
+		return
+	}
+
+	if _, err := kd.KeyDecrypt([]byte("foo")); !assert.Error(t, err, "non-empty encrypted key is rejected") {
+		return
+	}
+}
+
+func TestEncode_AesGcmKeyWrap(t *testing.T) {
+	plaintext := []byte("Lorem ipsum")
+	for _, alg := range []jwa.KeyEncryptionAlgorithm{jwa.A128GCMKW, jwa.A192GCMKW, jwa.A256GCMKW} {
+		keysize, err := aesGcmKeySize(alg)
+		if !assert.NoError(t, err, "key size for %s", alg) {
+			return
+		}
+		sharedkey := make([]byte, keysize)
+		rand.Read(sharedkey)
+
+		encrypted, err := Encrypt(plaintext, alg, sharedkey, jwa.A128CBC_HS256, jwa.NoCompress)
+		if !assert.NoError(t, err, "Encrypt succeeds") {
+			return
+		}
+
+		msg, err := Parse(encrypted)
+		if !assert.NoError(t, err, "Parse succeeds") {
+			return
+		}
+		if !assert.Len(t, msg.ProtectedHeader.InitializationVector.Bytes(), 12, "'iv' header is populated") {
+			return
+		}
+		if !assert.Len(t, msg.ProtectedHeader.Tag.Bytes(), 16, "'tag' header is populated") {
+			return
+		}
+
+		decrypted, err := Decrypt(encrypted, alg, sharedkey)
+		if !assert.NoError(t, err, "Decrypt succeeds") {
+			return
+		}
+		if !assert.Equal(t, plaintext, decrypted, "Decrypted content matches") {
+			return
+		}
+
+		if _, err := Decrypt(encrypted, alg, make([]byte, keysize)); !assert.Error(t, err, "Decrypt with the wrong key fails") {
+			return
+		}
+	}
+
+	if _, err := Encrypt(plaintext, jwa.A128GCMKW, make([]byte, 32), jwa.A128CBC_HS256, jwa.NoCompress); !assert.Error(t, err, "Encrypt with the wrong key size fails") {
+		return
+	}
+}
+
+// TestDecrypt_AesGcmKeyWrap decrypts the example from
+// https://tools.ietf.org/html/rfc7520#section-5.7
+func TestDecrypt_AesGcmKeyWrap(t *testing.T) {
+	const jwksrc = `{"kty":"oct","kid":"18ec08e1-bfa9-4d95-b205-2b4dd1d4321d","use":"enc","alg":"A256GCMKW","k":"qC57l_uxcm7Nm3K-ct4GFjx8tM1U8CZ0NLBvdQstiS8"}`
+	const encrypted = `eyJhbGciOiJBMjU2R0NNS1ciLCJraWQiOiIxOGVjMDhlMS1iZmE5LTRkOTUtYjIwNS0yYjRkZDFkNDMyMWQiLCJ0YWciOiJrZlBkdVZRM1QzSDZ2bmV3dC0ta3N3IiwiaXYiOiJLa1lUMEdYXzJqSGxmcU5fIiwiZW5jIjoiQTEyOENCQy1IUzI1NiJ9.lJf3HbOApxMEBkCMOoTnnABxs_CvTWUmZQ2ElLvYNok.gz6NjyEFNm_vm8Gj6FwoFQ.Jf5p9-ZhJlJy_IQ_byKFmI0Ro7w7G1QiaZpI8OaiVgD8EqoDZHyFKFBupS8iaEeVIgMqWmsuJKuoVgzR3YfzoMd3GxEm3VxNhzWyWtZKX0gxKdy6HgLvqoGNbZCzLjqcpDiF8q2_62EVAbr2uSc2oaxFmFuIQHLcqAHxy51449xkjZ7ewzZaGV3eFqhpco8o4DijXaG5_7kp3h2cajRfDgymuxUbWgLqaeNQaJtvJmSMFuEOSAzw9Hdeb6yhdTynCRmu-kqtO5Dec4lT2OMZKpnxc_F1_4yDJFcqb5CiDSmA-psB2k0JtjxAj4UPI61oONK7zzFIu4gBfjJCndsZfdvG7h8wGjV98QhrKEnR7xKZ3KCr0_qR1B-gxpNk3xWU.DKW7jrb4WaRSNfbXVPlT5g`
+
+	set, err := jwk.ParseString(jwksrc)
+	if !assert.NoError(t, err, "Parsing JWK succeeds") {
+		return
+	}
+	sharedkey, err := set.Keys[0].Materialize()
+	if !assert.NoError(t, err, "Materialize succeeds") {
+		return
+	}
+
+	decrypted, err := Decrypt([]byte(encrypted), jwa.A256GCMKW, sharedkey)
+	if !assert.NoError(t, err, "Decrypt succeeds") {
+		return
+	}
+	if !assert.Equal(t, rfc7520Plaintext, string(decrypted), "Decrypted content matches") {
+		return
+	}
+}
+
+func TestEncode_PBES2(t *testing.T) {
+	plaintext := []byte("Lorem ipsum")
+	password := []byte("entrap_o–peter_long–credit_tun")
+
+	for _, alg := range []jwa.KeyEncryptionAlgorithm{jwa.PBES2_HS256_A128KW, jwa.PBES2_HS384_A192KW, jwa.PBES2_HS512_A256KW} {
+		h := NewHeader()
+		h.Set("p2c", 4096)
+
+		encrypted, err := Encrypt(plaintext, alg, password, jwa.A128CBC_HS256, jwa.NoCompress, h)
+		if !assert.NoError(t, err, "Encrypt succeeds") {
+			return
+		}
+
+		msg, err := Parse(encrypted)
+		if !assert.NoError(t, err, "Parse succeeds") {
+			return
+		}
+		if !assert.Equal(t, 4096, msg.ProtectedHeader.PBES2Count, "'p2c' header is populated") {
+			return
+		}
+		if !assert.Len(t, msg.ProtectedHeader.PBES2Salt.Bytes(), 16, "'p2s' header is populated") {
+			return
+		}
+
+		decrypted, err := Decrypt(encrypted, alg, password)
+		if !assert.NoError(t, err, "Decrypt succeeds") {
+			return
+		}
+		if !assert.Equal(t, plaintext, decrypted, "Decrypted content matches") {
+			return
+		}
+
+		if _, err := Decrypt(encrypted, alg, []byte("wrong password")); !assert.Error(t, err, "Decrypt with the wrong password fails") {
+			return
+		}
+	}
+
+	h := NewHeader()
+	h.Set("p2c", PBES2MinCount-1)
+	if _, err := Encrypt(plaintext, jwa.PBES2_HS256_A128KW, password, jwa.A128CBC_HS256, jwa.NoCompress, h); !assert.Error(t, err, "Encrypt with a small iteration count fails") {
+		return
+	}
+}
+
+func TestDecrypt_PBES2MaxCount(t *testing.T) {
+	password := []byte("secret")
+
+	h := NewHeader()
+	h.Set("p2c", PBES2MinCount)
+	encrypted, err := Encrypt([]byte("Lorem ipsum"), jwa.PBES2_HS256_A128KW, password, jwa.A128GCM, jwa.NoCompress, h)
+	if !assert.NoError(t, err, "Encrypt succeeds") {
+		return
+	}
+
+	defer func(v int) { PBES2MaxCount = v }(PBES2MaxCount)
+	PBES2MaxCount = PBES2MinCount - 1
+
+	if _, err := Decrypt(encrypted, jwa.PBES2_HS256_A128KW, password); !assert.Error(t, err, "Decrypt with a large iteration count fails") {
+		return
+	}
+
+	salt := make([]byte, 16)
+	if _, err := NewPbes2KeyUnwrap(jwa.PBES2_HS256_A128KW, password, salt, PBES2MinCount); !assert.Error(t, err, "NewPbes2KeyUnwrap with a large iteration count fails") {
+		return
+	}
+}
+
+func TestEncode_Direct(t *testing.T) {
+	plaintext := []byte("Lorem ipsum")
+	for _, contentalg := range []jwa.ContentEncryptionAlgorithm{jwa.A128GCM, jwa.A256GCM, jwa.A128CBC_HS256, jwa.A256CBC_HS512} {
+		cc, err := BuildContentCipher(contentalg)
+		if !assert.NoError(t, err, "BuildContentCipher succeeds") {
+			return
+		}
+		sharedkey := make([]byte, cc.KeySize())
+		rand.Read(sharedkey)
+
+		symkey := &jwk.SymmetricKey{EssentialHeader: &jwk.EssentialHeader{KeyType: jwa.OctetSeq}, Key: sharedkey}
+		for _, key := range []interface{}{sharedkey, symkey} {
+			encrypted, err := Encrypt(plaintext, jwa.DIRECT, key, contentalg, jwa.NoCompress)
+			if !assert.NoError(t, err, "Encrypt succeeds") {
+				return
+			}
+
+			parts := bytes.Split(encrypted, []byte{'.'})
+			if !assert.Len(t, parts, 5, "compact serialization has 5 parts") {
+				return
+			}
+			if !assert.Empty(t, parts[1], "encrypted key is empty") {
+				return
+			}
+
+			decrypted, err := Decrypt(encrypted, jwa.DIRECT, key)
+			if !assert.NoError(t, err, "Decrypt succeeds") {
+				return
+			}
+			if !assert.Equal(t, plaintext, decrypted, "Decrypted content matches") {
+				return
+			}
+		}
+
+		if _, err := Encrypt(plaintext, jwa.DIRECT, sharedkey[1:], contentalg, jwa.NoCompress); !assert.Error(t, err, "Encrypt with the wrong key size fails") {
+			return
+		}
+	}
+}
+
+func TestDecrypt_Direct(t *testing.T) {
+	// https://tools.ietf.org/html/rfc7520#section-5.6
+	const jwksrc = `{"kty":"oct","kid":"77c7e2b8-6e13-45cf-8672-617b5b45243a","use":"enc","alg":"A128GCM","k":"XctOhJAkA-pD9Lh7ZgW_2A"}`
+	const encrypted = "eyJhbGciOiJkaXIiLCJraWQiOiI3N2M3ZTJiOC02ZTEzLTQ1Y2YtODY3Mi02MTdiNWI0NTI0M2EiLCJlbmMiOiJBMTI4R0NNIn0" +
+		"." +
+		"." +
+		"refa467QzzKx6QAB" +
+		"." +
+		"JW_i_f52hww_ELQPGaYyeAB6HYGcR559l9TYnSovc23XJoBcW29rHP8yZOZG7YhLpT1bjFuvZPjQS-m0IFtVcXkZXdH_lr_FrdYt9HRUYkshtrMmIUAyGmUnd9zMDB2n0cRDIHAzFVeJUDxkUwVAE7_YGRPdcqMyiBoCO-FBdE-Nceb4h3-FtBP-c_BIwCPTjb9o0SbdcdREEMJMyZBH8ySWMVi1gPD9yxi-aQpGbSv_F9N4IZAxscj5g-NJsUPbjk29-s7LJAGb15wEBtXphVCgyy53CoIKLHHeJHXex45Uz9aKZSRSInZI-wjsY0yu3cT4_aQ3i1o-tiE-F8Ios61EKgyIQ4CWao8PFMj8TTnp" +
+		"." +
+		"vbb32Xvllea2OtmHAdccRQ"
+
+	set, err := jwk.ParseString(jwksrc)
+	if !assert.NoError(t, err, "Parsing JWK succeeds") {
+		return
+	}
+	symkey, ok := set.Keys[0].(*jwk.SymmetricKey)
+	if !assert.True(t, ok, "key is a symmetric key") {
+		return
+	}
+
+	decrypted, err := Decrypt([]byte(encrypted), jwa.DIRECT, symkey)
+	if !assert.NoError(t, err, "Decrypt succeeds") {
+		return
+	}
+	if !assert.Equal(t, rfc7520Plaintext, string(decrypted), "Decrypted content matches") {
+		return
+	}
+
+	if _, err := Decrypt([]byte(encrypted), jwa.DIRECT, make([]byte, 16)); !assert.Error(t, err, "Decrypt with the wrong key fails") {
+		return
+	}
+}
+
+func TestEncode_Deflate(t *testing.T) {
+	plaintext := bytes.Repeat([]byte(rfc7520Plaintext), 10)
+	sharedkey := make([]byte, 16)
+	rand.Read(sharedkey)
+
+	encrypted, err := Encrypt(plaintext, jwa.A128KW, sharedkey, jwa.A128GCM, jwa.Deflate)
+	if !assert.NoError(t, err, "Encrypt succeeds") {
+		return
+	}
+
+	msg, err := Parse(encrypted)
+	if !assert.NoError(t, err, "Parse succeeds") {
+		return
+	}
+	if !assert.Equal(t, jwa.Deflate, msg.ProtectedHeader.Compression, "'zip' header is populated") {
+		return
+	}
+	if !assert.True(t, msg.CipherText.Len() < len(plaintext), "ciphertext is compressed") {
+		return
+	}
+
+	decrypted, err := Decrypt(encrypted, jwa.A128KW, sharedkey)
+	if !assert.NoError(t, err, "Decrypt succeeds") {
+		return
+	}
+	if !assert.Equal(t, plaintext, decrypted, "Decrypted content matches") {
+		return
+	}
+
+	defer func(v int64) { MaxDecompressedSize = v }(MaxDecompressedSize)
+	MaxDecompressedSize = int64(len(plaintext) - 1)
+	if _, err := Decrypt(encrypted, jwa.A128KW, sharedkey); !assert.Equal(t, ErrDecompressedTooLarge, err, "Decrypt fails when the plaintext is too large") {
+		return
+	}
+
+	if _, err := Encrypt(plaintext, jwa.A128KW, sharedkey, jwa.A128GCM, jwa.CompressionAlgorithm("XXX")); !assert.Error(t, err, "Encrypt with an unknown compression algorithm fails") {
+		return
+	}
+}
+
+func TestDecrypt_UnprotectedCompression(t *testing.T) {
+	plaintext := []byte("Lorem ipsum")
+	sharedkey := make([]byte, 16)
+	rand.Read(sharedkey)
+
+	contentcrypt, err := NewAesCrypt(jwa.A128GCM)
+	if !assert.NoError(t, err, "NewAesCrypt succeeds") {
+		return
+	}
+	keyenc, err := NewAesKeyWrap(jwa.A128KW, sharedkey)
+	if !assert.NoError(t, err, "NewAesKeyWrap succeeds") {
+		return
+	}
+
+	enc := NewMultiEncrypt(contentcrypt, NewRandomKeyGenerate(contentcrypt.KeySize()), keyenc)
+	enc.UnprotectedHeader = NewHeader()
+	enc.UnprotectedHeader.Set("zip", jwa.Deflate)
+	if _, err := enc.Encrypt(plaintext); !assert.Equal(t, ErrUnprotectedCompression, err, "Encrypt with 'zip' in the unprotected header fails") {
+		return
+	}
+
+	enc.UnprotectedHeader = nil
+	for _, setzip := range []func(*Message){
+		func(msg *Message) { msg.UnprotectedHeader.Set("zip", jwa.Deflate) },
+		func(msg *Message) { msg.Recipients[0].Header.Set("zip", jwa.Deflate) },
+	} {
+		msg, err := enc.Encrypt(plaintext)
+		if !assert.NoError(t, err, "Encrypt succeeds") {
+			return
+		}
+		setzip(msg)
+
+		encrypted, err := JSONSerialize{}.Serialize(msg)
+		if !assert.NoError(t, err, "JSONSerialize succeeds") {
+			return
+		}
+
+		if _, err := Decrypt(encrypted, jwa.A128KW, sharedkey); !assert.Equal(t, ErrUnprotectedCompression, err, "Decrypt with 'zip' outside of the protected header fails") {
+			return
+		}
+		if !assert.Equal(t, ErrUnprotectedCompression, DecryptStream(ioutil.Discard, bytes.NewReader(encrypted), jwa.A128KW, sharedkey), "DecryptStream with 'zip' outside of the protected header fails") {
+			return
+		}
+	}
+}
+
+func TestDecrypt_DuplicateHeaderParameter(t *testing.T) {
+	plaintext := []byte("Lorem ipsum")
+	sharedkey := make([]byte, 16)
+	rand.Read(sharedkey)
+
+	contentcrypt, err := NewAesCrypt(jwa.A128GCM)
+	if !assert.NoError(t, err, "NewAesCrypt succeeds") {
+		return
+	}
+	keyenc, err := NewAesKeyWrap(jwa.A128KW, sharedkey)
+	if !assert.NoError(t, err, "NewAesKeyWrap succeeds") {
+		return
+	}
+
+	enc := NewMultiEncrypt(contentcrypt, NewRandomKeyGenerate(contentcrypt.KeySize()), keyenc)
+	enc.UnprotectedHeader = NewHeader()
+	enc.UnprotectedHeader.Set("enc", jwa.A256GCM)
+	if _, err := enc.Encrypt(plaintext); !assert.Equal(t, ErrDuplicateHeaderParameter, err, "Encrypt with 'enc' in both the protected and the unprotected header fails") {
+		return
+	}
+
+	// RFC 7516 Section 7.2.1: the header parameters in the protected,
+	// unprotected and per-recipient headers must be disjoint
+	enc.UnprotectedHeader = nil
+	for _, duplicate := range []func(*Message){
+		func(msg *Message) { msg.UnprotectedHeader.Set("alg", jwa.A128KW) },
+		func(msg *Message) { msg.Recipients[0].Header.Set("enc", jwa.A128GCM) },
+		func(msg *Message) {
+			msg.UnprotectedHeader.Set("kid", "foo")
+			msg.Recipients[0].Header.Set("kid", "bar")
+		},
+	} {
+		msg, err := enc.Encrypt(plaintext)
+		if !assert.NoError(t, err, "Encrypt succeeds") {
+			return
+		}
+		duplicate(msg)
+
+		encrypted, err := JSONSerialize{}.Serialize(msg)
+		if !assert.NoError(t, err, "JSONSerialize succeeds") {
+			return
+		}
+
+		if _, err := Decrypt(encrypted, jwa.A128KW, sharedkey); !assert.Equal(t, ErrDuplicateHeaderParameter, err, "Decrypt with a duplicate header parameter fails") {
+			return
+		}
+		if !assert.Equal(t, ErrDuplicateHeaderParameter, DecryptStream(ioutil.Discard, bytes.NewReader(encrypted), jwa.A128KW, sharedkey), "DecryptStream with a duplicate header parameter fails") {
+			return
+		}
+	}
+}
+
+func TestDecrypt_Deflate(t *testing.T) {
+	// https://tools.ietf.org/html/rfc7520#section-5.9
+	const encrypted = "eyJhbGciOiJBMTI4S1ciLCJraWQiOiI4MWIyMDk2NS04MzMyLTQzZDktYTQ2OC04MjE2MGFkOTFhYzgiLCJlbmMiOiJBMTI4R0NNIiwiemlwIjoiREVGIn0" +
+		"." +
+		"5vUT2WOtQxKWcekM_IzVQwkGgzlFDwPi" +
+		"." +
+		"p9pUq6XHY0jfEZIl" +
+		"." +
+		"HbDtOsdai1oYziSx25KEeTxmwnh8L8jKMFNc1k3zmMI6VB8hry57tDZ61jXyezSPt0fdLVfe6Jf5y5-JaCap_JQBcb5opbmT60uWGml8blyiMQmOn9J--XhhlYg0m-BHaqfDO5iTOWxPxFMUedx7WCy8mxgDHj0aBMG6152PsM-w5E_o2B3jDbrYBKhpYA7qi3AyijnCJ7BP9rr3U8kxExCpG3mK420TjOw" +
+		"." +
+		"VILuUwuIxaLVmh5X-T7kmA"
+	sharedkey, _ := buffer.FromBase64([]byte("GZy6sIZ6wl9NJOKB-jnmVQ"))
+
+	msg, err := Parse([]byte(encrypted))
+	if !assert.NoError(t, err, "Parse succeeds") {
+		return
+	}
+	if !assert.Equal(t, jwa.Deflate, msg.ProtectedHeader.Compression, "'zip' header is parsed") {
+		return
+	}
+
+	decrypted, err := Decrypt([]byte(encrypted), jwa.A128KW, sharedkey.Bytes())
+	if !assert.NoError(t, err, "Decrypt succeeds") {
+		return
+	}
+	if !assert.Equal(t, rfc7520Plaintext, string(decrypted), "Decrypted content matches") {
+		return
+	}
+}
+
+func TestEncode_MultipleRecipients(t *testing.T) {
+	plaintext := []byte("Lorem ipsum")
+	aad := []byte("additional authenticated data")
+
+	kwkey1 := make([]byte, 16)
+	rand.Read(kwkey1)
+	kwkey2 := make([]byte, 16)
+	rand.Read(kwkey2)
+	gcmkey := make([]byte, 32)
+	rand.Read(gcmkey)
+
+	contentcrypt, err := NewAesCrypt(jwa.A128CBC_HS256)
+	if !assert.NoError(t, err, "NewAesCrypt succeeds") {
+		return
+	}
+
+	ke1, _ := NewAesKeyWrap(jwa.A128KW, kwkey1)
+	ke1.KeyID = "kw1"
+	ke2, _ := NewAesKeyWrap(jwa.A128KW, kwkey2)
+	ke2.KeyID = "kw2"
+	ke3, err := NewAesGcmKeyWrap(jwa.A256GCMKW, gcmkey)
+	if !assert.NoError(t, err, "NewAesGcmKeyWrap succeeds") {
+		return
+	}
+	ke3.KeyID = "gcm"
+	ke4, err := NewRSAOAEPKeyEncrypt(jwa.RSA_OAEP, &rsaPrivKey.PublicKey)
+	if !assert.NoError(t, err, "NewRSAOAEPKeyEncrypt succeeds") {
+		return
+	}
+	ke4.KeyID = "rsa"
+
+	unprotected := NewHeader()
+	unprotected.Set("cty", "text/plain")
+
+	enc := NewMultiEncrypt(contentcrypt, NewRandomKeyGenerate(contentcrypt.KeySize()), ke1, ke2, ke3, ke4)
+	enc.UnprotectedHeader = unprotected
+	enc.AuthenticatedData = aad
+
+	msg, err := enc.Encrypt(plaintext)
+	if !assert.NoError(t, err, "Encrypt succeeds") {
+		return
+	}
+
+	if _, err := (CompactSerialize{}).Serialize(msg); !assert.Error(t, err, "compact serialization fails") {
+		return
+	}
+	if _, err := (JSONSerialize{Flattened: true}).Serialize(msg); !assert.Error(t, err, "flattened serialization fails") {
+		return
+	}
+
+	serialized, err := JSONSerialize{}.Serialize(msg)
+	if !assert.NoError(t, err, "JSON serialization succeeds") {
+		return
+	}
+
+	var raw map[string]interface{}
+	if !assert.NoError(t, json.Unmarshal(serialized, &raw), "serialized message is a JSON object") {
+		return
+	}
+	for _, name := range []string{"protected", "unprotected", "recipients", "aad", "iv", "ciphertext", "tag"} {
+		if !assert.Contains(t, raw, name, "%s exists", name) {
+			return
+		}
+	}
+
+	parsed, err := Parse(serialized)
+	if !assert.NoError(t, err, "Parse succeeds") {
+		return
+	}
+	if !assert.Len(t, parsed.Recipients, 4, "there are 4 recipients") {
+		return
+	}
+	if !assert.Equal(t, "text/plain", parsed.UnprotectedHeader.ContentType, "unprotected header is parsed") {
+		return
+	}
+	if !assert.Equal(t, aad, parsed.AuthenticatedData.Bytes(), "aad is parsed") {
+		return
+	}
+	if !assert.Equal(t, "gcm", parsed.Recipients[2].Header.KeyID, "recipient header is parsed") {
+		return
+	}
+
+	reserialized, err := JSONSerialize{}.Serialize(parsed)
+	if !assert.NoError(t, err, "JSON serialization succeeds") {
+		return
+	}
+	if !assert.Equal(t, string(serialized), string(reserialized), "serialization round trips") {
+		return
+	}
+
+	keys := []struct {
+		alg jwa.KeyEncryptionAlgorithm
+		kid string
+		key interface{}
+	}{
+		{jwa.A128KW, "kw1", kwkey1},
+		{jwa.A128KW, "kw2", kwkey2},
+		{jwa.A256GCMKW, "gcm", gcmkey},
+		{jwa.RSA_OAEP, "rsa", rsaPrivKey},
+	}
+	for _, key := range keys {
+		decrypted, err := Decrypt(serialized, key.alg, key.key)
+		if !assert.NoError(t, err, "Decrypt succeeds (kid = %s)", key.kid) {
+			return
+		}
+		if !assert.Equal(t, plaintext, decrypted, "Decrypted content matches (kid = %s)", key.kid) {
+			return
+		}
+
+		decrypted, err = DecryptWithKeyID(serialized, key.alg, key.kid, key.key)
+		if !assert.NoError(t, err, "DecryptWithKeyID succeeds (kid = %s)", key.kid) {
+			return
+		}
+		if !assert.Equal(t, plaintext, decrypted, "Decrypted content matches (kid = %s)", key.kid) {
+			return
+		}
+	}
+
+	if _, err := DecryptWithKeyID(serialized, jwa.A128KW, "kw1", kwkey2); !assert.Error(t, err, "DecryptWithKeyID with the wrong key fails") {
+		return
+	}
+
+	parsed.AuthenticatedData = buffer.Buffer("tampered")
+	if _, err := parsed.Decrypt(jwa.A128KW, kwkey1); !assert.Error(t, err, "Decrypt with tampered aad fails") {
+		return
+	}
+}
+
+func TestEncode_FlattenedJSON(t *testing.T) {
+	plaintext := []byte("Lorem ipsum")
+	sharedkey := make([]byte, 16)
+	rand.Read(sharedkey)
+
+	contentcrypt, err := NewAesCrypt(jwa.A128GCM)
+	if !assert.NoError(t, err, "NewAesCrypt succeeds") {
+		return
+	}
+	ke, _ := NewAesKeyWrap(jwa.A128KW, sharedkey)
+	ke.KeyID = "kw"
+
+	enc := NewMultiEncrypt(contentcrypt, NewRandomKeyGenerate(contentcrypt.KeySize()), ke)
+	enc.AuthenticatedData = []byte("additional authenticated data")
+	msg, err := enc.Encrypt(plaintext)
+	if !assert.NoError(t, err, "Encrypt succeeds") {
+		return
+	}
+
+	if _, err := (CompactSerialize{}).Serialize(msg); !assert.Error(t, err, "compact serialization with aad fails") {
+		return
+	}
+
+	serialized, err := JSONSerialize{Flattened: true}.Serialize(msg)
+	if !assert.NoError(t, err, "flattened serialization succeeds") {
+		return
+	}
+
+	var raw map[string]interface{}
+	if !assert.NoError(t, json.Unmarshal(serialized, &raw), "serialized message is a JSON object") {
+		return
+	}
+	for _, name := range []string{"protected", "encrypted_key", "aad", "iv", "ciphertext", "tag"} {
+		if !assert.Contains(t, raw, name, "%s exists", name) {
+			return
+		}
+	}
+	for _, name := range []string{"recipients", "header", "unprotected"} {
+		if !assert.NotContains(t, raw, name, "%s does not exist", name) {
+			return
+		}
+	}
+
+	parsed, err := Parse(serialized)
+	if !assert.NoError(t, err, "Parse succeeds") {
+		return
+	}
+	if !assert.Equal(t, "kw", parsed.ProtectedHeader.KeyID, "the recipient's parameters are protected") {
+		return
+	}
+
+	decrypted, err := parsed.DecryptWithKeyID(jwa.A128KW, "kw", sharedkey)
+	if !assert.NoError(t, err, "Decrypt succeeds") {
+		return
+	}
+	if !assert.Equal(t, plaintext, decrypted, "Decrypted content matches") {
+		return
+	}
+
+	reserialized, err := JSONSerialize{Flattened: true}.Serialize(parsed)
+	if !assert.NoError(t, err, "flattened serialization succeeds") {
+		return
+	}
+	if !assert.Equal(t, string(serialized), string(reserialized), "serialization round trips") {
+		return
+	}
+}
+
+func TestDecrypt_MultipleRecipients(t *testing.T) {
+	// https://tools.ietf.org/html/rfc7520#section-5.13
+	const encrypted = `{
+  "recipients": [
+    {
+      "encrypted_key": "dYOD28kab0Vvf4ODgxVAJXgHcSZICSOp8M51zjwj4w6Y5G4XJQsNNIBiqyvUUAOcpL7S7-cFe7Pio7gV_Q06WmCSa-vhW6me4bWrBf7cHwEQJdXihidAYWVajJIaKMXMvFRMV6iDlRr076DFthg2_AV0_tSiV6xSEIFqt1xnYPpmP91tc5WJDOGb-wqjw0-b-S1laS11QVbuP78dQ7Fa0zAVzzjHX-xvyM2wxj_otxr9clN1LnZMbeYSrRicJK5xodvWgkpIdkMHo4LvdhRRvzoKzlic89jFWPlnBq_V4n5trGuExtp_-dbHcGlihqc_wGgho9fLMK8JOArYLcMDNQ",
+      "header": {
+        "alg": "RSA1_5",
+        "kid": "frodo.baggins@hobbiton.example"
+      }
+    },
+    {
+      "encrypted_key": "ExInT0io9BqBMYF6-maw5tZlgoZXThD1zWKsHixJuw_elY4gSSId_w",
+      "header": {
+        "alg": "ECDH-ES+A256KW",
+        "kid": "peregrin.took@tuckborough.example",
+        "epk": {
+          "kty": "EC",
+          "crv": "P-384",
+          "x": "Uzdvk3pi5wKCRc1izp5_r0OjeqT-I68i8g2b8mva8diRhsE2xAn2DtMRb25Ma2CX",
+          "y": "VDrRyFJh-Kwd1EjAgmj5Eo-CTHAZ53MC7PjjpLioy3ylEjI1pOMbw91fzZ84pbfm"
+        }
+      }
+    },
+    {
+      "encrypted_key": "a7CclAejo_7JSuPB8zeagxXRam8dwCfmkt9-WyTpS1E",
+      "header": {
+        "alg": "A256GCMKW",
+        "kid": "18ec08e1-bfa9-4d95-b205-2b4dd1d4321d",
+        "tag": "59Nqh1LlYtVIhfD3pgRGvw",
+        "iv": "AvpeoPZ9Ncn9mkBn"
+      }
+    }
+  ],
+  "unprotected": {
+    "cty": "text/plain"
+  },
+  "protected": "eyJlbmMiOiJBMTI4Q0JDLUhTMjU2In0",
+  "iv": "VgEIHY20EnzUtZFl2RpB1g",
+  "ciphertext": "ajm2Q-OpPXCr7-MHXicknb1lsxLdXxK_yLds0KuhJzfWK04SjdxQeSw2L9mu3a_k1C55kCQ_3xlkcVKC5yr__Is48VOoK0k63_QRM9tBURMFqLByJ8vOYQX0oJW4VUHJLmGhF-tVQWB7Kz8mr8zeE7txF0MSaP6ga7-siYxStR7_G07Thd1jh-zGT0wxM5g-VRORtq0K6AXpLlwEqRp7pkt2zRM0ZAXqSpe1O6FJ7FHLDyEFnD-zDIZukLpCbzhzMDLLw2-8I14FQrgi-iEuzHgIJFIJn2wh9Tj0cg_kOZy9BqMRZbmYXMY9YQjorZ_P_JYG3ARAIF3OjDNqpdYe-K_5Q5crGJSDNyij_ygEiItR5jssQVH2ofDQdLChtazE",
+  "tag": "BESYyFN7T09KY7i8zKs5_g"
+}`
+
+	// The keys of the three recipients, as published in RFC 7520
+	const jwksrc = `{"keys":[
+  {"kty":"RSA","kid":"frodo.baggins@hobbiton.example","use":"enc","n":"maxhbsmBtdQ3CNrKvprUE6n9lYcregDMLYNeTAWcLj8NnPU9XIYegTHVHQjxKDSHP2l-F5jS7sppG1wgdAqZyhnWvXhYNvcM7RfgKxqNx_xAHx6f3yy7s-M9PSNCwPC2lh6UAkR4I00EhV9lrypM9Pi4lBUop9t5fS9W5UNwaAllhrd-osQGPjIeI1deHTwx-ZTHu3C60Pu_LJIl6hKn9wbwaUmA4cR5Bd2pgbaY7ASgsjCUbtYJaNIHSoHXprUdJZKUMAzV0WOKPfA6OPI4oypBadjvMZ4ZAj3BnXaSYsEZhaueTXvZB4eZOAjIyh2e_VOIKVMsnDrJYAVotGlvMQ","e":"AQAB","d":"Kn9tgoHfiTVi8uPu5b9TnwyHwG5dK6RE0uFdlpCGnJN7ZEi963R7wybQ1PLAHmpIbNTztfrheoAniRV1NCIqXaW_qS461xiDTp4ntEPnqcKsyO5jMAji7-CL8vhpYYowNFvIesgMoVaPRYMYT9TW63hNM0aWs7USZ_hLg6Oe1mY0vHTI3FucjSM86Nff4oIENt43r2fspgEPGRrdE6fpLc9Oaq-qeP1GFULimrRdndm-P8q8kvN3KHlNAtEgrQAgTTgz80S-3VD0FgWfgnb1PNmiuPUxO8OpI9KDIfu_acc6fg14nsNaJqXe6RESvhGPH2afjHqSy_Fd2vpzj85bQQ","p":"2DwQmZ43FoTnQ8IkUj3BmKRf5Eh2mizZA5xEJ2MinUE3sdTYKSLtaEoekX9vbBZuWxHdVhM6UnKCJ_2iNk8Z0ayLYHL0_G21aXf9-unynEpUsH7HHTklLpYAzOOx1ZgVljoxAdWNn3hiEFrjZLZGS7lOH-a3QQlDDQoJOJ2VFmU","q":"te8LY4-W7IyaqH1ExujjMqkTAlTeRbv0VLQnfLY2xINnrWdwiQ93_VF099aP1ESeLja2nw-6iKIe-qT7mtCPozKfVtUYfz5HrJ_XY2kfexJINb9lhZHMv5p1skZpeIS-GPHCC6gRlKo1q-idn_qxyusfWv7WAxlSVfQfk8d6Et0","dp":"UfYKcL_or492vVc0PzwLSplbg4L3-Z5wL48mwiswbpzOyIgd2xHTHQmjJpFAIZ8q-zf9RmgJXkDrFs9rkdxPtAsL1WYdeCT5c125Fkdg317JVRDo1inX7x2Kdh8ERCreW8_4zXItuTl_KiXZNU5lvMQjWbIw2eTx1lpsflo0rYU","dq":"iEgcO-QfpepdH8FWd7mUFyrXdnOkXJBCogChY6YKuIHGc_p8Le9MbpFKESzEaLlN1Ehf3B6oGBl5Iz_ayUlZj2IoQZ82znoUrpa9fVYNot87ACfzIG7q9Mv7RiPAderZi03tkVXAdaBau_9vs5rS-7HMtxkVrxSUvJY14TkXlHE","qi":"kC-lzZOqoFaZCr5l0tOVtREKoVqaAYhQiqIRGL-MzS4sCmRkxm5vZlXYx6RtE1n_AagjqajlkjieGlxTTThHD8Iga6foGBMaAr5uR1hGQpSc7Gl7CF1DZkBJMTQN6EshYzZfxW08mIO8M6Rzuh0beL6fG9mkDcIyPrBXx2bQ_mM"},
+  {"kty":"EC","kid":"peregrin.took@tuckborough.example","use":"enc","crv":"P-384","x":"YU4rRUzdmVqmRtWOs2OpDE_T5fsNIodcG8G5FWPrTPMyxpzsSOGaQLpe2FpxBmu2","y":"A8-yxCHxkfBz3hKZfI1jUYMjUhsEveZ9THuwFjH2sCNdtksRJU7D5-SkgaFL1ETP","d":"iTx2pk7wW-GqJkHcEkFQb2EFyYcO7RugmaW3mRrQVAOUiPommT0IdnYK2xDlZh-j"},
+  {"kty":"oct","kid":"18ec08e1-bfa9-4d95-b205-2b4dd1d4321d","use":"enc","alg":"A256GCMKW","k":"qC57l_uxcm7Nm3K-ct4GFjx8tM1U8CZ0NLBvdQstiS8"}
+]}`
+
+	set, err := jwk.ParseString(jwksrc)
+	if !assert.NoError(t, err, "Parsing JWK set succeeds") {
+		return
+	}
+
+	algs := []jwa.KeyEncryptionAlgorithm{jwa.RSA1_5, jwa.ECDH_ES_A256KW, jwa.A256GCMKW}
+	for i, key := range set.Keys {
+		rawkey, err := key.Materialize()
+		if !assert.NoError(t, err, "Materialize succeeds (%s)", algs[i]) {
+			return
+		}
+
+		decrypted, err := DecryptWithKeyID([]byte(encrypted), algs[i], key.Kid(), rawkey)
+		if !assert.NoError(t, err, "Decrypt succeeds (%s)", algs[i]) {
+			return
+		}
+		if !assert.Equal(t, rfc7520Plaintext, string(decrypted), "Decrypted content matches (%s)", algs[i]) {
+			return
+		}
+	}
+
+	gcmkey, err := set.Keys[2].Materialize()
+	if !assert.NoError(t, err, "Materialize succeeds") {
+		return
+	}
+	if _, err := DecryptWithKeyID([]byte(encrypted), jwa.A256GCMKW, set.Keys[0].Kid(), gcmkey); !assert.Error(t, err, "Decrypt with a mismatching kid fails") {
+		return
+	}
+}
+
+func TestDecrypt_FlattenedJSON(t *testing.T) {
+	// https://tools.ietf.org/html/rfc7520#section-5.12
+	const encrypted = `{
+  "unprotected": {
+    "alg": "A128KW",
+    "kid": "81b20965-8332-43d9-a468-82160ad91ac8",
+    "enc": "A128GCM"
+  },
+  "encrypted_key": "244YHfO_W7RMpQW81UjQrZcq5LSyqiPv",
+  "iv": "YihBoVOGsR1l7jCD",
+  "ciphertext": "qtPIMMaOBRgASL10dNQhOa7Gqrk7Eal1vwht7R4TT1uq-arsVCPaIeFwQfzrSS6oEUWbBtxEasE0vC6r7sphyVziMCVJEuRJyoAHFSP3eqQPb4Ic1SDSqyXjw_L3svybhHYUGyQuTmUQEDjgjJfBOifwHIsDsRPeBz1NomqeifVPq5GTCWFo5k_MNIQURR2Wj0AHC2k7JZfu2iWjUHLF8ExFZLZ4nlmsvJu_mvifMYiikfNfsZAudISOa6O73yPZtL04k_1FI7WDfrb2w7OqKLWDXzlpcxohPVOLQwpA3mFNRKdY-bQz4Z4KX9lfz1cne31N4-8BKmojpw-OdQjKdLOGkC445Fb_K1tlDQXw2sBF",
+  "tag": "e2m0Vm7JvjK2VpCKXS-kyg"
+}`
+	sharedkey, _ := buffer.FromBase64([]byte("GZy6sIZ6wl9NJOKB-jnmVQ"))
+
+	decrypted, err := Decrypt([]byte(encrypted), jwa.A128KW, sharedkey.Bytes())
+	if !assert.NoError(t, err, "Decrypt succeeds") {
+		return
+	}
+	if !assert.Equal(t, rfc7520Plaintext, string(decrypted), "Decrypted content matches") {
+		return
+	}
+}
+
+func TestDecryptWithJWK(t *testing.T) {
+	plaintext := []byte("Lorem ipsum")
+	const jwksrc = `{"keys":[
+  {"kty":"oct","kid":"sig","use":"sig","k":"GawgguFyGrWKav7AX4VKUg"},
+  {"kty":"oct","kid":"sign-only","key_ops":["sign"],"k":"GawgguFyGrWKav7AX4VKUg"},
+  {"kty":"oct","kid":"other-alg","alg":"A256KW","k":"GawgguFyGrWKav7AX4VKUg"},
+  {"kty":"oct","kid":"wrong-key","alg":"A128KW","k":"AAAAAAAAAAAAAAAAAAAAAA"},
+  {"kty":"oct","kid":"enc","use":"enc","alg":"A128KW","key_ops":["wrapKey","unwrapKey"],"k":"GawgguFyGrWKav7AX4VKUg"}
+]}`
+
+	set, err := jwk.ParseString(jwksrc)
+	if !assert.NoError(t, err, "Parsing JWK set succeeds") {
+		return
+	}
+	sharedkey, err := set.LookupKeyID("enc")[0].Materialize()
+	if !assert.NoError(t, err, "Materialize succeeds") {
+		return
+	}
+
+	// Without "kid", all keys are tried. Only the last one is allowed
+	// to decrypt the message
+	encrypted, err := Encrypt(plaintext, jwa.A128KW, sharedkey, jwa.A128GCM, jwa.NoCompress)
+	if !assert.NoError(t, err, "Encrypt succeeds") {
+		return
+	}
+
+	decrypted, err := DecryptWithJWK(encrypted, set)
+	if !assert.NoError(t, err, "DecryptWithJWK succeeds") {
+		return
+	}
+	if !assert.Equal(t, plaintext, decrypted, "Decrypted content matches") {
+		return
+	}
+
+	for _, kid := range []string{"sig", "sign-only", "other-alg", "wrong-key"} {
+		h := NewHeader()
+		h.Set("kid", kid)
+		encrypted, err := Encrypt(plaintext, jwa.A128KW, sharedkey, jwa.A128GCM, jwa.NoCompress, h)
+		if !assert.NoError(t, err, "Encrypt succeeds") {
+			return
+		}
+
+		if _, err := DecryptWithJWK(encrypted, set); !assert.Error(t, err, "DecryptWithJWK fails (kid = %s)", kid) {
+			return
+		}
+	}
+
+	// Multiple recipients: the RSA key is picked by its "kid"
+	rsakey, err := jwk.NewRsaPrivateKey(rsaPrivKey)
+	if !assert.NoError(t, err, "NewRsaPrivateKey succeeds") {
+		return
+	}
+	rsakey.Set("kid", "rsa")
+	rsaset := &jwk.Set{Keys: []jwk.Key{rsakey}}
+
+	contentcrypt, err := NewAesCrypt(jwa.A128CBC_HS256)
+	if !assert.NoError(t, err, "NewAesCrypt succeeds") {
+		return
+	}
+	ke1, _ := NewAesKeyWrap(jwa.A128KW, sharedkey.([]byte))
+	ke1.KeyID = "unknown"
+	ke2, _ := NewRSAOAEPKeyEncrypt(jwa.RSA_OAEP, &rsaPrivKey.PublicKey)
+	ke2.KeyID = "rsa"
+
+	msg, err := NewMultiEncrypt(contentcrypt, NewRandomKeyGenerate(contentcrypt.KeySize()), ke1, ke2).Encrypt(plaintext)
+	if !assert.NoError(t, err, "Encrypt succeeds") {
+		return
+	}
+
+	decrypted, err = msg.DecryptWithJWK(rsaset)
+	if !assert.NoError(t, err, "DecryptWithJWK succeeds") {
+		return
+	}
+	if !assert.Equal(t, plaintext, decrypted, "Decrypted content matches") {
+		return
+	}
+}
+
+func TestDecrypt_Critical(t *testing.T) {
+	sharedkey := make([]byte, 16)
+	if _, err := rand.Read(sharedkey); !assert.NoError(t, err, "Generate shared key") {
+		return
+	}
+
+	encrypt := func(t *testing.T, protected, unprotected *Header) []byte {
+		contentcrypt, err := NewAesCrypt(jwa.A128CBC_HS256)
+		if !assert.NoError(t, err, "NewAesCrypt is successful") {
+			return nil
+		}
+		keyenc, err := NewAesKeyWrap(jwa.A128KW, sharedkey)
+		if !assert.NoError(t, err, "NewAesKeyWrap is successful") {
+			return nil
+		}
+
+		enc := NewMultiEncrypt(contentcrypt, NewRandomKeyGenerate(contentcrypt.KeySize()), keyenc)
+		enc.ProtectedHeader = protected
+		enc.UnprotectedHeader = unprotected
+		msg, err := enc.Encrypt([]byte("Lorem Ipsum"))
+		if !assert.NoError(t, err, "Encrypt is successful") {
+			return nil
+		}
+
+		buf, err := JSONSerialize{}.Serialize(msg)
+		if !assert.NoError(t, err, "Serialize is successful") {
+			return nil
+		}
+		return buf
+	}
+
+	newHeader := func(crit []string, params map[string]interface{}) *Header {
+		h := NewHeader()
+		h.Critical = crit
+		for k, v := range params {
+			h.Set(k, v)
+		}
+		return h
+	}
+
+	t.Run("not understood", func(t *testing.T) {
+		buf := encrypt(t, newHeader([]string{"exp"}, map[string]interface{}{"exp": 1}), nil)
+		_, err := Decrypt(buf, jwa.A128KW, sharedkey)
+		if !assert.Equal(t, ErrUnsupportedCriticalHeader, err, "Decrypt should fail") {
+			return
+		}
+	})
+
+	t.Run("registered handler", func(t *testing.T) {
+		errExpired := errors.New("expired")
+		RegisterCriticalHeader("exp", func(v interface{}) error {
+			if f, ok := v.(float64); !ok || f < 10 {
+				return errExpired
+			}
+			return nil
+		})
+		defer UnregisterCriticalHeader("exp")
+
+		if !assert.Panics(t, func() { RegisterCriticalHeader("zip", func(interface{}) error { return nil }) }, "standard headers can not be registered") {
+			return
+		}
+
+		buf := encrypt(t, newHeader([]string{"exp"}, map[string]interface{}{"exp": 100}), nil)
+		decrypted, err := Decrypt(buf, jwa.A128KW, sharedkey)
+		if !assert.NoError(t, err, "Decrypt is successful") {
+			return
+		}
+		if !assert.Equal(t, "Lorem Ipsum", string(decrypted), "Decrypted content matches") {
+			return
+		}
+
+		buf = encrypt(t, newHeader([]string{"exp"}, map[string]interface{}{"exp": 1}), nil)
+		_, err = Decrypt(buf, jwa.A128KW, sharedkey)
+		if !assert.Equal(t, errExpired, err, "Decrypt should fail with the handler's error") {
+			return
+		}
+
+		buf = encrypt(t, newHeader([]string{"exp"}, nil), nil)
+		_, err = Decrypt(buf, jwa.A128KW, sharedkey)
+		if !assert.Equal(t, ErrInvalidCriticalHeader, err, "listed header must be present") {
+			return
+		}
+
+		buf = encrypt(t, newHeader(nil, map[string]interface{}{"exp": 100}), newHeader([]string{"exp"}, nil))
+		_, err = Decrypt(buf, jwa.A128KW, sharedkey)
+		if !assert.Equal(t, ErrInvalidCriticalHeader, err, "crit must be protected") {
+			return
+		}
+	})
+
+	t.Run("standard header", func(t *testing.T) {
+		buf := encrypt(t, newHeader([]string{"enc"}, nil), nil)
+		_, err := Decrypt(buf, jwa.A128KW, sharedkey)
+		if !assert.Equal(t, ErrInvalidCriticalHeader, err, "crit may not list standard headers") {
+			return
+		}
+	})
+}
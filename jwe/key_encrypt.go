@@ -1,23 +1,24 @@
 package jwe
 
 import (
-	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/subtle"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash"
+	"io"
 
-	"github.com/lestrrat/go-jwx/internal/concatkdf"
+	"github.com/lestrrat/go-jwx/buffer"
 	"github.com/lestrrat/go-jwx/internal/debug"
 	"github.com/lestrrat/go-jwx/jwa"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 func NewAesKeyWrap(alg jwa.KeyEncryptionAlgorithm, sharedkey []byte) (KeyWrapEncrypt, error) {
@@ -61,7 +62,270 @@ func (kw KeyWrapEncrypt) KeyEncrypt(cek []byte) (ByteSource, error) {
 	return ByteKey(encrypted), nil
 }
 
-func NewEcdhesKeyWrapEncrypt(alg jwa.KeyEncryptionAlgorithm, key *ecdsa.PublicKey) (*EcdhesKeyWrapEncrypt, error) {
+func aesGcmKeySize(alg jwa.KeyEncryptionAlgorithm) (int, error) {
+	switch alg {
+	case jwa.A128GCMKW:
+		return 16, nil
+	case jwa.A192GCMKW:
+		return 24, nil
+	case jwa.A256GCMKW:
+		return 32, nil
+	default:
+		return 0, ErrUnsupportedAlgorithm
+	}
+}
+
+// NewAesGcmKeyWrap creates a key encrypter for A128GCMKW, A192GCMKW and
+// A256GCMKW. The size of `sharedkey` must match the algorithm
+func NewAesGcmKeyWrap(alg jwa.KeyEncryptionAlgorithm, sharedkey []byte) (*AesGcmKeyWrap, error) {
+	keysize, err := aesGcmKeySize(alg)
+	if err != nil {
+		return nil, err
+	}
+	if len(sharedkey) != keysize {
+		return nil, fmt.Errorf("invalid key size for %s (expected %d, got %d)", alg, keysize, len(sharedkey))
+	}
+
+	return &AesGcmKeyWrap{
+		alg:       alg,
+		sharedkey: sharedkey,
+	}, nil
+}
+
+func (kw AesGcmKeyWrap) Algorithm() jwa.KeyEncryptionAlgorithm {
+	return kw.alg
+}
+
+func (kw AesGcmKeyWrap) Kid() string {
+	return kw.KeyID
+}
+
+// KeyEncrypt encrypts the CEK using a random 96 bit IV. The returned
+// ByteWithIVAndTag populates the "iv" and "tag" header parameters
+func (kw AesGcmKeyWrap) KeyEncrypt(cek []byte) (ByteSource, error) {
+	block, err := aes.NewCipher(kw.sharedkey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+
+	sealed := aead.Seal(nil, iv, cek, nil)
+	tagoffset := len(sealed) - aead.Overhead()
+
+	return ByteWithIVAndTag{
+		ByteKey: ByteKey(sealed[:tagoffset]),
+		IV:      iv,
+		Tag:     sealed[tagoffset:],
+	}, nil
+}
+
+// NewAesGcmKeyUnwrap creates a key decrypter for A128GCMKW, A192GCMKW
+// and A256GCMKW. `iv` and `tag` are the values of the "iv" and "tag"
+// header parameters
+func NewAesGcmKeyUnwrap(alg jwa.KeyEncryptionAlgorithm, sharedkey, iv, tag []byte) (*AesGcmKeyUnwrap, error) {
+	keysize, err := aesGcmKeySize(alg)
+	if err != nil {
+		return nil, err
+	}
+	if len(sharedkey) != keysize {
+		return nil, fmt.Errorf("invalid key size for %s (expected %d, got %d)", alg, keysize, len(sharedkey))
+	}
+
+	return &AesGcmKeyUnwrap{
+		alg:       alg,
+		sharedkey: sharedkey,
+		iv:        iv,
+		tag:       tag,
+	}, nil
+}
+
+func (kw AesGcmKeyUnwrap) Algorithm() jwa.KeyEncryptionAlgorithm {
+	return kw.alg
+}
+
+func (kw AesGcmKeyUnwrap) KeyDecrypt(enckey []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kw.sharedkey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(kw.iv) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid 'iv' size (expected %d, got %d)", aead.NonceSize(), len(kw.iv))
+	}
+	if len(kw.tag) != aead.Overhead() {
+		return nil, fmt.Errorf("invalid 'tag' size (expected %d, got %d)", aead.Overhead(), len(kw.tag))
+	}
+
+	sealed := make([]byte, 0, len(enckey)+len(kw.tag))
+	sealed = append(sealed, enckey...)
+	sealed = append(sealed, kw.tag...)
+
+	cek, err := aead.Open(nil, kw.iv, sealed, nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt key")
+	}
+	return cek, nil
+}
+
+func (k ByteWithIVAndTag) HeaderPopulate(h *Header) {
+	h.Set("iv", buffer.Buffer(k.IV))
+	h.Set("tag", buffer.Buffer(k.Tag))
+}
+
+func pbes2Params(alg jwa.KeyEncryptionAlgorithm) (func() hash.Hash, int, error) {
+	switch alg {
+	case jwa.PBES2_HS256_A128KW:
+		return sha256.New, 16, nil
+	case jwa.PBES2_HS384_A192KW:
+		return sha512.New384, 24, nil
+	case jwa.PBES2_HS512_A256KW:
+		return sha512.New, 32, nil
+	default:
+		return nil, 0, ErrUnsupportedAlgorithm
+	}
+}
+
+// pbes2DeriveKey derives the key encryption key from the password.
+// The salt used by PBKDF2 is the algorithm name, a zero byte, and
+// the "p2s" value. https://tools.ietf.org/html/rfc7518#section-4.8.1.1
+func pbes2DeriveKey(alg jwa.KeyEncryptionAlgorithm, password, salt []byte, count int) ([]byte, error) {
+	h, keysize, err := pbes2Params(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	salt = append(append([]byte(alg.String()), 0), salt...)
+	return pbkdf2.Key(password, salt, count, keysize, h), nil
+}
+
+// NewPbes2KeyWrap creates a key encrypter for PBES2-HS256+A128KW,
+// PBES2-HS384+A192KW and PBES2-HS512+A256KW. If `count` is 0,
+// PBES2DefaultCount is used. Iteration counts smaller than
+// PBES2MinCount are rejected
+func NewPbes2KeyWrap(alg jwa.KeyEncryptionAlgorithm, password []byte, count int) (*Pbes2KeyWrap, error) {
+	if _, _, err := pbes2Params(alg); err != nil {
+		return nil, err
+	}
+
+	if count == 0 {
+		count = PBES2DefaultCount
+	}
+	if count < PBES2MinCount {
+		return nil, fmt.Errorf("iteration count for %s must be at least %d", alg, PBES2MinCount)
+	}
+
+	return &Pbes2KeyWrap{
+		alg:      alg,
+		password: password,
+		count:    count,
+	}, nil
+}
+
+func (kw Pbes2KeyWrap) Algorithm() jwa.KeyEncryptionAlgorithm {
+	return kw.alg
+}
+
+func (kw Pbes2KeyWrap) Kid() string {
+	return kw.KeyID
+}
+
+// KeyEncrypt encrypts the CEK using a random salt. The returned
+// ByteWithSaltAndCount populates the "p2s" and "p2c" header parameters
+func (kw Pbes2KeyWrap) KeyEncrypt(cek []byte) (ByteSource, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	kek, err := pbes2DeriveKey(kw.alg, kw.password, salt, kw.count)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := keywrap(block, cek)
+	if err != nil {
+		return nil, err
+	}
+
+	return ByteWithSaltAndCount{
+		ByteKey: ByteKey(encrypted),
+		Salt:    salt,
+		Count:   kw.count,
+	}, nil
+}
+
+// NewPbes2KeyUnwrap creates a key decrypter for PBES2-HS256+A128KW,
+// PBES2-HS384+A192KW and PBES2-HS512+A256KW. `salt` and `count` are
+// the values of the "p2s" and "p2c" header parameters. Iteration
+// counts larger than PBES2MaxCount are rejected
+func NewPbes2KeyUnwrap(alg jwa.KeyEncryptionAlgorithm, password, salt []byte, count int) (*Pbes2KeyUnwrap, error) {
+	if _, _, err := pbes2Params(alg); err != nil {
+		return nil, err
+	}
+
+	if len(salt) < 8 {
+		return nil, errors.New("'p2s' must be at least 8 bytes long")
+	}
+	if count <= 0 {
+		return nil, errors.New("'p2c' must be a positive integer")
+	}
+	if count > PBES2MaxCount {
+		return nil, fmt.Errorf("'p2c' exceeds the maximum iteration count (%d)", PBES2MaxCount)
+	}
+
+	return &Pbes2KeyUnwrap{
+		alg:      alg,
+		password: password,
+		salt:     salt,
+		count:    count,
+	}, nil
+}
+
+func (kw Pbes2KeyUnwrap) Algorithm() jwa.KeyEncryptionAlgorithm {
+	return kw.alg
+}
+
+func (kw Pbes2KeyUnwrap) KeyDecrypt(enckey []byte) ([]byte, error) {
+	kek, err := pbes2DeriveKey(kw.alg, kw.password, kw.salt, kw.count)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyunwrap(block, enckey)
+}
+
+func (k ByteWithSaltAndCount) HeaderPopulate(h *Header) {
+	h.Set("p2s", buffer.Buffer(k.Salt))
+	h.Set("p2c", k.Count)
+}
+
+// NewEcdhesKeyWrapEncrypt creates a key encrypter for ECDH-ES+AxxxKW.
+// `key` must be either an *ecdsa.PublicKey or an x25519.PublicKey
+func NewEcdhesKeyWrapEncrypt(alg jwa.KeyEncryptionAlgorithm, key interface{}) (*EcdhesKeyWrapEncrypt, error) {
 	generator, err := NewEcdhesKeyGenerate(alg, key)
 	if err != nil {
 		return nil, err
@@ -106,7 +370,12 @@ func (kw EcdhesKeyWrapEncrypt) KeyEncrypt(cek []byte) (ByteSource, error) {
 	return bwpk, nil
 }
 
-func NewEcdhesKeyWrapDecrypt(alg jwa.KeyEncryptionAlgorithm, pubkey *ecdsa.PublicKey, apu, apv []byte, privkey *ecdsa.PrivateKey) *EcdhesKeyWrapDecrypt {
+// NewEcdhesKeyWrapDecrypt creates a key decrypter for ECDH-ES+AxxxKW.
+// `pubkey` is the ephemeral public key from the "epk" header, and
+// `privkey` is the recipient's private key. They must either be
+// *ecdsa.PublicKey and *ecdsa.PrivateKey, or x25519.PublicKey and
+// x25519.PrivateKey
+func NewEcdhesKeyWrapDecrypt(alg jwa.KeyEncryptionAlgorithm, pubkey interface{}, apu, apv []byte, privkey interface{}) *EcdhesKeyWrapDecrypt {
 	return &EcdhesKeyWrapDecrypt{
 		algorithm: alg,
 		apu:       apu,
@@ -121,7 +390,7 @@ func (kw EcdhesKeyWrapDecrypt) Algorithm() jwa.KeyEncryptionAlgorithm {
 }
 
 func (kw EcdhesKeyWrapDecrypt) KeyDecrypt(enckey []byte) ([]byte, error) {
-	var keysize uint32
+	var keysize int
 	switch kw.algorithm {
 	case jwa.ECDH_ES_A128KW:
 		keysize = 16
@@ -133,16 +402,10 @@ func (kw EcdhesKeyWrapDecrypt) KeyDecrypt(enckey []byte) ([]byte, error) {
 		return nil, ErrUnsupportedAlgorithm
 	}
 
-	privkey := kw.privkey
-	pubkey := kw.pubkey
-
-	pubinfo := make([]byte, 4)
-	binary.BigEndian.PutUint32(pubinfo, keysize*8)
-
-	z, _ := privkey.PublicKey.Curve.ScalarMult(pubkey.X, pubkey.Y, privkey.D.Bytes())
-	kdf := concatkdf.New(crypto.SHA256, []byte(kw.algorithm.String()), z.Bytes(), kw.apu, kw.apv, pubinfo, []byte{})
-	kek := make([]byte, keysize)
-	kdf.Read(kek)
+	kek, err := ecdhesDeriveKey(kw.algorithm.String(), keysize, kw.privkey, kw.pubkey, kw.apu, kw.apv)
+	if err != nil {
+		return nil, err
+	}
 
 	block, err := aes.NewCipher(kek)
 	if err != nil {
@@ -152,6 +415,64 @@ func (kw EcdhesKeyWrapDecrypt) KeyDecrypt(enckey []byte) ([]byte, error) {
 	return keyunwrap(block, enckey)
 }
 
+// NewEcdhesDirectDecrypt creates a key decrypter for direct ECDH-ES key
+// agreement. `keysize` is the size of the CEK for `enc`, `pubkey` is the
+// ephemeral public key from the "epk" header, and `privkey` is the
+// recipient's private key. They must either be *ecdsa.PublicKey and
+// *ecdsa.PrivateKey, or x25519.PublicKey and x25519.PrivateKey
+func NewEcdhesDirectDecrypt(enc jwa.ContentEncryptionAlgorithm, keysize int, pubkey interface{}, apu, apv []byte, privkey interface{}) *EcdhesDirectDecrypt {
+	return &EcdhesDirectDecrypt{
+		enc:     enc,
+		keysize: keysize,
+		apu:     apu,
+		apv:     apv,
+		privkey: privkey,
+		pubkey:  pubkey,
+	}
+}
+
+func (d EcdhesDirectDecrypt) Algorithm() jwa.KeyEncryptionAlgorithm {
+	return jwa.ECDH_ES
+}
+
+// KeyDecrypt derives the CEK. As the CEK is not transmitted in direct
+// key agreement, `enckey` must be empty
+func (d EcdhesDirectDecrypt) KeyDecrypt(enckey []byte) ([]byte, error) {
+	if len(enckey) != 0 {
+		return nil, errors.New("encrypted key must be empty for ECDH-ES")
+	}
+
+	if d.enc == "" || d.keysize <= 0 {
+		return nil, errors.New("content encryption algorithm is required for ECDH-ES")
+	}
+
+	return ecdhesDeriveKey(d.enc.String(), d.keysize, d.privkey, d.pubkey, d.apu, d.apv)
+}
+
+// NewDirectKeyEncrypt creates a new DirectKeyEncrypt for `alg`,
+// which should be either jwa.DIRECT or jwa.ECDH_ES
+func NewDirectKeyEncrypt(alg jwa.KeyEncryptionAlgorithm) (*DirectKeyEncrypt, error) {
+	switch alg {
+	case jwa.DIRECT, jwa.ECDH_ES:
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+	return &DirectKeyEncrypt{alg: alg}, nil
+}
+
+func (e DirectKeyEncrypt) Algorithm() jwa.KeyEncryptionAlgorithm {
+	return e.alg
+}
+
+func (e DirectKeyEncrypt) Kid() string {
+	return e.KeyID
+}
+
+// KeyEncrypt returns an empty encrypted key, as the CEK is not transmitted
+func (e DirectKeyEncrypt) KeyEncrypt(cek []byte) (ByteSource, error) {
+	return ByteKey(nil), nil
+}
+
 func NewRSAOAEPKeyEncrypt(alg jwa.KeyEncryptionAlgorithm, pubkey *rsa.PublicKey) (*RSAOAEPKeyEncrypt, error) {
 	switch alg {
 	case jwa.RSA_OAEP, jwa.RSA_OAEP_256:
@@ -316,16 +637,36 @@ func (d RSAOAEPKeyDecrypt) KeyDecrypt(enckey []byte) ([]byte, error) {
 	return rsa.DecryptOAEP(hash, rand.Reader, d.privkey, enckey, []byte{})
 }
 
+// DirectDecrypt is the KeyDecrypter for direct encryption ("dir"),
+// where the shared key is used as the CEK
 type DirectDecrypt struct {
 	Key []byte
 }
 
+// NewDirectDecrypt creates a key decrypter for direct encryption
+func NewDirectDecrypt(key []byte) *DirectDecrypt {
+	return &DirectDecrypt{Key: key}
+}
+
+func (d DirectDecrypt) Algorithm() jwa.KeyEncryptionAlgorithm {
+	return jwa.DIRECT
+}
+
 func (d DirectDecrypt) Decrypt() ([]byte, error) {
 	cek := make([]byte, len(d.Key))
 	copy(cek, d.Key)
 	return cek, nil
 }
 
+// KeyDecrypt returns a copy of the shared key. As the CEK is not
+// transmitted in direct encryption, `enckey` must be empty
+func (d DirectDecrypt) KeyDecrypt(enckey []byte) ([]byte, error) {
+	if len(enckey) != 0 {
+		return nil, errors.New("encrypted key must be empty for direct encryption")
+	}
+	return d.Decrypt()
+}
+
 var keywrapDefaultIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
 
 const keywrapChunkLen = 8
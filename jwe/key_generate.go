@@ -11,6 +11,7 @@ import (
 	"github.com/lestrrat/go-jwx/internal/concatkdf"
 	"github.com/lestrrat/go-jwx/jwa"
 	"github.com/lestrrat/go-jwx/jwk"
+	"github.com/lestrrat/go-jwx/x25519"
 )
 
 func (k ByteKey) Bytes() []byte {
@@ -47,11 +48,14 @@ func (g RandomKeyGenerate) KeyGenerate() (ByteSource, error) {
 	return ByteKey(buf), nil
 }
 
-func NewEcdhesKeyGenerate(alg jwa.KeyEncryptionAlgorithm, pubkey *ecdsa.PublicKey) (*EcdhesKeyGenerate, error) {
+// NewEcdhesKeyGenerate creates a new key generator for ECDH-ES key
+// agreement with the owner of `pubkey`, which must be either an
+// *ecdsa.PublicKey or an x25519.PublicKey
+func NewEcdhesKeyGenerate(alg jwa.KeyEncryptionAlgorithm, pubkey interface{}) (*EcdhesKeyGenerate, error) {
 	var keysize int
 	switch alg {
 	case jwa.ECDH_ES:
-		return nil, errors.New("unimplemented")
+		return nil, errors.New("use NewEcdhesDirectKeyGenerate for direct ECDH-ES key agreement")
 	case jwa.ECDH_ES_A128KW:
 		keysize = 16
 	case jwa.ECDH_ES_A192KW:
@@ -62,37 +66,159 @@ func NewEcdhesKeyGenerate(alg jwa.KeyEncryptionAlgorithm, pubkey *ecdsa.PublicKe
 		return nil, ErrUnsupportedAlgorithm
 	}
 
+	switch pubkey.(type) {
+	case *ecdsa.PublicKey, x25519.PublicKey:
+	default:
+		return nil, errors.New("invalid key: *ecdsa.PublicKey or x25519.PublicKey required")
+	}
+
 	return &EcdhesKeyGenerate{
 		algorithm: alg,
+		algid:     alg.String(),
 		keysize:   keysize,
 		pubkey:    pubkey,
 	}, nil
 }
 
+// NewEcdhesDirectKeyGenerate creates a new key generator for direct
+// ECDH-ES key agreement with the owner of `pubkey`, which must be either
+// an *ecdsa.PublicKey or an x25519.PublicKey. The generated key is used
+// as the CEK for the content encryption algorithm `enc`.
+func NewEcdhesDirectKeyGenerate(enc jwa.ContentEncryptionAlgorithm, pubkey interface{}) (*EcdhesKeyGenerate, error) {
+	cipher, err := BuildContentCipher(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	switch pubkey.(type) {
+	case *ecdsa.PublicKey, x25519.PublicKey:
+	default:
+		return nil, errors.New("invalid key: *ecdsa.PublicKey or x25519.PublicKey required")
+	}
+
+	return &EcdhesKeyGenerate{
+		algorithm: jwa.ECDH_ES,
+		algid:     enc.String(),
+		keysize:   cipher.KeySize(),
+		pubkey:    pubkey,
+	}, nil
+}
+
 func (g EcdhesKeyGenerate) KeySize() int {
 	return g.keysize
 }
 
 func (g EcdhesKeyGenerate) KeyGenerate() (ByteSource, error) {
-	priv, err := ecdsa.GenerateKey(g.pubkey.Curve, rand.Reader)
+	priv, err := generateEphemeralKey(g.pubkey)
 	if err != nil {
 		return nil, err
 	}
 
-	pubinfo := make([]byte, 4)
-	binary.BigEndian.PutUint32(pubinfo, uint32(g.keysize)*8)
+	epk, err := ephemeralPublicKey(priv)
+	if err != nil {
+		return nil, err
+	}
 
-	z, _ := priv.PublicKey.Curve.ScalarMult(g.pubkey.X, g.pubkey.Y, priv.D.Bytes())
-	kdf := concatkdf.New(crypto.SHA256, []byte(g.algorithm.String()), z.Bytes(), []byte{}, []byte{}, pubinfo, []byte{})
-	kek := make([]byte, g.keysize)
-	kdf.Read(kek)
+	kek, err := ecdhesDeriveKey(g.algid, g.keysize, priv, g.pubkey, []byte{}, []byte{})
+	if err != nil {
+		return nil, err
+	}
 
 	return ByteWithECPrivateKey{
 		PrivateKey: priv,
+		PublicKey:  epk,
 		ByteKey:    ByteKey(kek),
 	}, nil
 }
 
+// generateEphemeralKey creates a new private key of the same type
+// (and on the same curve) as `pubkey`
+func generateEphemeralKey(pubkey interface{}) (interface{}, error) {
+	switch pub := pubkey.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.GenerateKey(pub.Curve, rand.Reader)
+	case x25519.PublicKey:
+		_, priv, err := x25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return priv, nil
+	default:
+		return nil, errors.New("invalid key: *ecdsa.PublicKey or x25519.PublicKey required")
+	}
+}
+
+// ephemeralPublicKey returns the public part of the ephemeral key
+// `privkey` as a JWK, to be used as the "epk" header
+func ephemeralPublicKey(privkey interface{}) (jwk.Key, error) {
+	switch priv := privkey.(type) {
+	case *ecdsa.PrivateKey:
+		return jwk.NewEcdsaPublicKey(&priv.PublicKey), nil
+	case x25519.PrivateKey:
+		pub, err := priv.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		return jwk.NewOKPPublicKey(pub)
+	default:
+		return nil, errors.New("invalid key: *ecdsa.PrivateKey or x25519.PrivateKey required")
+	}
+}
+
+// ecdhesDeriveKey derives a key of `keysize` bytes from the ECDH-ES key
+// agreement between `privkey` and `pubkey`, using the Concat KDF
+// https://tools.ietf.org/html/rfc7518#section-4.6.2
+func ecdhesDeriveKey(algid string, keysize int, privkey, pubkey interface{}, apu, apv []byte) ([]byte, error) {
+	z, err := ecdhSharedSecret(privkey, pubkey)
+	if err != nil {
+		return nil, err
+	}
+
+	pubinfo := make([]byte, 4)
+	binary.BigEndian.PutUint32(pubinfo, uint32(keysize)*8)
+
+	kdf := concatkdf.New(crypto.SHA256, []byte(algid), z, apu, apv, pubinfo, []byte{})
+	key := make([]byte, keysize)
+	kdf.Read(key)
+	return key, nil
+}
+
+// ecdhSharedSecret computes the shared secret Z between `privkey` and
+// `pubkey`, which must either be *ecdsa.PrivateKey and *ecdsa.PublicKey
+// on the same curve, or x25519.PrivateKey and x25519.PublicKey
+func ecdhSharedSecret(privkey, pubkey interface{}) ([]byte, error) {
+	switch priv := privkey.(type) {
+	case *ecdsa.PrivateKey:
+		pub, ok := pubkey.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, errors.New("public key for ECDH-ES must be *ecdsa.PublicKey")
+		}
+
+		params := priv.Curve.Params()
+		if pub.Curve.Params().Name != params.Name || !priv.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("public key for ECDH-ES is not on the expected curve")
+		}
+
+		x, _ := priv.Curve.ScalarMult(pub.X, pub.Y, priv.D.Bytes())
+
+		// Z must be as long as the field size of the curve
+		// https://tools.ietf.org/html/rfc7518#section-4.6.2
+		size := (params.BitSize + 7) / 8
+		xbuf := x.Bytes()
+		z := make([]byte, size)
+		copy(z[size-len(xbuf):], xbuf)
+		return z, nil
+	case x25519.PrivateKey:
+		pub, ok := pubkey.(x25519.PublicKey)
+		if !ok {
+			return nil, errors.New("public key for ECDH-ES must be x25519.PublicKey")
+		}
+		return priv.SharedSecret(pub)
+	default:
+		return nil, errors.New("invalid key: *ecdsa.PrivateKey or x25519.PrivateKey required")
+	}
+}
+
 func (k ByteWithECPrivateKey) HeaderPopulate(h *Header) {
-	h.Set("epk", jwk.NewEcdsaPublicKey(&k.PrivateKey.PublicKey))
+	h.Set("epk", k.PublicKey)
 }
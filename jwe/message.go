@@ -1,8 +1,6 @@
 package jwe
 
 import (
-	"bytes"
-	"compress/flate"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -48,8 +46,18 @@ func (h *Header) Get(key string) (interface{}, error) {
 		return h.EphemeralPublicKey, nil
 	case "cty":
 		return h.ContentType, nil
+	case "zip":
+		return h.Compression, nil
+	case "iv":
+		return h.InitializationVector, nil
 	case "kid":
 		return h.KeyID, nil
+	case "p2c":
+		return h.PBES2Count, nil
+	case "p2s":
+		return h.PBES2Salt, nil
+	case "tag":
+		return h.Tag, nil
 	case "typ":
 		return h.Type, nil
 	case "x5t":
@@ -131,18 +139,80 @@ func (h *Header) Set(key string, value interface{}) error {
 			return ErrInvalidHeaderValue
 		}
 		h.ContentType = v
+	case "zip":
+		var v jwa.CompressionAlgorithm
+		s, ok := value.(string)
+		if ok {
+			v = jwa.CompressionAlgorithm(s)
+		} else {
+			v, ok = value.(jwa.CompressionAlgorithm)
+			if !ok {
+				return ErrInvalidHeaderValue
+			}
+		}
+		h.Compression = v
 	case "epk":
-		v, ok := value.(*jwk.EcdsaPublicKey)
+		v, ok := value.(jwk.Key)
 		if !ok {
 			return ErrInvalidHeaderValue
 		}
 		h.EphemeralPublicKey = v
+	case "iv":
+		var v buffer.Buffer
+		switch value.(type) {
+		case buffer.Buffer:
+			v = value.(buffer.Buffer)
+		case []byte:
+			v = buffer.Buffer(value.([]byte))
+		case string:
+			v = buffer.Buffer(value.(string))
+		default:
+			return ErrInvalidHeaderValue
+		}
+		h.InitializationVector = v
 	case "kid":
 		v, ok := value.(string)
 		if !ok {
 			return ErrInvalidHeaderValue
 		}
 		h.KeyID = v
+	case "p2c":
+		var v int
+		switch value.(type) {
+		case int:
+			v = value.(int)
+		case float64:
+			v = int(value.(float64))
+		default:
+			return ErrInvalidHeaderValue
+		}
+		h.PBES2Count = v
+	case "p2s":
+		var v buffer.Buffer
+		switch value.(type) {
+		case buffer.Buffer:
+			v = value.(buffer.Buffer)
+		case []byte:
+			v = buffer.Buffer(value.([]byte))
+		case string:
+			v = buffer.Buffer(value.(string))
+		default:
+			return ErrInvalidHeaderValue
+		}
+		h.PBES2Salt = v
+	case "tag":
+		var v buffer.Buffer
+		switch value.(type) {
+		case buffer.Buffer:
+			v = value.(buffer.Buffer)
+		case []byte:
+			v = buffer.Buffer(value.([]byte))
+		case string:
+			v = buffer.Buffer(value.(string))
+		default:
+			return ErrInvalidHeaderValue
+		}
+		h.Tag = v
 	case "typ":
 		v, ok := value.(string)
 		if !ok {
@@ -251,6 +321,10 @@ func (h1 *EssentialHeader) Merge(h2 *EssentialHeader) {
 		h1.EphemeralPublicKey = h2.EphemeralPublicKey
 	}
 
+	if h2.InitializationVector.Len() != 0 {
+		h1.InitializationVector = h2.InitializationVector
+	}
+
 	if h2.Jwk != nil {
 		h1.Jwk = h2.Jwk
 	}
@@ -263,6 +337,18 @@ func (h1 *EssentialHeader) Merge(h2 *EssentialHeader) {
 		h1.KeyID = h2.KeyID
 	}
 
+	if h2.PBES2Count != 0 {
+		h1.PBES2Count = h2.PBES2Count
+	}
+
+	if h2.PBES2Salt.Len() != 0 {
+		h1.PBES2Salt = h2.PBES2Salt
+	}
+
+	if h2.Tag.Len() != 0 {
+		h1.Tag = h2.Tag
+	}
+
 	if h2.Type != "" {
 		h1.Type = h2.Type
 	}
@@ -310,9 +396,13 @@ func (h1 *EssentialHeader) Copy(h2 *EssentialHeader) {
 	h1.Compression = h2.Compression
 	h1.Critical = h2.Critical
 	h1.EphemeralPublicKey = h2.EphemeralPublicKey
+	h1.InitializationVector = h2.InitializationVector
 	h1.Jwk = h2.Jwk
 	h1.JwkSetURL = h2.JwkSetURL
 	h1.KeyID = h2.KeyID
+	h1.PBES2Count = h2.PBES2Count
+	h1.PBES2Salt = h2.PBES2Salt
+	h1.Tag = h2.Tag
 	h1.Type = h2.Type
 	h1.X509Url = h2.X509Url
 	h1.X509CertChain = h2.X509CertChain
@@ -320,6 +410,50 @@ func (h1 *EssentialHeader) Copy(h2 *EssentialHeader) {
 	h1.X509CertThumbprintS256 = h2.X509CertThumbprintS256
 }
 
+// UnmarshalJSON parses the JSON representation of the header. The
+// values of "epk" and "jwk" are parsed using jwk.Parse, so that they
+// become the appropriate type of jwk.Key
+func (h *EssentialHeader) UnmarshalJSON(data []byte) error {
+	type essentialHeader EssentialHeader
+	proxy := struct {
+		*essentialHeader
+		EphemeralPublicKey json.RawMessage `json:"epk,omitempty"`
+		Jwk                json.RawMessage `json:"jwk,omitempty"`
+	}{essentialHeader: (*essentialHeader)(h)}
+
+	if err := json.Unmarshal(data, &proxy); err != nil {
+		return err
+	}
+
+	if len(proxy.EphemeralPublicKey) > 0 {
+		k, err := parseHeaderJwk(proxy.EphemeralPublicKey)
+		if err != nil {
+			return fmt.Errorf("failed to parse 'epk': %s", err)
+		}
+		h.EphemeralPublicKey = k
+	}
+
+	if len(proxy.Jwk) > 0 {
+		k, err := parseHeaderJwk(proxy.Jwk)
+		if err != nil {
+			return fmt.Errorf("failed to parse 'jwk': %s", err)
+		}
+		h.Jwk = k
+	}
+	return nil
+}
+
+func parseHeaderJwk(buf []byte) (jwk.Key, error) {
+	set, err := jwk.Parse(buf)
+	if err != nil {
+		return nil, err
+	}
+	if len(set.Keys) != 1 {
+		return nil, errors.New("expected a single JWK")
+	}
+	return set.Keys[0], nil
+}
+
 func (h Header) MarshalJSON() ([]byte, error) {
 	return emap.MergeMarshal(h.EssentialHeader, h.PrivateParams)
 }
@@ -340,7 +474,7 @@ func (h *Header) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &m); err != nil {
 		return err
 	}
-	for _, n := range []string{"alg", "apu", "apv", "enc", "cty", "zip", "crit", "epk", "jwk", "jku", "kid", "typ", "x5u", "x5c", "x5t", "x5t#S256"} {
+	for _, n := range []string{"alg", "apu", "apv", "enc", "cty", "zip", "crit", "epk", "iv", "jwk", "jku", "kid", "p2c", "p2s", "tag", "typ", "x5u", "x5c", "x5t", "x5t#S256"} {
 		delete(m, n)
 	}
 
@@ -352,7 +486,30 @@ func (h *Header) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// isEmpty returns true if the header does not contain any parameters
+func (h *Header) isEmpty() bool {
+	if h == nil {
+		return true
+	}
+	if len(h.PrivateParams) > 0 {
+		return false
+	}
+	if h.EssentialHeader == nil {
+		return true
+	}
+	buf, err := json.Marshal(h.EssentialHeader)
+	return err == nil && string(buf) == "{}"
+}
+
+// Base64Encode returns the base64 encoded JSON representation of the
+// header. If the header was parsed from a JWE message, the encoded
+// value from the source is returned as is, as re-encoding the header
+// may produce a different value
 func (e EncodedHeader) Base64Encode() ([]byte, error) {
+	if e.encoded.Len() > 0 {
+		return e.encoded.Bytes(), nil
+	}
+
 	buf, err := json.Marshal(e.Header)
 	if err != nil {
 		return nil, err
@@ -375,9 +532,14 @@ func (e EncodedHeader) MarshalJSON() ([]byte, error) {
 }
 
 func (e *EncodedHeader) UnmarshalJSON(buf []byte) error {
+	var encoded string
+	if err := json.Unmarshal(buf, &encoded); err != nil {
+		return err
+	}
+
 	b := buffer.Buffer{}
 	// base646 json string -> json object representation of header
-	if err := json.Unmarshal(buf, &b); err != nil {
+	if err := b.Base64Decode([]byte(encoded)); err != nil {
 		return err
 	}
 
@@ -385,9 +547,62 @@ func (e *EncodedHeader) UnmarshalJSON(buf []byte) error {
 		return err
 	}
 
+	e.encoded = buffer.Buffer(encoded)
 	return nil
 }
 
+// isEmpty returns true if the header does not contain any parameters
+func (e *EncodedHeader) isEmpty() bool {
+	return e == nil || (e.encoded.Len() == 0 && e.Header.isEmpty())
+}
+
+// MarshalJSON omits the "header" parameter if the recipient header is
+// empty, which is the case when all of its parameters are protected
+func (r Recipient) MarshalJSON() ([]byte, error) {
+	type recipient Recipient
+	proxy := recipient(r)
+	if proxy.Header.isEmpty() {
+		proxy.Header = nil
+	}
+	return json.Marshal(proxy)
+}
+
+// MarshalJSON omits the "protected" and "unprotected" parameters if
+// the respective headers are empty
+func (m Message) MarshalJSON() ([]byte, error) {
+	type message Message
+	proxy := message(m)
+	if proxy.ProtectedHeader.isEmpty() {
+		proxy.ProtectedHeader = nil
+	}
+	if proxy.UnprotectedHeader.isEmpty() {
+		proxy.UnprotectedHeader = nil
+	}
+	return json.Marshal(proxy)
+}
+
+// computeAAD computes the additional authenticated data used by the
+// content encryption. https://tools.ietf.org/html/rfc7516#section-5.1
+func computeAAD(protected *EncodedHeader, aad buffer.Buffer) ([]byte, error) {
+	var buf []byte
+	if !protected.isEmpty() {
+		encoded, err := protected.Base64Encode()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, encoded...)
+	}
+
+	if aad.Len() > 0 {
+		encoded, err := aad.Base64Encode()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(buf, '.'), encoded...)
+	}
+	return buf, nil
+}
+
 func NewMessage() *Message {
 	return &Message{
 		ProtectedHeader:   NewEncodedHeader(),
@@ -395,26 +610,133 @@ func NewMessage() *Message {
 	}
 }
 
+// Decrypt decrypts the message for the first recipient that uses the
+// key encryption algorithm `alg`, and can be decrypted using `key`
 func (m *Message) Decrypt(alg jwa.KeyEncryptionAlgorithm, key interface{}) ([]byte, error) {
+	return m.decrypt(func(h *Header) []interface{} {
+		if h.Algorithm != alg {
+			return nil
+		}
+		return []interface{}{key}
+	})
+}
+
+// DecryptWithKeyID is the same as Decrypt, but only considers the
+// recipients whose "kid" header matches `kid`
+func (m *Message) DecryptWithKeyID(alg jwa.KeyEncryptionAlgorithm, kid string, key interface{}) ([]byte, error) {
+	if kid == "" {
+		return nil, errors.New("empty key ID")
+	}
+
+	return m.decrypt(func(h *Header) []interface{} {
+		if h.Algorithm != alg || h.KeyID != kid {
+			return nil
+		}
+		return []interface{}{key}
+	})
+}
+
+// DecryptWithJWK decrypts the message using the keys in `keyset`. For
+// each recipient, the candidate keys are the ones whose "kid" matches
+// the recipient's "kid" (all keys if the recipient does not have one),
+// and whose "alg", "use" and "key_ops" allow them to be used with the
+// recipient's key encryption algorithm. Each candidate is tried until
+// the message is successfully decrypted.
+func (m *Message) DecryptWithJWK(keyset *jwk.Set) ([]byte, error) {
+	if keyset == nil {
+		return nil, errors.New("nil key set")
+	}
+
+	return m.decrypt(func(h *Header) []interface{} {
+		keys := keyset.Keys
+		if h.KeyID != "" {
+			keys = keyset.LookupKeyID(h.KeyID)
+		}
+
+		var candidates []interface{}
+		for _, key := range keys {
+			if !isDecryptionKey(key, h.Algorithm) {
+				continue
+			}
+
+			keyval, err := key.Materialize()
+			if err != nil {
+				debug.Printf("failed to materialize key (kid = %s): %s", key.Kid(), err)
+				continue
+			}
+			candidates = append(candidates, keyval)
+		}
+		return candidates
+	})
+}
+
+// isDecryptionKey checks if the JWK may be used to decrypt a CEK that
+// was encrypted using `alg`
+func isDecryptionKey(key jwk.Key, alg jwa.KeyEncryptionAlgorithm) bool {
+	if u := key.Use(); u != "" && u != string(jwk.ForEncryption) {
+		return false
+	}
+
+	if v := key.Alg(); v != "" && v != alg.String() {
+		return false
+	}
+
+	opsif, err := key.Get("key_ops")
+	if err != nil {
+		return true
+	}
+	ops, ok := opsif.([]jwk.KeyOperation)
+	if !ok || len(ops) == 0 {
+		return true
+	}
+
+	// "dir" uses the key as the CEK, ECDH-ES derives a key from it,
+	// and the rest of the algorithms use it to decrypt the CEK
+	var allowed []jwk.KeyOperation
+	switch alg {
+	case jwa.DIRECT:
+		allowed = []jwk.KeyOperation{jwk.KeyOpDecrypt}
+	case jwa.ECDH_ES, jwa.ECDH_ES_A128KW, jwa.ECDH_ES_A192KW, jwa.ECDH_ES_A256KW:
+		allowed = []jwk.KeyOperation{jwk.KeyOpDeriveKey, jwk.KeyOpDeriveBits}
+	default:
+		allowed = []jwk.KeyOperation{jwk.KeyOpUnwrapKey}
+	}
+
+	for _, op := range ops {
+		for _, a := range allowed {
+			if op == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decrypt attempts to decrypt the message for each recipient, using the
+// keys returned by `selectKeys`. `selectKeys` receives the complete
+// header for the recipient (the protected, unprotected and recipient
+// headers merged together)
+func (m *Message) decrypt(selectKeys func(*Header) []interface{}) ([]byte, error) {
 	var err error
 
 	if len(m.Recipients) == 0 {
 		return nil, errors.New("no recipients, can not proceed with decrypt")
 	}
 
-	enc := m.ProtectedHeader.ContentEncryption
+	if err := m.checkCritical(); err != nil {
+		return nil, err
+	}
 
-	h := NewHeader()
-	if err := h.Copy(m.ProtectedHeader.Header); err != nil {
+	if err := m.checkDisjointHeaders(); err != nil {
 		return nil, err
 	}
-	h, err = h.Merge(m.UnprotectedHeader)
+
+	compression, err := m.compression()
 	if err != nil {
-		debug.Printf("failed to merge unprotected header")
 		return nil, err
 	}
 
-	aad, err := m.AuthenticatedData.Base64Encode()
+	aad, err := computeAAD(m.ProtectedHeader, m.AuthenticatedData)
 	if err != nil {
 		return nil, err
 	}
@@ -422,72 +744,173 @@ func (m *Message) Decrypt(alg jwa.KeyEncryptionAlgorithm, key interface{}) ([]by
 	iv := m.InitializationVector.Bytes()
 	tag := m.Tag.Bytes()
 
-	cipher, err := BuildContentCipher(enc)
-	if err != nil {
-		return nil, fmt.Errorf("unsupported content cipher algorithm '%s'", enc)
-	}
-	keysize := cipher.KeySize()
-
 	var plaintext []byte
+RECIPIENTS:
 	for _, recipient := range m.Recipients {
-		debug.Printf("Attempting to check if we can decode for recipient (alg = %s)", recipient.Header.Algorithm)
-		if recipient.Header.Algorithm != alg {
+		h2, err := m.recipientHeader(recipient)
+		if err != nil {
+			debug.Printf("failed to merge headers: %s", err)
 			continue
 		}
 
-		h2 := NewHeader()
-		if err := h2.Copy(h); err != nil {
-			debug.Printf("failed to copy header: %s", err)
+		debug.Printf("Attempting to check if we can decode for recipient (alg = %s, kid = %s)", h2.Algorithm, h2.KeyID)
+		keys := selectKeys(h2)
+		if len(keys) == 0 {
 			continue
 		}
 
-		h2, err := h2.Merge(recipient.Header)
+		cipher, err := BuildContentCipher(h2.ContentEncryption)
 		if err != nil {
-			debug.Printf("Failed to merge! %s", err)
+			debug.Printf("unsupported content cipher algorithm '%s'", h2.ContentEncryption)
 			continue
 		}
 
-		k, err := BuildKeyDecrypter(h2.Algorithm, h2, key, keysize)
-		if err != nil {
-			debug.Printf("failed to create key decrypter: %s", err)
-			continue
-		}
+		for _, key := range keys {
+			k, err := BuildKeyDecrypter(h2.Algorithm, h2, key, cipher.KeySize())
+			if err != nil {
+				debug.Printf("failed to create key decrypter: %s", err)
+				continue
+			}
 
-		cek, err := k.KeyDecrypt(recipient.EncryptedKey.Bytes())
-		if err != nil {
-			debug.Printf("failed to decrypt key: %s", err)
-			return nil, errors.New("failed to decrypt key")
-			continue
-		}
+			cek, err := k.KeyDecrypt(recipient.EncryptedKey.Bytes())
+			if err != nil {
+				debug.Printf("failed to decrypt key: %s", err)
+				// Keep looping because there might be another key with the same algo
+				continue
+			}
 
-		plaintext, err = cipher.decrypt(cek, iv, ciphertext, tag, aad)
-		if err == nil {
-			break
+			plaintext, err = cipher.decrypt(cek, iv, ciphertext, tag, aad)
+			if err == nil {
+				break RECIPIENTS
+			}
+			debug.Printf("DecryptMessage: failed to decrypt using %s: %s", h2.Algorithm, err)
+			// Keep looping because there might be another key with the same algo
 		}
-		debug.Printf("DecryptMessage: failed to decrypt using %s: %s", h2.Algorithm, err)
-		// Keep looping because there might be another key with the same algo
 	}
 
 	if plaintext == nil {
 		return nil, errors.New("failed to find matching recipient to decrypt key")
 	}
 
-	if h.Compression == jwa.Deflate {
-		output := bytes.Buffer{}
-		w, _ := flate.NewWriter(&output, 1)
-		in := plaintext
-		for len(in) > 0 {
-			n, err := w.Write(in)
-			if err != nil {
-				return nil, err
+	plaintext, err = uncompress(compression, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return plaintext, nil
+}
+
+// compression returns the compression algorithm of the message. The
+// plaintext is decompressed before its integrity can be checked, so
+// "zip" is only allowed in the protected header
+// https://tools.ietf.org/html/rfc7516#section-4.1.3
+func (m *Message) compression() (jwa.CompressionAlgorithm, error) {
+	if m.UnprotectedHeader != nil && m.UnprotectedHeader.EssentialHeader != nil && m.UnprotectedHeader.Compression != jwa.NoCompress {
+		debug.Printf("'zip' found in shared unprotected header")
+		return jwa.NoCompress, ErrUnprotectedCompression
+	}
+	for _, recipient := range m.Recipients {
+		if recipient.Header != nil && recipient.Header.EssentialHeader != nil && recipient.Header.Compression != jwa.NoCompress {
+			debug.Printf("'zip' found in per-recipient header")
+			return jwa.NoCompress, ErrUnprotectedCompression
+		}
+	}
+
+	if m.ProtectedHeader == nil || m.ProtectedHeader.Header == nil || m.ProtectedHeader.EssentialHeader == nil {
+		return jwa.NoCompress, nil
+	}
+	return m.ProtectedHeader.Compression, nil
+}
+
+// checkDisjointHeaders makes sure that no header parameter appears in
+// more than one of the protected, the shared unprotected and the
+// per-recipient headers, as required by RFC 7516 Section 7.2.1.
+// Otherwise an unprotected value could override a protected one when
+// the headers are merged
+func (m *Message) checkDisjointHeaders() error {
+	var protected *Header
+	if m.ProtectedHeader != nil {
+		protected = m.ProtectedHeader.Header
+	}
+
+	shared := map[string]struct{}{}
+	for _, h := range []*Header{protected, m.UnprotectedHeader} {
+		names, err := h.paramNames()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if _, ok := shared[name]; ok {
+				debug.Printf("'%s' found in both the protected and the shared unprotected header", name)
+				return ErrDuplicateHeaderParameter
 			}
-			in = in[n:]
+			shared[name] = struct{}{}
+		}
+	}
+
+	for _, recipient := range m.Recipients {
+		names, err := recipient.Header.paramNames()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if _, ok := shared[name]; ok {
+				debug.Printf("'%s' found in both the per-recipient header and a shared header", name)
+				return ErrDuplicateHeaderParameter
+			}
+		}
+	}
+	return nil
+}
+
+// paramNames returns the names of the parameters in the header
+func (h *Header) paramNames() ([]string, error) {
+	if h == nil {
+		return nil, nil
+	}
+
+	var names []string
+	if h.EssentialHeader != nil {
+		buf, err := json.Marshal(h.EssentialHeader)
+		if err != nil {
+			return nil, err
 		}
-		if err := w.Close(); err != nil {
+		m := map[string]json.RawMessage{}
+		if err := json.Unmarshal(buf, &m); err != nil {
 			return nil, err
 		}
-		plaintext = output.Bytes()
+		for name := range m {
+			names = append(names, name)
+		}
+	}
+	for name := range h.PrivateParams {
+		names = append(names, name)
 	}
+	return names, nil
+}
 
-	return plaintext, nil
+// recipientHeader returns the complete header for `recipient`, i.e. the
+// protected, unprotected and recipient headers merged together
+func (m *Message) recipientHeader(recipient Recipient) (*Header, error) {
+	h := NewHeader()
+	if m.ProtectedHeader != nil && m.ProtectedHeader.Header != nil {
+		if err := h.Copy(m.ProtectedHeader.Header); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if m.UnprotectedHeader != nil {
+		h, err = h.Merge(m.UnprotectedHeader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if recipient.Header != nil {
+		h, err = h.Merge(recipient.Header)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
 }
@@ -12,32 +12,54 @@ func (s CompactSerialize) Serialize(m *Message) ([]byte, error) {
 		return nil, errors.New("wrong number of recipients for compact serialization")
 	}
 
+	// The compact serialization has no place for the additional
+	// authenticated data
+	if m.AuthenticatedData.Len() > 0 {
+		return nil, errors.New("additional authenticated data can not be used in compact serialization")
+	}
+
 	recipient := m.Recipients[0]
 
-	// The protected header must be a merge between the message-wide
-	// protected header AND the recipient header
-	hcopy := NewHeader()
 	// There's something wrong if m.ProtectedHeader.Header is nil, but
 	// it could happen
 	if m.ProtectedHeader == nil || m.ProtectedHeader.Header == nil {
 		return nil, errors.New("invalid protected header")
 	}
-	err := hcopy.Copy(m.ProtectedHeader.Header)
-	if err != nil {
-		return nil, fmt.Errorf("copy header failed (protected): %s", err)
-	}
-	hcopy, err = hcopy.Merge(m.UnprotectedHeader)
-	if err != nil {
-		return nil, fmt.Errorf("merge header failed (unprotected): %s", err)
-	}
-	hcopy, err = hcopy.Merge(recipient.Header)
-	if err != nil {
-		return nil, fmt.Errorf("merge header failed (recipient): %s", err)
-	}
 
-	protected, err := EncodedHeader{Header: hcopy}.Base64Encode()
-	if err != nil {
-		return nil, err
+	var protected []byte
+	var err error
+	if m.UnprotectedHeader.isEmpty() && recipient.Header.isEmpty() {
+		// Use the protected header as is, as it was used to compute
+		// the additional authenticated data
+		protected, err = m.ProtectedHeader.Base64Encode()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// The protected header must be a merge between the message-wide
+		// protected header AND the recipient header
+		hcopy := NewHeader()
+		err = hcopy.Copy(m.ProtectedHeader.Header)
+		if err != nil {
+			return nil, fmt.Errorf("copy header failed (protected): %s", err)
+		}
+		if m.UnprotectedHeader != nil {
+			hcopy, err = hcopy.Merge(m.UnprotectedHeader)
+			if err != nil {
+				return nil, fmt.Errorf("merge header failed (unprotected): %s", err)
+			}
+		}
+		if recipient.Header != nil {
+			hcopy, err = hcopy.Merge(recipient.Header)
+			if err != nil {
+				return nil, fmt.Errorf("merge header failed (recipient): %s", err)
+			}
+		}
+
+		protected, err = EncodedHeader{Header: hcopy}.Base64Encode()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	encryptedKey, err := recipient.EncryptedKey.Base64Encode()
@@ -66,8 +88,34 @@ func (s CompactSerialize) Serialize(m *Message) ([]byte, error) {
 
 // Serialize converts the mssage into a JWE JSON serialize format byte buffer
 func (s JSONSerialize) Serialize(m *Message) ([]byte, error) {
+	var v interface{} = m
+	if s.Flattened {
+		if len(m.Recipients) != 1 {
+			return nil, errors.New("wrong number of recipients for flattened serialization")
+		}
+
+		recipient := m.Recipients[0]
+		fm := flattenedMessage{
+			AuthenticatedData:    m.AuthenticatedData,
+			CipherText:           m.CipherText,
+			EncryptedKey:         recipient.EncryptedKey,
+			InitializationVector: m.InitializationVector,
+			Tag:                  m.Tag,
+		}
+		if !recipient.Header.isEmpty() {
+			fm.Header = recipient.Header
+		}
+		if !m.ProtectedHeader.isEmpty() {
+			fm.ProtectedHeader = m.ProtectedHeader
+		}
+		if !m.UnprotectedHeader.isEmpty() {
+			fm.UnprotectedHeader = m.UnprotectedHeader
+		}
+		v = fm
+	}
+
 	if s.Pretty {
-		return json.MarshalIndent(m, "", "  ")
+		return json.MarshalIndent(v, "", "  ")
 	}
-	return json.Marshal(m)
+	return json.Marshal(v)
 }
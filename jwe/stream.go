@@ -0,0 +1,640 @@
+package jwe
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/lestrrat/go-jwx/buffer"
+	"github.com/lestrrat/go-jwx/internal/debug"
+	"github.com/lestrrat/go-jwx/internal/streamutil"
+	"github.com/lestrrat/go-jwx/jwa"
+	"github.com/lestrrat/go-jwx/jwe/aescbc"
+)
+
+// maxStreamPartsSize is the maximum size of the parts of a message other
+// than the ciphertext (i.e. the headers, the encrypted keys, the IV and
+// the tag) that DecryptStream reads into memory
+const maxStreamPartsSize = 1024 * 1024
+
+// EncryptStream is the same as Encrypt, but it reads the payload from
+// `src`, and writes the JWE message in compact serialization to `dst`.
+// Only the AES-CBC-HMAC content encryption algorithms are supported.
+func EncryptStream(dst io.Writer, src io.Reader, keyalg jwa.KeyEncryptionAlgorithm, key interface{}, contentalg jwa.ContentEncryptionAlgorithm, compressalg jwa.CompressionAlgorithm, hdrs ...*Header) error {
+	enc, err := newMultiEncrypt(keyalg, key, contentalg, compressalg, hdrs)
+	if err != nil {
+		return err
+	}
+
+	return enc.EncryptStream(dst, src, CompactSerialize{})
+}
+
+// EncryptStream encrypts the plaintext read from `src`, and writes the
+// message to `dst` using `serializer`, which must be either
+// CompactSerialize or JSONSerialize. The plaintext, the compressed
+// plaintext and the ciphertext are never held in memory in their
+// entirety. Only the AES-CBC-HMAC content encryption algorithms are
+// supported.
+//
+// In the JSON serialization, the "ciphertext" and "tag" members are
+// written after all of the other members, so that DecryptStream can
+// decrypt the message without buffering the ciphertext.
+func (e MultiEncrypt) EncryptStream(dst io.Writer, src io.Reader, serializer Serializer) error {
+	if !isStreamable(e.ContentEncrypter.Algorithm()) {
+		return NewErrUnsupportedAlgorithm(string(e.ContentEncrypter.Algorithm()), "streaming content encryption")
+	}
+
+	cek, msg, err := e.newMessage()
+	if err != nil {
+		return err
+	}
+
+	aad, err := computeAAD(msg.ProtectedHeader, msg.AuthenticatedData)
+	if err != nil {
+		return err
+	}
+
+	c, err := aescbc.New(cek, aes.NewCipher)
+	if err != nil {
+		return err
+	}
+
+	bs, err := NewRandomKeyGenerate(c.NonceSize()).KeyGenerate()
+	if err != nil {
+		return err
+	}
+	msg.InitializationVector = bs.Bytes()
+
+	// Serialize everything but the ciphertext and the tag, which are
+	// written once they are available
+	prefix, err := streamPrefix(msg, serializer)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(prefix); err != nil {
+		return err
+	}
+
+	b64 := base64.NewEncoder(base64.RawURLEncoding, dst)
+	enc, err := c.NewStreamEncrypter(b64, msg.InitializationVector.Bytes(), aad)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = enc
+	var fw *flate.Writer
+	switch msg.ProtectedHeader.Compression {
+	case jwa.NoCompress:
+	case jwa.Deflate:
+		fw, err = flate.NewWriter(enc, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		w = fw
+	default:
+		return NewErrUnsupportedAlgorithm(string(msg.ProtectedHeader.Compression), "compression")
+	}
+
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+	if fw != nil {
+		if err := fw.Close(); err != nil {
+			return err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	if err := b64.Close(); err != nil {
+		return err
+	}
+
+	tag, err := buffer.Buffer(enc.Tag()).Base64Encode()
+	if err != nil {
+		return err
+	}
+
+	var suffix []byte
+	switch s := serializer.(type) {
+	case CompactSerialize:
+		suffix = append([]byte{'.'}, tag...)
+	case JSONSerialize:
+		sep := `","tag":"`
+		end := `"}`
+		if s.Pretty {
+			sep = `",` + "\n  " + `"tag": "`
+			end = `"` + "\n}"
+		}
+		suffix = append(append([]byte(sep), tag...), end...)
+	}
+	_, err = dst.Write(suffix)
+	return err
+}
+
+// streamPrefix serializes `m`, which has no ciphertext nor tag, up to
+// the point where the ciphertext should be written
+func streamPrefix(m *Message, serializer Serializer) ([]byte, error) {
+	switch s := serializer.(type) {
+	case CompactSerialize:
+		buf, err := s.Serialize(m)
+		if err != nil {
+			return nil, err
+		}
+		// buf is "header.encrypted_key.iv.." -- drop the separator for
+		// the tag, which is written later
+		return buf[:len(buf)-1], nil
+	case JSONSerialize:
+		buf, err := s.Serialize(m)
+		if err != nil {
+			return nil, err
+		}
+
+		members := map[string]json.RawMessage{}
+		if err := json.Unmarshal(buf, &members); err != nil {
+			return nil, err
+		}
+		delete(members, "ciphertext")
+		delete(members, "tag")
+
+		keys := make([]string, 0, len(members))
+		for k := range members {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		// The members are copied from the output of the serializer as
+		// they are, which means that they are already indented properly
+		// if s.Pretty is set
+		var out bytes.Buffer
+		out.WriteByte('{')
+		for _, k := range keys {
+			if s.Pretty {
+				out.WriteString("\n  ")
+			}
+			kbuf, err := json.Marshal(k)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(kbuf)
+			out.WriteByte(':')
+			if s.Pretty {
+				out.WriteByte(' ')
+			}
+			out.Write(members[k])
+			out.WriteByte(',')
+		}
+		if s.Pretty {
+			out.WriteString("\n  ")
+		}
+		out.WriteString(`"ciphertext":`)
+		if s.Pretty {
+			out.WriteByte(' ')
+		}
+		out.WriteByte('"')
+		return out.Bytes(), nil
+	}
+	return nil, errors.New("streaming requires either CompactSerialize or JSONSerialize")
+}
+
+// DecryptStream is the same as Decrypt, but it reads the JWE message from
+// `src`, and writes the decrypted payload to `dst`. The JWE message can
+// be either compact or JSON format. Only the AES-CBC-HMAC content
+// encryption algorithms are supported.
+//
+// The payload is written to `dst` as it is being decrypted, i.e. BEFORE
+// the authentication tag has been verified. You must discard whatever
+// has been written to `dst` unless DecryptStream returns a nil error.
+// As the payload is not held in memory, MaxDecompressedSize does not
+// apply to compressed messages.
+//
+// Unlike Decrypt, only the first recipient whose CEK can be decrypted
+// using `key` is considered, as the ciphertext can only be read once.
+//
+// In the JSON format, all of the members except for "tag" must precede
+// "ciphertext" for it to be decrypted as it is being read (which is the
+// case for messages created by MultiEncrypt.EncryptStream). If the
+// "ciphertext" member precedes the "iv" member (which is the case for
+// messages serialized by JSONSerialize), the ciphertext can not be
+// decrypted until the IV is known, so the (base64url decoded) ciphertext
+// is read into memory before it is decrypted. DecryptStream fails with
+// ErrTooLarge if it is larger than MaxBufferedCiphertextSize bytes: use
+// MultiEncrypt.EncryptStream to create messages that are too large for
+// that.
+//
+// The parts of the message other than the ciphertext are read into
+// memory, and DecryptStream fails if they are larger than 1 MiB.
+func DecryptStream(dst io.Writer, src io.Reader, alg jwa.KeyEncryptionAlgorithm, key interface{}) error {
+	r := bufio.NewReader(src)
+
+	var c byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("empty buffer")
+			}
+			return err
+		}
+		if !isSpace(b) {
+			c = b
+			break
+		}
+	}
+	if err := r.UnreadByte(); err != nil {
+		return err
+	}
+
+	var m *Message
+	var ciphertext io.Reader
+	var tag func() ([]byte, error)
+	var err error
+	if c == '{' {
+		m, ciphertext, tag, err = parseJSONStream(r)
+	} else {
+		m, ciphertext, tag, err = parseCompactStream(r)
+	}
+	if err != nil {
+		return err
+	}
+
+	return m.decryptStream(dst, ciphertext, tag, alg, key)
+}
+
+// parseCompactStream parses the first three parts of a compact JWE
+// message. The ciphertext can be read from the returned reader, and the
+// tag is parsed once the ciphertext has been read
+func parseCompactStream(r *bufio.Reader) (*Message, io.Reader, func() ([]byte, error), error) {
+	var prefix []byte
+	for i := 0; i < 3; i++ {
+		part, err := streamutil.ReadBytes(r, '.', maxStreamPartsSize-len(prefix))
+		if err != nil {
+			if err == io.EOF {
+				return nil, nil, nil, ErrInvalidCompactPartsCount
+			}
+			return nil, nil, nil, err
+		}
+		prefix = append(prefix, part...)
+	}
+	prefix = bytes.TrimSpace(prefix)
+
+	// Parse the message without the ciphertext and the tag
+	m, err := parseCompact(append(prefix, '.'))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ciphertext := streamutil.NewSegmentReader(r)
+	tag := func() ([]byte, error) {
+		if !ciphertext.Found() {
+			return nil, ErrInvalidCompactPartsCount
+		}
+
+		tagbuf, err := streamutil.ReadAll(r, maxStreamPartsSize)
+		if err != nil {
+			return nil, err
+		}
+		tagbuf = bytes.TrimSpace(tagbuf)
+		if bytes.IndexByte(tagbuf, '.') > -1 {
+			return nil, ErrInvalidCompactPartsCount
+		}
+
+		decoded, err := buffer.FromBase64(tagbuf)
+		if err != nil {
+			return nil, err
+		}
+		return decoded.Bytes(), nil
+	}
+	return m, base64.NewDecoder(base64.RawURLEncoding, ciphertext), tag, nil
+}
+
+// parseJSONStream parses the members of a JSON JWE message that precede
+// the "ciphertext" member. The ciphertext can be read from the returned
+// reader, and the rest of the members are parsed once the ciphertext
+// has been read
+func parseJSONStream(r *bufio.Reader) (*Message, io.Reader, func() ([]byte, error), error) {
+	members := map[string]json.RawMessage{}
+
+	dec := json.NewDecoder(streamutil.LimitReader(r, maxStreamPartsSize))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if tok != json.Delim('{') {
+		return nil, nil, nil, errors.New("invalid message: expected a json object")
+	}
+
+	found := false
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		name, ok := tok.(string)
+		if !ok {
+			return nil, nil, nil, errors.New("invalid message: expected a member name")
+		}
+		if name == "ciphertext" {
+			found = true
+			break
+		}
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, nil, nil, err
+		}
+		members[name] = raw
+	}
+	if !found {
+		return nil, nil, nil, errors.New("invalid message: missing ciphertext")
+	}
+
+	// The decoder has consumed the member name, but not the colon that
+	// follows. From here on we read the input ourselves
+	rest := bufio.NewReader(io.MultiReader(dec.Buffered(), r))
+	if err := expectByte(rest, ':'); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := expectByte(rest, '"'); err != nil {
+		return nil, nil, nil, err
+	}
+	ciphertext := &stringReader{r: rest}
+
+	// parseRest parses the members that follow the ciphertext, and
+	// returns the tag
+	parseRest := func() ([]byte, error) {
+		if !ciphertext.done {
+			return nil, errors.New("invalid message: unterminated ciphertext")
+		}
+
+		buf, err := streamutil.ReadAll(rest, maxStreamPartsSize)
+		if err != nil {
+			return nil, err
+		}
+
+		after, err := trailingMembers(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		var tag buffer.Buffer
+		for name, raw := range after {
+			if name != "tag" {
+				// The CEK and the additional authenticated data have
+				// already been computed without this member
+				return nil, errors.New("invalid message: '" + name + "' must precede the ciphertext")
+			}
+			if err := json.Unmarshal(raw, &tag); err != nil {
+				return nil, err
+			}
+		}
+		return tag.Bytes(), nil
+	}
+
+	// Without the IV the ciphertext can not be decrypted as it is being
+	// read, so read it into memory first, along with the rest of the
+	// members. Only the decoded ciphertext is kept, and only up to
+	// MaxBufferedCiphertextSize bytes of it
+	if _, ok := members["iv"]; !ok {
+		debug.Printf("'iv' follows 'ciphertext', buffering the ciphertext")
+		decoded, err := streamutil.ReadAll(base64.NewDecoder(base64.RawURLEncoding, ciphertext), MaxBufferedCiphertextSize)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if !ciphertext.done {
+			return nil, nil, nil, errors.New("invalid message: unterminated ciphertext")
+		}
+		remaining, err := streamutil.ReadAll(rest, maxStreamPartsSize)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		after, err := trailingMembers(remaining)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for name, raw := range after {
+			members[name] = raw
+		}
+
+		m, err := messageFromMembers(members)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		tag := m.Tag.Bytes()
+		return m, bytes.NewReader(decoded), func() ([]byte, error) { return tag, nil }, nil
+	}
+
+	m, err := messageFromMembers(members)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return m, base64.NewDecoder(base64.RawURLEncoding, ciphertext), parseRest, nil
+}
+
+// trailingMembers parses the members that follow the ciphertext. `buf`
+// is the rest of the JSON object, i.e. either '}' or ', ... }'
+func trailingMembers(buf []byte) (map[string]json.RawMessage, error) {
+	buf = bytes.TrimSpace(buf)
+	switch {
+	case bytes.HasPrefix(buf, []byte{','}):
+		buf = buf[1:]
+	case bytes.HasPrefix(buf, []byte{'}'}):
+	default:
+		return nil, errors.New("invalid message: malformed json object")
+	}
+
+	members := map[string]json.RawMessage{}
+	if err := json.Unmarshal(append([]byte{'{'}, buf...), &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func messageFromMembers(members map[string]json.RawMessage) (*Message, error) {
+	buf, err := json.Marshal(members)
+	if err != nil {
+		return nil, err
+	}
+	return parseJSON(buf)
+}
+
+// decryptStream decrypts the ciphertext read from `ciphertext` for the
+// first recipient that uses the key encryption
+// algorithm `alg`, and whose CEK can be decrypted using `key`
+func (m *Message) decryptStream(dst io.Writer, ciphertext io.Reader, tag func() ([]byte, error), alg jwa.KeyEncryptionAlgorithm, key interface{}) error {
+	if len(m.Recipients) == 0 {
+		return errors.New("no recipients, can not proceed with decrypt")
+	}
+
+	if err := m.checkCritical(); err != nil {
+		return err
+	}
+
+	if err := m.checkDisjointHeaders(); err != nil {
+		return err
+	}
+
+	compression, err := m.compression()
+	if err != nil {
+		return err
+	}
+
+	aad, err := computeAAD(m.ProtectedHeader, m.AuthenticatedData)
+	if err != nil {
+		return err
+	}
+
+	var cek []byte
+	var h *Header
+	for _, recipient := range m.Recipients {
+		h2, err := m.recipientHeader(recipient)
+		if err != nil {
+			debug.Printf("failed to merge headers: %s", err)
+			continue
+		}
+		if h2.Algorithm != alg {
+			continue
+		}
+
+		if !isStreamable(h2.ContentEncryption) {
+			return NewErrUnsupportedAlgorithm(string(h2.ContentEncryption), "streaming content decryption")
+		}
+
+		cipher, err := BuildContentCipher(h2.ContentEncryption)
+		if err != nil {
+			return err
+		}
+
+		k, err := BuildKeyDecrypter(h2.Algorithm, h2, key, cipher.KeySize())
+		if err != nil {
+			debug.Printf("failed to create key decrypter: %s", err)
+			continue
+		}
+
+		cek, err = k.KeyDecrypt(recipient.EncryptedKey.Bytes())
+		if err != nil {
+			debug.Printf("failed to decrypt key: %s", err)
+			continue
+		}
+		if len(cek) != cipher.KeySize() {
+			debug.Printf("invalid key size %d (expected %d)", len(cek), cipher.KeySize())
+			continue
+		}
+		h = h2
+		break
+	}
+
+	if h == nil {
+		return errors.New("failed to find matching recipient to decrypt key")
+	}
+
+	c, err := aescbc.New(cek, aes.NewCipher)
+	if err != nil {
+		return err
+	}
+
+	dec, err := c.NewStreamDecrypter(ciphertext, m.InitializationVector.Bytes(), aad, tag)
+	if err != nil {
+		return err
+	}
+
+	switch compression {
+	case jwa.NoCompress:
+		_, err = io.Copy(dst, dec)
+		return err
+	case jwa.Deflate:
+		fr := flate.NewReader(dec)
+		defer fr.Close()
+		if _, err := io.Copy(dst, fr); err != nil {
+			return err
+		}
+		// The compressed stream may end before the ciphertext does. The
+		// tag is only verified once all of the ciphertext has been read
+		_, err = io.Copy(ioutil.Discard, dec)
+		return err
+	default:
+		return NewErrUnsupportedAlgorithm(string(compression), "compression")
+	}
+}
+
+// isStreamable returns true if the content encryption algorithm `alg`
+// can be used with EncryptStream and DecryptStream
+func isStreamable(alg jwa.ContentEncryptionAlgorithm) bool {
+	switch alg {
+	case jwa.A128CBC_HS256, jwa.A192CBC_HS384, jwa.A256CBC_HS512:
+		return true
+	}
+	return false
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+// expectByte skips whitespace, and reads `c`
+func expectByte(r *bufio.Reader, c byte) error {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if isSpace(b) {
+			continue
+		}
+		if b != c {
+			return errors.New("invalid message: malformed json object")
+		}
+		return nil
+	}
+}
+
+// stringReader reads the contents of a JSON string from r, up to the
+// closing quote. The string must not contain any escape sequences,
+// which is the case for base64url encoded values
+type stringReader struct {
+	r    *bufio.Reader
+	buf  []byte
+	done bool
+}
+
+func (s *stringReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+
+		chunk, err := s.r.ReadSlice('"')
+		switch err {
+		case nil:
+			s.buf = chunk[:len(chunk)-1]
+			s.done = true
+		case bufio.ErrBufferFull:
+			s.buf = chunk
+		case io.EOF:
+			return 0, io.ErrUnexpectedEOF
+		default:
+			return 0, err
+		}
+
+		if bytes.IndexByte(s.buf, '\\') > -1 {
+			return 0, errors.New("invalid message: unexpected escape sequence in ciphertext")
+		}
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
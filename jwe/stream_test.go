@@ -0,0 +1,238 @@
+package jwe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/lestrrat/go-jwx/internal/streamutil"
+	"github.com/lestrrat/go-jwx/jwa"
+	"github.com/stretchr/testify/assert"
+)
+
+// onlyReader hides any other interface (e.g. io.WriterTo) that the
+// underlying reader implements, so that the data is read in chunks
+type onlyReader struct {
+	io.Reader
+}
+
+func TestStream_Roundtrip(t *testing.T) {
+	sharedkey := []byte("Lorem ipsum dolo")
+
+	payload := make([]byte, 1024*1024+3)
+	if _, err := rand.Read(payload); !assert.NoError(t, err, "payload generated") {
+		return
+	}
+
+	serializers := []struct {
+		name       string
+		serializer Serializer
+	}{
+		{"Compact", CompactSerialize{}},
+		{"JSON", JSONSerialize{}},
+		{"JSON (pretty)", JSONSerialize{Pretty: true}},
+		{"JSON (flattened)", JSONSerialize{Flattened: true}},
+	}
+
+	for _, contentalg := range []jwa.ContentEncryptionAlgorithm{jwa.A128CBC_HS256, jwa.A192CBC_HS384, jwa.A256CBC_HS512} {
+		for _, compressalg := range []jwa.CompressionAlgorithm{jwa.NoCompress, jwa.Deflate} {
+			for _, s := range serializers {
+				t.Run(contentalg.String()+"/"+string(compressalg)+"/"+s.name, func(t *testing.T) {
+					enc, err := newMultiEncrypt(jwa.A128KW, sharedkey, contentalg, compressalg, nil)
+					if !assert.NoError(t, err, "newMultiEncrypt is successful") {
+						return
+					}
+
+					var encrypted bytes.Buffer
+					if !assert.NoError(t, enc.EncryptStream(&encrypted, onlyReader{bytes.NewReader(payload)}, s.serializer), "EncryptStream is successful") {
+						return
+					}
+
+					// Must be compatible with Decrypt
+					decrypted, err := Decrypt(encrypted.Bytes(), jwa.A128KW, sharedkey)
+					if !assert.NoError(t, err, "Decrypt is successful") {
+						return
+					}
+					if !assert.Equal(t, payload, decrypted, "payload matches") {
+						return
+					}
+
+					var out bytes.Buffer
+					if !assert.NoError(t, DecryptStream(&out, onlyReader{bytes.NewReader(encrypted.Bytes())}, jwa.A128KW, sharedkey), "DecryptStream is successful") {
+						return
+					}
+					if !assert.Equal(t, payload, out.Bytes(), "payload matches") {
+						return
+					}
+
+					// Messages created by MultiEncrypt.Encrypt can also be
+					// decrypted. In the JSON serialization, "ciphertext"
+					// precedes "iv", so the ciphertext is buffered
+					msg, err := enc.Encrypt(payload)
+					if !assert.NoError(t, err, "Encrypt is successful") {
+						return
+					}
+					buf, err := s.serializer.Serialize(msg)
+					if !assert.NoError(t, err, "Serialize is successful") {
+						return
+					}
+					out.Reset()
+					if !assert.NoError(t, DecryptStream(&out, bytes.NewReader(buf), jwa.A128KW, sharedkey), "DecryptStream is successful") {
+						return
+					}
+					if !assert.Equal(t, payload, out.Bytes(), "payload matches") {
+						return
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestStream_MaxBufferedCiphertextSize(t *testing.T) {
+	sharedkey := []byte("Lorem ipsum dolo")
+	payload := make([]byte, 1024)
+	if _, err := rand.Read(payload); !assert.NoError(t, err, "payload generated") {
+		return
+	}
+
+	defer func(v int64) { MaxBufferedCiphertextSize = v }(MaxBufferedCiphertextSize)
+	MaxBufferedCiphertextSize = int64(len(payload))
+
+	enc, err := newMultiEncrypt(jwa.A128KW, sharedkey, jwa.A128CBC_HS256, jwa.NoCompress, nil)
+	if !assert.NoError(t, err, "newMultiEncrypt is successful") {
+		return
+	}
+
+	// With padding, the ciphertext is larger than the payload. The
+	// limit does not apply when the ciphertext is not buffered...
+	var encrypted bytes.Buffer
+	if !assert.NoError(t, enc.EncryptStream(&encrypted, bytes.NewReader(payload), JSONSerialize{}), "EncryptStream is successful") {
+		return
+	}
+	var out bytes.Buffer
+	if !assert.NoError(t, DecryptStream(&out, bytes.NewReader(encrypted.Bytes()), jwa.A128KW, sharedkey), "DecryptStream is successful") {
+		return
+	}
+	if !assert.Equal(t, payload, out.Bytes(), "payload matches") {
+		return
+	}
+
+	// ...but it does when "iv" follows "ciphertext"
+	msg, err := enc.Encrypt(payload)
+	if !assert.NoError(t, err, "Encrypt is successful") {
+		return
+	}
+	buf, err := JSONSerialize{}.Serialize(msg)
+	if !assert.NoError(t, err, "Serialize is successful") {
+		return
+	}
+	if !assert.Equal(t, ErrTooLarge, DecryptStream(ioutil.Discard, bytes.NewReader(buf), jwa.A128KW, sharedkey), "DecryptStream fails with ErrTooLarge") {
+		return
+	}
+
+	MaxBufferedCiphertextSize = int64(len(msg.CipherText.Bytes()))
+	out.Reset()
+	if !assert.NoError(t, DecryptStream(&out, bytes.NewReader(buf), jwa.A128KW, sharedkey), "DecryptStream with exactly MaxBufferedCiphertextSize bytes is successful") {
+		return
+	}
+	if !assert.Equal(t, payload, out.Bytes(), "payload matches") {
+		return
+	}
+}
+
+func TestStream_AuthenticatedData(t *testing.T) {
+	rsakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "RSA key generated") {
+		return
+	}
+
+	contentcrypt, err := NewAesCrypt(jwa.A256CBC_HS512)
+	if !assert.NoError(t, err, "NewAesCrypt is successful") {
+		return
+	}
+	keyenc, err := NewRSAOAEPKeyEncrypt(jwa.RSA_OAEP, &rsakey.PublicKey)
+	if !assert.NoError(t, err, "NewRSAOAEPKeyEncrypt is successful") {
+		return
+	}
+
+	enc := NewMultiEncrypt(contentcrypt, NewRandomKeyGenerate(contentcrypt.KeySize()), keyenc)
+	enc.AuthenticatedData = []byte("additional authenticated data")
+	enc.UnprotectedHeader = NewHeader()
+	enc.UnprotectedHeader.Set("cty", "text/plain")
+
+	payload := []byte("Lorem ipsum dolor sit amet")
+	if !assert.Error(t, enc.EncryptStream(ioutil.Discard, bytes.NewReader(payload), CompactSerialize{}), "EncryptStream should fail with compact serialization") {
+		return
+	}
+
+	var encrypted bytes.Buffer
+	if !assert.NoError(t, enc.EncryptStream(&encrypted, bytes.NewReader(payload), JSONSerialize{}), "EncryptStream is successful") {
+		return
+	}
+
+	var out bytes.Buffer
+	if !assert.NoError(t, DecryptStream(&out, bytes.NewReader(encrypted.Bytes()), jwa.RSA_OAEP, rsakey), "DecryptStream is successful") {
+		return
+	}
+	if !assert.Equal(t, payload, out.Bytes(), "payload matches") {
+		return
+	}
+
+	// The additional authenticated data is integrity protected
+	tampered := bytes.Replace(encrypted.Bytes(), []byte(`"aad":"`), []byte(`"aad":"A`), 1)
+	if !assert.Error(t, DecryptStream(ioutil.Discard, bytes.NewReader(tampered), jwa.RSA_OAEP, rsakey), "DecryptStream should fail") {
+		return
+	}
+}
+
+func TestStream_Tampered(t *testing.T) {
+	sharedkey := []byte("Lorem ipsum dolo")
+	payload := bytes.Repeat([]byte("Lorem ipsum "), 10000)
+
+	var encrypted bytes.Buffer
+	if !assert.NoError(t, EncryptStream(&encrypted, bytes.NewReader(payload), jwa.A128KW, sharedkey, jwa.A128CBC_HS256, jwa.Deflate), "EncryptStream is successful") {
+		return
+	}
+
+	parts := bytes.Split(encrypted.Bytes(), []byte{'.'})
+	if !assert.Len(t, parts, 5, "compact serialization") {
+		return
+	}
+
+	tampered := append([]byte{}, encrypted.Bytes()...)
+	i := len(parts[0]) + len(parts[1]) + len(parts[2]) + 3 + 10
+	tampered[i] ^= 0x01
+	if !assert.Error(t, DecryptStream(ioutil.Discard, bytes.NewReader(tampered), jwa.A128KW, sharedkey), "DecryptStream should fail") {
+		return
+	}
+
+	if !assert.Error(t, DecryptStream(ioutil.Discard, bytes.NewReader(encrypted.Bytes()), jwa.A128KW, []byte("dolor sit amet, ")), "DecryptStream should fail with the wrong key") {
+		return
+	}
+
+	if !assert.Equal(t, ErrInvalidCompactPartsCount, DecryptStream(ioutil.Discard, bytes.NewReader(bytes.Join(parts[:4], []byte{'.'})), jwa.A128KW, sharedkey), "DecryptStream should fail with missing parts") {
+		return
+	}
+
+	// Everything but the ciphertext is read into memory, so its size is
+	// limited
+	huge := bytes.Repeat([]byte{'A'}, maxStreamPartsSize+1)
+	if !assert.Equal(t, streamutil.ErrTooLarge, DecryptStream(ioutil.Discard, bytes.NewReader(huge), jwa.A128KW, sharedkey), "DecryptStream should fail with a huge header") {
+		return
+	}
+	if !assert.Equal(t, streamutil.ErrTooLarge, DecryptStream(ioutil.Discard, bytes.NewReader(append(append([]byte{}, encrypted.Bytes()...), huge...)), jwa.A128KW, sharedkey), "DecryptStream should fail with a huge tag") {
+		return
+	}
+	hugejson := append([]byte(`{"unprotected":{"foo":"`), huge...)
+	if !assert.Equal(t, streamutil.ErrTooLarge, DecryptStream(ioutil.Discard, bytes.NewReader(hugejson), jwa.A128KW, sharedkey), "DecryptStream should fail with a huge JSON member") {
+		return
+	}
+
+	if !assert.Error(t, EncryptStream(ioutil.Discard, bytes.NewReader(payload), jwa.A128KW, sharedkey, jwa.A128GCM, jwa.NoCompress), "EncryptStream should fail with AES-GCM") {
+		return
+	}
+}
@@ -1,29 +1,45 @@
 package jwk
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"math/big"
 
+	"github.com/lestrrat/go-jwx/buffer"
 	"github.com/lestrrat/go-jwx/jwa"
 )
 
 func NewEcdsaPublicKey(pk *ecdsa.PublicKey) *EcdsaPublicKey {
+	crv := jwa.EllipticCurveAlgorithm(pk.Params().Name)
 	pubkey := &EcdsaPublicKey{
-		Curve: jwa.EllipticCurveAlgorithm(pk.Params().Name),
+		EssentialHeader: &EssentialHeader{KeyType: jwa.EC},
+		Curve:           crv,
 	}
-	pubkey.X.SetBytes(pk.X.Bytes())
-	pubkey.Y.SetBytes(pk.Y.Bytes())
+	// x and y must be the full size of the coordinate
+	// https://tools.ietf.org/html/rfc7518#section-6.2.1.2
+	pubkey.X.SetBytes(padBytes(pk.X.Bytes(), crv.Size()))
+	pubkey.Y.SetBytes(padBytes(pk.Y.Bytes(), crv.Size()))
 	return pubkey
 }
 
 func NewEcdsaPrivateKey(pk *ecdsa.PrivateKey) *EcdsaPrivateKey {
 	pubkey := NewEcdsaPublicKey(&pk.PublicKey)
 	privkey := &EcdsaPrivateKey{EcdsaPublicKey: pubkey}
-	privkey.D.SetBytes(pk.D.Bytes())
+	privkey.D.SetBytes(padBytes(pk.D.Bytes(), pubkey.Curve.Size()))
 	return privkey
 }
 
+// padBytes left-pads `b` with zeros so that it is `size` bytes long
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	buf := make([]byte, size)
+	copy(buf[size-len(b):], b)
+	return buf
+}
+
 func (k *EcdsaPublicKey) Materialize() (interface{}, error) {
 	return k.PublicKey()
 }
@@ -49,6 +65,42 @@ func (k *EcdsaPublicKey) PublicKey() (*ecdsa.PublicKey, error) {
 	return pubkey, nil
 }
 
+// Thumbprint computes the JWK thumbprint of the key using `hash`. The
+// required members for EC keys are "crv", "kty", "x" and "y"
+func (k *EcdsaPublicKey) Thumbprint(hash crypto.Hash) ([]byte, error) {
+	x, err := k.X.Base64Encode()
+	if err != nil {
+		return nil, err
+	}
+	y, err := k.Y.Base64Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return thumbprint(hash, map[string]string{
+		"crv": k.Curve.String(),
+		"kty": string(jwa.EC),
+		"x":   string(x),
+		"y":   string(y),
+	})
+}
+
+// Public returns the public part of the key as a JWK, with the same
+// header parameters. Note that PublicKey (which is promoted from
+// EcdsaPublicKey) returns a *ecdsa.PublicKey instead
+func (k *EcdsaPrivateKey) Public() *EcdsaPublicKey {
+	return k.EcdsaPublicKey.copy()
+}
+
+func (k *EcdsaPublicKey) copy() *EcdsaPublicKey {
+	return &EcdsaPublicKey{
+		EssentialHeader: k.EssentialHeader.copy(),
+		Curve:           k.Curve,
+		X:               buffer.Buffer(append([]byte(nil), k.X.Bytes()...)),
+		Y:               buffer.Buffer(append([]byte(nil), k.Y.Bytes()...)),
+	}
+}
+
 func (k *EcdsaPrivateKey) Materialize() (interface{}, error) {
 	return k.PrivateKey()
 }
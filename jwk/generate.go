@@ -0,0 +1,164 @@
+package jwk
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+
+	"github.com/lestrrat/go-jwx/buffer"
+	"github.com/lestrrat/go-jwx/jwa"
+	"github.com/lestrrat/go-jwx/x25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	// DefaultRsaKeySize is the size of RSA keys created by Generate, in bits
+	DefaultRsaKeySize = 2048
+	// DefaultSymmetricKeySize is the size of symmetric keys created by
+	// Generate, in bytes
+	DefaultSymmetricKeySize = 32
+)
+
+// GenerateParams specifies the key created by Generate. The zero value
+// can be used to create a key using the defaults
+type GenerateParams struct {
+	// Size is the size of the RSA modulus in bits (DefaultRsaKeySize if
+	// not specified), or the size of the symmetric key in bytes
+	// (DefaultSymmetricKeySize if not specified)
+	Size int
+	// Curve is the curve of the EC key (P-256 if not specified) or the
+	// OKP key (Ed25519 if not specified)
+	Curve jwa.EllipticCurveAlgorithm
+	// Algorithm is the "alg" of the key. If not specified, it is derived
+	// from the type of the key (e.g. RS256 for RSA keys)
+	Algorithm string
+	// Usage is the "use" of the key. If not specified, it is "enc" for
+	// X25519 keys, and "sig" for the rest
+	Usage KeyUsageType
+	// KeyID is the "kid" of the key. If not specified, the key's JWK
+	// thumbprint is used (see AssignKeyID)
+	KeyID string
+}
+
+// Generate creates a new private key of the given type, and returns it
+// as a JWK with "kid", "use" and "alg" populated. The returned key is
+// either a *RsaPrivateKey, *EcdsaPrivateKey, *OKPPrivateKey or
+// *SymmetricKey. Use PublicKeyOf to obtain the public key as a JWK
+// (symmetric keys have no public counterpart, so it fails for them)
+func Generate(kty jwa.KeyType, params GenerateParams) (Key, error) {
+	var key Key
+	var hdr *EssentialHeader
+	var alg string
+	usage := ForSignature
+
+	switch kty {
+	case jwa.RSA:
+		size := params.Size
+		if size == 0 {
+			size = DefaultRsaKeySize
+		}
+		// RFC 7518 Section 3.3
+		if size < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+
+		pk, err := rsa.GenerateKey(rand.Reader, size)
+		if err != nil {
+			return nil, err
+		}
+		k, err := NewRsaPrivateKey(pk)
+		if err != nil {
+			return nil, err
+		}
+		key, hdr, alg = k, k.EssentialHeader, jwa.RS256.String()
+	case jwa.EC:
+		var crv elliptic.Curve
+		switch params.Curve {
+		case jwa.P256, "":
+			crv, alg = elliptic.P256(), jwa.ES256.String()
+		case jwa.P384:
+			crv, alg = elliptic.P384(), jwa.ES384.String()
+		case jwa.P521:
+			crv, alg = elliptic.P521(), jwa.ES512.String()
+		default:
+			return nil, ErrUnsupportedCurve
+		}
+
+		pk, err := ecdsa.GenerateKey(crv, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		k := NewEcdsaPrivateKey(pk)
+		key, hdr = k, k.EssentialHeader
+	case jwa.OKP:
+		var pk interface{}
+		var err error
+		switch params.Curve {
+		case jwa.Ed25519, "":
+			_, pk, err = ed25519.GenerateKey(rand.Reader)
+			alg = jwa.EdDSA.String()
+		case jwa.X25519:
+			_, pk, err = x25519.GenerateKey(rand.Reader)
+			alg = jwa.ECDH_ES.String()
+			usage = ForEncryption
+		default:
+			return nil, ErrUnsupportedCurve
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		k, err := NewOKPPrivateKey(pk)
+		if err != nil {
+			return nil, err
+		}
+		key, hdr = k, k.EssentialHeader
+	case jwa.OctetSeq:
+		size := params.Size
+		if size == 0 {
+			size = DefaultSymmetricKeySize
+		}
+
+		buf := make([]byte, size)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+
+		// The HMAC algorithms require keys that are at least as large
+		// as the hash output (RFC 7518 Section 3.2). Smaller keys don't
+		// get a default "alg"
+		switch {
+		case size >= 64:
+			alg = jwa.HS512.String()
+		case size >= 48:
+			alg = jwa.HS384.String()
+		case size >= 32:
+			alg = jwa.HS256.String()
+		}
+
+		k := &SymmetricKey{
+			EssentialHeader: &EssentialHeader{KeyType: jwa.OctetSeq},
+			Key:             buffer.Buffer(buf),
+		}
+		key, hdr = k, k.EssentialHeader
+	default:
+		return nil, ErrUnsupportedKty
+	}
+
+	if params.Algorithm != "" {
+		alg = params.Algorithm
+	}
+	if params.Usage != "" {
+		usage = params.Usage
+	}
+
+	hdr.Algorithm = alg
+	hdr.KeyUsage = string(usage)
+	hdr.KeyID = params.KeyID
+	if err := AssignKeyID(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,130 @@
+package jwk
+
+import (
+	"crypto"
+	"encoding/json"
+	"testing"
+
+	"github.com/lestrrat/go-jwx/buffer"
+	"github.com/lestrrat/go-jwx/jwa"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerate(t *testing.T) {
+	data := []struct {
+		name   string
+		kty    jwa.KeyType
+		params GenerateParams
+		alg    string
+		use    KeyUsageType
+	}{
+		{"RSA", jwa.RSA, GenerateParams{}, "RS256", ForSignature},
+		{"RSA (PS384)", jwa.RSA, GenerateParams{Size: 3072, Algorithm: "PS384"}, "PS384", ForSignature},
+		{"EC", jwa.EC, GenerateParams{}, "ES256", ForSignature},
+		{"EC (P-384)", jwa.EC, GenerateParams{Curve: jwa.P384}, "ES384", ForSignature},
+		{"EC (P-521)", jwa.EC, GenerateParams{Curve: jwa.P521}, "ES512", ForSignature},
+		{"EC (ECDH-ES)", jwa.EC, GenerateParams{Algorithm: "ECDH-ES", Usage: ForEncryption}, "ECDH-ES", ForEncryption},
+		{"OKP", jwa.OKP, GenerateParams{}, "EdDSA", ForSignature},
+		{"OKP (X25519)", jwa.OKP, GenerateParams{Curve: jwa.X25519}, "ECDH-ES", ForEncryption},
+		{"oct", jwa.OctetSeq, GenerateParams{}, "HS256", ForSignature},
+		{"oct (64 bytes)", jwa.OctetSeq, GenerateParams{Size: 64}, "HS512", ForSignature},
+		{"oct (A128KW)", jwa.OctetSeq, GenerateParams{Size: 16, Algorithm: "A128KW", Usage: ForEncryption}, "A128KW", ForEncryption},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			key, err := Generate(d.kty, d.params)
+			if !assert.NoError(t, err, "Generate should succeed") {
+				return
+			}
+
+			if !assert.Equal(t, d.kty, key.Kty(), "kty matches") ||
+				!assert.Equal(t, d.alg, key.Alg(), "alg matches") ||
+				!assert.Equal(t, string(d.use), key.Use(), "use matches") {
+				return
+			}
+
+			tp, err := key.Thumbprint(crypto.SHA256)
+			if !assert.NoError(t, err, "Thumbprint should succeed") {
+				return
+			}
+			kid, err := buffer.Buffer(tp).Base64Encode()
+			if !assert.NoError(t, err, "Base64Encode should succeed") {
+				return
+			}
+			if !assert.Equal(t, string(kid), key.Kid(), "kid is the thumbprint") {
+				return
+			}
+
+			if _, err := key.Materialize(); !assert.NoError(t, err, "Materialize should succeed") {
+				return
+			}
+
+			// The JSON representation can be parsed back
+			buf, err := json.Marshal(key)
+			if !assert.NoError(t, err, "Marshal should succeed") {
+				return
+			}
+			set, err := Parse(buf)
+			if !assert.NoError(t, err, "Parse should succeed") {
+				return
+			}
+			if !assert.Equal(t, key, set.Keys[0], "keys match") {
+				return
+			}
+
+			var pubkey Key
+			switch k := key.(type) {
+			case *RsaPrivateKey:
+				pubkey = k.Public()
+			case *EcdsaPrivateKey:
+				pubkey = k.Public()
+			case *OKPPrivateKey:
+				pubkey = k.Public()
+			default:
+				return
+			}
+
+			if !assert.Equal(t, key.Kid(), pubkey.Kid(), "kid matches") ||
+				!assert.Equal(t, key.Alg(), pubkey.Alg(), "alg matches") ||
+				!assert.Equal(t, key.Use(), pubkey.Use(), "use matches") {
+				return
+			}
+			pubtp, err := pubkey.Thumbprint(crypto.SHA256)
+			if !assert.NoError(t, err, "Thumbprint should succeed") {
+				return
+			}
+			if !assert.Equal(t, tp, pubtp, "thumbprint matches") {
+				return
+			}
+			if _, err := pubkey.Materialize(); !assert.NoError(t, err, "Materialize should succeed") {
+				return
+			}
+		})
+	}
+}
+
+func TestGenerate_Errors(t *testing.T) {
+	if _, err := Generate(jwa.RSA, GenerateParams{Size: 1024}); !assert.Error(t, err, "RSA keys must be at least 2048 bits") {
+		return
+	}
+	if _, err := Generate(jwa.EC, GenerateParams{Curve: jwa.X25519}); !assert.Equal(t, ErrUnsupportedCurve, err, "X25519 is not an EC curve") {
+		return
+	}
+	if _, err := Generate(jwa.OKP, GenerateParams{Curve: jwa.P256}); !assert.Equal(t, ErrUnsupportedCurve, err, "P-256 is not an OKP curve") {
+		return
+	}
+	if _, err := Generate(jwa.KeyType("foo"), GenerateParams{}); !assert.Equal(t, ErrUnsupportedKty, err, "unknown key type") {
+		return
+	}
+}
+
+func TestGenerate_KeyID(t *testing.T) {
+	key, err := Generate(jwa.OctetSeq, GenerateParams{KeyID: "mykey"})
+	if !assert.NoError(t, err, "Generate should succeed") {
+		return
+	}
+	if !assert.Equal(t, "mykey", key.Kid(), "kid is used as is") {
+		return
+	}
+}
@@ -14,6 +14,8 @@ func (h *EssentialHeader) Get(key string) (interface{}, error) {
 		return h.Algorithm, nil
 	case "kid":
 		return h.KeyID, nil
+	case "key_ops":
+		return h.KeyOps, nil
 	case "kty":
 		return h.KeyType, nil
 	case "use":
@@ -51,6 +53,19 @@ func (h *EssentialHeader) Set(key string, value interface{}) error {
 		}
 		h.KeyID = v
 		return nil
+	case "key_ops":
+		switch v := value.(type) {
+		case []KeyOperation:
+			h.KeyOps = v
+		case []string:
+			h.KeyOps = make([]KeyOperation, len(v))
+			for i, x := range v {
+				h.KeyOps[i] = KeyOperation(x)
+			}
+		default:
+			return ErrInvalidHeaderValue
+		}
+		return nil
 	case "kty":
 		switch value.(type) {
 		case jwa.KeyType:
@@ -107,3 +122,23 @@ func (h *EssentialHeader) Set(key string, value interface{}) error {
 		return ErrInvalidHeaderName
 	}
 }
+
+// copy creates a deep copy of the header
+func (h *EssentialHeader) copy() *EssentialHeader {
+	if h == nil {
+		return &EssentialHeader{}
+	}
+
+	c := *h
+	if h.KeyOps != nil {
+		c.KeyOps = append([]KeyOperation(nil), h.KeyOps...)
+	}
+	if h.X509CertChain != nil {
+		c.X509CertChain = append([]string(nil), h.X509CertChain...)
+	}
+	if h.X509Url != nil {
+		u := *h.X509Url
+		c.X509Url = &u
+	}
+	return &c
+}
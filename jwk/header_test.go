@@ -111,3 +111,36 @@ func TestHeader_X5u(t *testing.T) {
 		}
 	}
 }
+
+func TestHeader_KeyOps(t *testing.T) {
+	h := &EssentialHeader{}
+	expected := []KeyOperation{KeyOpWrapKey, KeyOpUnwrapKey}
+
+	for _, value := range []interface{}{expected, []string{"wrapKey", "unwrapKey"}} {
+		if !assert.NoError(t, h.Set("key_ops", value), "Set for key_ops should succeed") {
+			return
+		}
+
+		got, err := h.Get("key_ops")
+		if !assert.NoError(t, err, "Get for key_ops should succeed") {
+			return
+		}
+
+		if !assert.Equal(t, expected, got, "values match") {
+			return
+		}
+	}
+
+	set, err := ParseString(`{"kty":"oct","key_ops":["wrapKey","unwrapKey"],"k":"GawgguFyGrWKav7AX4VKUg"}`)
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	got, err := set.Keys[0].Get("key_ops")
+	if !assert.NoError(t, err, "Get for key_ops should succeed") {
+		return
+	}
+	if !assert.Equal(t, expected, got, "key_ops is parsed") {
+		return
+	}
+}
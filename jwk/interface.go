@@ -1,6 +1,7 @@
 package jwk
 
 import (
+	"crypto"
 	"errors"
 	"net/url"
 
@@ -20,6 +21,7 @@ var (
 	ErrInvalidHeaderValue = errors.New("invalid value for header key")
 	ErrUnsupportedKty     = errors.New("unsupported kty")
 	ErrUnsupportedCurve   = errors.New("unsupported curve")
+	ErrNoPublicKey        = errors.New("key does not have a public key")
 )
 
 type KeyOperation string
@@ -60,8 +62,15 @@ type Key interface {
 	// Materialize creates the corresponding key. For example,
 	// RSA types would create *rsa.PublicKey or *rsa.PrivateKey,
 	// EC types would create *ecdsa.PublicKey or *ecdsa.PrivateKey,
+	// OKP types would create ed25519.PublicKey or ed25519.PrivateKey
+	// (or x25519.PublicKey or x25519.PrivateKey for X25519 keys),
 	// and OctetSeq types create a []byte key.
 	Materialize() (interface{}, error)
+
+	// Thumbprint computes the JWK thumbprint of the key using `hash`,
+	// as described in RFC 7638. Private keys have the same thumbprint
+	// as their public counterparts
+	Thumbprint(crypto.Hash) ([]byte, error)
 }
 
 // EssentialHeader defines the common data that any Key may
@@ -115,6 +124,21 @@ type EcdsaPrivateKey struct {
 	D buffer.Buffer `json:"d"`
 }
 
+// OKPPublicKey is a type of JWK representing the public part of an
+// octet key pair, such as Ed25519 and X25519 keys (RFC 8037)
+type OKPPublicKey struct {
+	*EssentialHeader
+	Curve jwa.EllipticCurveAlgorithm `json:"crv"`
+	X     buffer.Buffer              `json:"x"`
+}
+
+// OKPPrivateKey is a type of JWK representing an octet key pair,
+// such as Ed25519 and X25519 keys (RFC 8037)
+type OKPPrivateKey struct {
+	*OKPPublicKey
+	D buffer.Buffer `json:"d"`
+}
+
 type EcdhesPublicKey struct {
 	KeyEncryption     jwa.KeyEncryptionAlgorithm     `json:"alg"`
 	ContentEncryption jwa.ContentEncryptionAlgorithm `json:"enc"`
@@ -1,4 +1,11 @@
 // Package jwk implements JWK as described in https://tools.ietf.org/html/rfc7517
+//
+// The private key types (*RsaPrivateKey, *EcdsaPrivateKey and
+// *OKPPrivateKey) have two similarly named methods: Public returns the
+// public key as a JWK (e.g. *RsaPublicKey), while PublicKey, which is
+// promoted from the embedded public key type, returns the Go public key
+// (e.g. *rsa.PublicKey). PublicKeyOf is the generic version of Public,
+// which works with any Key.
 package jwk
 
 import (
@@ -78,6 +85,43 @@ func ParseString(s string) (*Set, error) {
 	return Parse([]byte(s))
 }
 
+// PublicKeyOf returns the public counterpart of `key` as a new JWK. The
+// header parameters (e.g. "kid", "alg" and "use") are preserved, but
+// none of the private parameters ("d", "p", "q", "dp", "dq" and "qi")
+// are. Public keys are returned as a copy. Symmetric keys do not have a
+// public counterpart, and ErrNoPublicKey is returned for them
+func PublicKeyOf(key Key) (Key, error) {
+	switch k := key.(type) {
+	case *RsaPrivateKey:
+		if k.RsaPublicKey == nil {
+			return nil, errors.New("missing public key")
+		}
+		return k.Public(), nil
+	case *RsaPublicKey:
+		return k.copy(), nil
+	case *EcdsaPrivateKey:
+		if k.EcdsaPublicKey == nil {
+			return nil, errors.New("missing public key")
+		}
+		return k.Public(), nil
+	case *EcdsaPublicKey:
+		return k.copy(), nil
+	case *OKPPrivateKey:
+		if k.OKPPublicKey == nil {
+			return nil, errors.New("missing public key")
+		}
+		return k.Public(), nil
+	case *OKPPublicKey:
+		return k.copy(), nil
+	case SymmetricKey, *SymmetricKey:
+		return nil, ErrNoPublicKey
+	default:
+		// We don't know what an unknown key type might contain, so
+		// refuse it rather than risk leaking private parameters
+		return nil, ErrUnsupportedKty
+	}
+}
+
 func constructKey(m map[string]interface{}) (Key, error) {
 	kty, ok := m["kty"].(string)
 	if !ok {
@@ -97,6 +141,11 @@ func constructKey(m map[string]interface{}) (Key, error) {
 		return constructEcdsaPublicKey(m)
 	case jwa.OctetSeq:
 		return constructSymmetricKey(m)
+	case jwa.OKP:
+		if _, ok := m["d"]; ok {
+			return constructOKPPrivateKey(m)
+		}
+		return constructOKPPublicKey(m)
 	default:
 		return nil, ErrUnsupportedKty
 	}
@@ -117,11 +166,20 @@ func constructEssentialHeader(m map[string]interface{}) (*EssentialHeader, error
 	e.KeyUsage, _ = r.GetString("use")
 
 	// https://tools.ietf.org/html/rfc7517#section-4.3
-	if v, err := r.GetStringSlice("key_ops"); err != nil {
-		if len(v) > 0 {
-			e.KeyOps = make([]KeyOperation, len(v))
-			for i, x := range v {
-				e.KeyOps[i] = KeyOperation(x)
+	if v, ok := m["key_ops"]; ok {
+		delete(m, "key_ops")
+		ops, ok := v.([]interface{})
+		if !ok {
+			return nil, errors.New("invalid 'key_ops'")
+		}
+		if len(ops) > 0 {
+			e.KeyOps = make([]KeyOperation, len(ops))
+			for i, x := range ops {
+				op, ok := x.(string)
+				if !ok {
+					return nil, errors.New("invalid 'key_ops'")
+				}
+				e.KeyOps[i] = KeyOperation(op)
 			}
 		}
 	}
@@ -225,6 +283,63 @@ func constructEcdsaPrivateKey(m map[string]interface{}) (*EcdsaPrivateKey, error
 	}, nil
 }
 
+func constructOKPPublicKey(m map[string]interface{}) (*OKPPublicKey, error) {
+	e, err := constructEssentialHeader(m)
+	if err != nil {
+		return nil, err
+	}
+	r := emap.Hmap(m)
+
+	crvstr, err := r.GetString("crv")
+	if err != nil {
+		return nil, err
+	}
+	crv := jwa.EllipticCurveAlgorithm(crvstr)
+
+	switch crv {
+	case jwa.Ed25519, jwa.Ed448, jwa.X25519, jwa.X448:
+	default:
+		return nil, ErrUnsupportedCurve
+	}
+
+	x, err := r.GetBuffer("x")
+	if err != nil {
+		return nil, err
+	}
+
+	if x.Len() != crv.Size() {
+		return nil, errors.New("size of x does not match crv size")
+	}
+
+	return &OKPPublicKey{
+		EssentialHeader: e,
+		Curve:           crv,
+		X:               x,
+	}, nil
+}
+
+func constructOKPPrivateKey(m map[string]interface{}) (*OKPPrivateKey, error) {
+	pubkey, err := constructOKPPublicKey(m)
+	if err != nil {
+		return nil, err
+	}
+
+	r := emap.Hmap(m)
+	d, err := r.GetBuffer("d")
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Len() != pubkey.Curve.Size() {
+		return nil, errors.New("size of d does not match crv size")
+	}
+
+	return &OKPPrivateKey{
+		OKPPublicKey: pubkey,
+		D:            d,
+	}, nil
+}
+
 func constructRsaPublicKey(m map[string]interface{}) (*RsaPublicKey, error) {
 	e, err := constructEssentialHeader(m)
 	if err != nil {
@@ -190,4 +190,72 @@ func TestAppendix_A3(t *testing.T) {
 			return
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestSet_Public(t *testing.T) {
+	ks := &Set{}
+	for _, kty := range []jwa.KeyType{jwa.RSA, jwa.EC, jwa.OKP, jwa.OctetSeq} {
+		key, err := Generate(kty, GenerateParams{})
+		if !assert.NoError(t, err, "Generate should succeed") {
+			return
+		}
+		ks.Keys = append(ks.Keys, key)
+	}
+	// Keys that are already public are kept as is
+	pubkey, err := PublicKeyOf(ks.Keys[0])
+	if !assert.NoError(t, err, "PublicKeyOf should succeed") {
+		return
+	}
+	pubkey.Set("kid", "already-public")
+	ks.Keys = append(ks.Keys, pubkey)
+
+	public, err := ks.Public()
+	if !assert.NoError(t, err, "Public should succeed") {
+		return
+	}
+	if !assert.Len(t, public.Keys, 4, "symmetric key is left out") {
+		return
+	}
+
+	expected := append(append([]Key{}, ks.Keys[:3]...), ks.Keys[4])
+	for i, key := range public.Keys {
+		if !assert.Equal(t, expected[i].Kid(), key.Kid(), "kid is preserved") ||
+			!assert.Equal(t, expected[i].Alg(), key.Alg(), "alg is preserved") ||
+			!assert.Equal(t, expected[i].Use(), key.Use(), "use is preserved") {
+			return
+		}
+	}
+
+	buf, err := json.Marshal(public)
+	if !assert.NoError(t, err, "Marshal should succeed") {
+		return
+	}
+
+	var raw struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if !assert.NoError(t, json.Unmarshal(buf, &raw), "Unmarshal should succeed") {
+		return
+	}
+	for _, m := range raw.Keys {
+		for _, name := range []string{"d", "p", "q", "dp", "dq", "qi", "k"} {
+			if !assert.NotContains(t, m, name, "'%s' must not be published", name) {
+				return
+			}
+		}
+	}
+
+	// The original set is left alone
+	if _, ok := ks.Keys[0].(*RsaPrivateKey); !assert.True(t, ok, "original key is still private") {
+		return
+	}
+	public.Keys[0].Set("kid", "modified")
+	if !assert.NotEqual(t, "modified", ks.Keys[0].Kid(), "headers are copied") {
+		return
+	}
+
+	// Symmetric keys have no public counterpart
+	if _, err := PublicKeyOf(ks.Keys[3]); !assert.Equal(t, ErrNoPublicKey, err, "PublicKeyOf should fail for symmetric keys") {
+		return
+	}
+}
@@ -0,0 +1,155 @@
+package jwk
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+
+	"github.com/lestrrat/go-jwx/buffer"
+	"github.com/lestrrat/go-jwx/jwa"
+	"github.com/lestrrat/go-jwx/x25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+// NewOKPPublicKey creates a new JWK from the given public key.
+// Currently ed25519.PublicKey and x25519.PublicKey are supported
+func NewOKPPublicKey(key interface{}) (*OKPPublicKey, error) {
+	switch v := key.(type) {
+	case x25519.PublicKey:
+		if len(v) != x25519.PublicKeySize {
+			return nil, errors.New("invalid x25519 public key size")
+		}
+		return &OKPPublicKey{
+			EssentialHeader: &EssentialHeader{KeyType: jwa.OKP},
+			Curve:           jwa.X25519,
+			X:               buffer.Buffer(append([]byte(nil), v...)),
+		}, nil
+	case ed25519.PublicKey:
+		if len(v) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 public key size")
+		}
+		return &OKPPublicKey{
+			EssentialHeader: &EssentialHeader{KeyType: jwa.OKP},
+			Curve:           jwa.Ed25519,
+			X:               buffer.Buffer(append([]byte(nil), v...)),
+		}, nil
+	default:
+		return nil, errors.New("unsupported key type for OKP public key")
+	}
+}
+
+// NewOKPPrivateKey creates a new JWK from the given private key.
+// Currently ed25519.PrivateKey and x25519.PrivateKey are supported
+func NewOKPPrivateKey(key interface{}) (*OKPPrivateKey, error) {
+	switch v := key.(type) {
+	case x25519.PrivateKey:
+		pub, err := v.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		pubkey, err := NewOKPPublicKey(pub)
+		if err != nil {
+			return nil, err
+		}
+		return &OKPPrivateKey{
+			OKPPublicKey: pubkey,
+			D:            buffer.Buffer(append([]byte(nil), v...)),
+		}, nil
+	case ed25519.PrivateKey:
+		if len(v) != ed25519.PrivateKeySize {
+			return nil, errors.New("invalid ed25519 private key size")
+		}
+		pubkey, err := NewOKPPublicKey(v.Public())
+		if err != nil {
+			return nil, err
+		}
+		return &OKPPrivateKey{
+			OKPPublicKey: pubkey,
+			D:            buffer.Buffer(append([]byte(nil), v.Seed()...)),
+		}, nil
+	default:
+		return nil, errors.New("unsupported key type for OKP private key")
+	}
+}
+
+// Materialize creates the public key described by this JWK.
+// For Ed25519 keys, an ed25519.PublicKey is returned, and for
+// X25519 keys, an x25519.PublicKey is returned
+func (k *OKPPublicKey) Materialize() (interface{}, error) {
+	switch k.Curve {
+	case jwa.X25519:
+		if k.X.Len() != x25519.PublicKeySize {
+			return nil, errors.New("invalid size for parameter 'x'")
+		}
+		return x25519.PublicKey(append([]byte(nil), k.X.Bytes()...)), nil
+	case jwa.Ed25519:
+		if k.X.Len() != ed25519.PublicKeySize {
+			return nil, errors.New("invalid size for parameter 'x'")
+		}
+		return ed25519.PublicKey(append([]byte(nil), k.X.Bytes()...)), nil
+	default:
+		return nil, ErrUnsupportedCurve
+	}
+}
+
+// Public returns the public part of the key as a JWK, with the same
+// header parameters
+func (k *OKPPrivateKey) Public() *OKPPublicKey {
+	return k.OKPPublicKey.copy()
+}
+
+func (k *OKPPublicKey) copy() *OKPPublicKey {
+	return &OKPPublicKey{
+		EssentialHeader: k.EssentialHeader.copy(),
+		Curve:           k.Curve,
+		X:               buffer.Buffer(append([]byte(nil), k.X.Bytes()...)),
+	}
+}
+
+// Materialize creates the private key described by this JWK.
+// For Ed25519 keys, an ed25519.PrivateKey is returned, and for
+// X25519 keys, an x25519.PrivateKey is returned
+func (k *OKPPrivateKey) Materialize() (interface{}, error) {
+	switch k.Curve {
+	case jwa.X25519:
+		if k.D.Len() != x25519.PrivateKeySize {
+			return nil, errors.New("invalid size for parameter 'd'")
+		}
+		privkey := x25519.PrivateKey(append([]byte(nil), k.D.Bytes()...))
+		pubkey, err := privkey.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(pubkey, k.X.Bytes()) {
+			return nil, errors.New("parameter 'x' does not match the private key")
+		}
+		return privkey, nil
+	case jwa.Ed25519:
+		if k.D.Len() != ed25519.SeedSize {
+			return nil, errors.New("invalid size for parameter 'd'")
+		}
+		privkey := ed25519.NewKeyFromSeed(k.D.Bytes())
+		if !bytes.Equal(privkey.Public().(ed25519.PublicKey), k.X.Bytes()) {
+			return nil, errors.New("parameter 'x' does not match the private key")
+		}
+		return privkey, nil
+	default:
+		return nil, ErrUnsupportedCurve
+	}
+}
+
+// Thumbprint computes the JWK thumbprint of the key using `hash`. The
+// required members for OKP keys are "crv", "kty" and "x" (RFC 8037
+// Section 2)
+func (k *OKPPublicKey) Thumbprint(hash crypto.Hash) ([]byte, error) {
+	x, err := k.X.Base64Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return thumbprint(hash, map[string]string{
+		"crv": k.Curve.String(),
+		"kty": string(jwa.OKP),
+		"x":   string(x),
+	})
+}
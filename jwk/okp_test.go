@@ -0,0 +1,92 @@
+package jwk
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/lestrrat/go-jwx/jwa"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+// https://tools.ietf.org/html/rfc8037#appendix-A.1
+const rfc8037PrivateKey = `{"kty":"OKP","crv":"Ed25519","d":"nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`
+
+func TestParse_OKPPrivateKey(t *testing.T) {
+	set, err := ParseString(rfc8037PrivateKey)
+	if !assert.NoError(t, err, "Parsing OKP private key is successful") {
+		return
+	}
+
+	jwkkey, ok := set.Keys[0].(*OKPPrivateKey)
+	if !assert.True(t, ok, "set.Keys[0] should be a OKPPrivateKey") {
+		return
+	}
+	if !assert.Equal(t, jwa.OKP, jwkkey.Kty(), "kty matches") {
+		return
+	}
+
+	rawkey, err := jwkkey.Materialize()
+	if !assert.NoError(t, err, "Materialize should succeed") {
+		return
+	}
+
+	privkey, ok := rawkey.(ed25519.PrivateKey)
+	if !assert.True(t, ok, "Materialize returns ed25519.PrivateKey") {
+		return
+	}
+
+	rawkey, err = jwkkey.OKPPublicKey.Materialize()
+	if !assert.NoError(t, err, "Materialize should succeed") {
+		return
+	}
+
+	pubkey, ok := rawkey.(ed25519.PublicKey)
+	if !assert.True(t, ok, "Materialize returns ed25519.PublicKey") {
+		return
+	}
+	if !assert.Equal(t, privkey.Public(), pubkey, "public keys match") {
+		return
+	}
+
+	jwkkey2, err := NewOKPPrivateKey(privkey)
+	if !assert.NoError(t, err, "NewOKPPrivateKey should succeed") {
+		return
+	}
+
+	buf, err := json.Marshal(jwkkey2)
+	if !assert.NoError(t, err, "Marshal should succeed") {
+		return
+	}
+
+	if !assert.JSONEq(t, rfc8037PrivateKey, string(buf), "JWK roundtrips") {
+		return
+	}
+}
+
+func TestParse_OKPPublicKey(t *testing.T) {
+	set, err := ParseString(`{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`)
+	if !assert.NoError(t, err, "Parsing OKP public key is successful") {
+		return
+	}
+
+	if _, ok := set.Keys[0].(*OKPPublicKey); !assert.True(t, ok, "set.Keys[0] should be a OKPPublicKey") {
+		return
+	}
+
+	// Ed448 keys can be parsed, but not materialized
+	set, err = ParseString(`{"kty":"OKP","crv":"Ed448","x":"X9dEm1m0Yf0s54fsYWrUah2hNCSFpw4fig6nXYDpZ3jt8SR2m0bHBhvWeD3x5Q9s0foavq_oJWGA"}`)
+	if !assert.NoError(t, err, "Parsing Ed448 public key is successful") {
+		return
+	}
+	if _, err := set.Keys[0].Materialize(); !assert.Equal(t, ErrUnsupportedCurve, err, "Materialize Ed448 key should fail") {
+		return
+	}
+
+	if _, err := ParseString(`{"kty":"OKP","crv":"Ed25519","x":"AAAA"}`); !assert.Error(t, err, "Parsing key with wrong size should fail") {
+		return
+	}
+	if _, err := ParseString(`{"kty":"OKP","crv":"P-256","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`); !assert.Error(t, err, "Parsing key with wrong curve should fail") {
+		return
+	}
+}
@@ -1,11 +1,13 @@
 package jwk
 
 import (
+	"crypto"
 	"crypto/rsa"
 	"errors"
 	"math/big"
 
 	"github.com/lestrrat/go-jwx/buffer"
+	"github.com/lestrrat/go-jwx/jwa"
 )
 
 func NewRsaPublicKey(pk *rsa.PublicKey) (*RsaPublicKey, error) {
@@ -56,6 +58,47 @@ func (k *RsaPublicKey) PublicKey() (*rsa.PublicKey, error) {
 	}, nil
 }
 
+// Thumbprint computes the JWK thumbprint of the key using `hash`. The
+// required members for RSA keys are "e", "kty" and "n"
+func (k *RsaPublicKey) Thumbprint(hash crypto.Hash) ([]byte, error) {
+	if k.N.Len() == 0 {
+		return nil, errors.New("missing parameter 'N'")
+	}
+	if k.E.Len() == 0 {
+		return nil, errors.New("missing parameter 'E'")
+	}
+
+	e, err := k.E.Base64Encode()
+	if err != nil {
+		return nil, err
+	}
+	n, err := k.N.Base64Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return thumbprint(hash, map[string]string{
+		"e":   string(e),
+		"kty": string(jwa.RSA),
+		"n":   string(n),
+	})
+}
+
+// Public returns the public part of the key as a JWK, with the same
+// header parameters. Note that PublicKey (which is promoted from
+// RsaPublicKey) returns a *rsa.PublicKey instead
+func (k *RsaPrivateKey) Public() *RsaPublicKey {
+	return k.RsaPublicKey.copy()
+}
+
+func (k *RsaPublicKey) copy() *RsaPublicKey {
+	return &RsaPublicKey{
+		EssentialHeader: k.EssentialHeader.copy(),
+		E:               buffer.Buffer(append([]byte(nil), k.E.Bytes()...)),
+		N:               buffer.Buffer(append([]byte(nil), k.N.Bytes()...)),
+	}
+}
+
 func (k *RsaPrivateKey) Materialize() (interface{}, error) {
 	return k.PrivateKey()
 }
@@ -1,6 +1,9 @@
 package jwk
 
-import "errors"
+import (
+	"bytes"
+	"errors"
+)
 
 // LookupKeyID looks for keys matching the given key id. Note that the
 // Set *may* contain multiple keys with the same key id
@@ -14,6 +17,45 @@ func (s Set) LookupKeyID(kid string) []Key {
 	return keys
 }
 
+// LookupThumbprintURI looks for keys whose JWK thumbprint matches the
+// given thumbprint URI. Nothing is returned if the URI is invalid
+func (s Set) LookupThumbprintURI(uri string) []Key {
+	hash, expected, err := ParseThumbprintURI(uri)
+	if err != nil {
+		return nil
+	}
+
+	var keys []Key
+	for _, key := range s.Keys {
+		tp, err := key.Thumbprint(hash)
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(tp, expected) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Public returns a new Set that contains the public counterparts of
+// the keys in the Set (see PublicKeyOf), e.g. to be published as a JWKS.
+// Symmetric keys are left out, as they can not be made public
+func (s Set) Public() (*Set, error) {
+	ps := &Set{Keys: []Key{}}
+	for _, key := range s.Keys {
+		pubkey, err := PublicKeyOf(key)
+		if err != nil {
+			if err == ErrNoPublicKey {
+				continue
+			}
+			return nil, err
+		}
+		ps.Keys = append(ps.Keys, pubkey)
+	}
+	return ps, nil
+}
+
 func constructSet(m map[string]interface{}) (*Set, error) {
 	raw, ok := m["keys"]
 	if !ok {
@@ -1,5 +1,11 @@
 package jwk
 
+import (
+	"crypto"
+
+	"github.com/lestrrat/go-jwx/jwa"
+)
+
 func (s SymmetricKey) Materialize() (interface{}, error) {
 	return s.Octets(), nil
 }
@@ -7,3 +13,17 @@ func (s SymmetricKey) Materialize() (interface{}, error) {
 func (s SymmetricKey) Octets() []byte {
 	return s.Key
 }
+
+// Thumbprint computes the JWK thumbprint of the key using `hash`. The
+// required members for symmetric keys are "k" and "kty"
+func (s SymmetricKey) Thumbprint(hash crypto.Hash) ([]byte, error) {
+	k, err := s.Key.Base64Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return thumbprint(hash, map[string]string{
+		"k":   string(k),
+		"kty": string(jwa.OctetSeq),
+	})
+}
@@ -0,0 +1,119 @@
+package jwk
+
+import (
+	"crypto"
+	_ "crypto/sha256" // AssignKeyID uses crypto.SHA256
+	_ "crypto/sha512" // for thumbprint URIs using sha-384 and sha-512
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/lestrrat/go-jwx/buffer"
+)
+
+// ThumbprintURIPrefix is the prefix of JWK thumbprint URIs (RFC 9278)
+const ThumbprintURIPrefix = "urn:ietf:params:oauth:jwk-thumbprint:"
+
+// thumbprintHashNames maps the hash functions to their names in the
+// IANA "Named Information Hash Algorithm" registry, which are used in
+// JWK thumbprint URIs
+var thumbprintHashNames = map[crypto.Hash]string{
+	crypto.SHA256: "sha-256",
+	crypto.SHA384: "sha-384",
+	crypto.SHA512: "sha-512",
+}
+
+// thumbprint hashes the JSON representation of the required members of
+// a key. encoding/json sorts the keys of a map, and does not add any
+// whitespace, which is exactly what RFC 7638 Section 3.2 requires
+func thumbprint(hash crypto.Hash, members map[string]string) ([]byte, error) {
+	if !hash.Available() {
+		return nil, errors.New("hash function is not available")
+	}
+
+	buf, err := json.Marshal(members)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write(buf)
+	return h.Sum(nil), nil
+}
+
+// AssignKeyID sets the "kid" of `key` to the base64url encoded SHA-256
+// JWK thumbprint of the key, unless it already has a "kid". As the
+// thumbprint only depends on the key material, the same key is always
+// assigned the same "kid"
+func AssignKeyID(key Key) error {
+	if key.Kid() != "" {
+		return nil
+	}
+
+	tp, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return err
+	}
+
+	kid, err := buffer.Buffer(tp).Base64Encode()
+	if err != nil {
+		return err
+	}
+	return key.Set("kid", string(kid))
+}
+
+// ThumbprintURI returns the JWK thumbprint URI of `key` as described
+// in RFC 9278, e.g. "urn:ietf:params:oauth:jwk-thumbprint:sha-256:...".
+// `hash` must be one of crypto.SHA256, crypto.SHA384 or crypto.SHA512
+func ThumbprintURI(key Key, hash crypto.Hash) (string, error) {
+	name, ok := thumbprintHashNames[hash]
+	if !ok {
+		return "", errors.New("unsupported hash function for thumbprint URI")
+	}
+
+	tp, err := key.Thumbprint(hash)
+	if err != nil {
+		return "", err
+	}
+
+	encoded, err := buffer.Buffer(tp).Base64Encode()
+	if err != nil {
+		return "", err
+	}
+	return ThumbprintURIPrefix + name + ":" + string(encoded), nil
+}
+
+// ParseThumbprintURI parses a JWK thumbprint URI, and returns the hash
+// function and the thumbprint
+func ParseThumbprintURI(uri string) (crypto.Hash, []byte, error) {
+	if !strings.HasPrefix(uri, ThumbprintURIPrefix) {
+		return 0, nil, errors.New("invalid thumbprint URI: missing prefix")
+	}
+
+	i := strings.IndexByte(uri[len(ThumbprintURIPrefix):], ':')
+	if i < 0 {
+		return 0, nil, errors.New("invalid thumbprint URI: missing hash function")
+	}
+	name := uri[len(ThumbprintURIPrefix) : len(ThumbprintURIPrefix)+i]
+	value := uri[len(ThumbprintURIPrefix)+i+1:]
+
+	var hash crypto.Hash
+	for h, n := range thumbprintHashNames {
+		if n == name {
+			hash = h
+			break
+		}
+	}
+	if hash == 0 {
+		return 0, nil, errors.New("invalid thumbprint URI: unsupported hash function '" + name + "'")
+	}
+
+	tp, err := buffer.FromBase64([]byte(value))
+	if err != nil {
+		return 0, nil, err
+	}
+	if tp.Len() != hash.Size() {
+		return 0, nil, errors.New("invalid thumbprint URI: invalid thumbprint size")
+	}
+	return hash, tp.Bytes(), nil
+}
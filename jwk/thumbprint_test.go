@@ -0,0 +1,193 @@
+package jwk
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/lestrrat/go-jwx/buffer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThumbprint(t *testing.T) {
+	data := []struct {
+		name     string
+		src      string
+		expected string
+	}{
+		{
+			// RFC 7638 Section 3.1
+			name:     "RSA",
+			src:      `{"kty":"RSA","n":"0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw","e":"AQAB","alg":"RS256","kid":"2011-04-29"}`,
+			expected: "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs",
+		},
+		{
+			name:     "EC",
+			src:      `{"kty":"EC","crv":"P-256","x":"MKBCTNIcKUSDii11ySs3526iDZ8AiTo7Tu6KPAqv7D4","y":"4Etl6SRW2YiLUrN5vfvVHuhp7x8PxltmWWlbbM4IFyM","use":"enc","kid":"1"}`,
+			expected: "cn-I_WNMClehiVp51i_0VpOENW1upEerA8sEam5hn-s",
+		},
+		{
+			name:     "oct",
+			src:      `{"kty":"oct","alg":"A128KW","k":"GawgguFyGrWKav7AX4VKUg"}`,
+			expected: "k1JnWRfC-5zzmL72vXIuBgTLfVROXBakS4OmGcrMCoc",
+		},
+		{
+			// RFC 8037 Appendix A.3
+			name:     "OKP",
+			src:      `{"kty":"OKP","crv":"Ed25519","d":"nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`,
+			expected: "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k",
+		},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			set, err := ParseString(d.src)
+			if !assert.NoError(t, err, "Parse should succeed") {
+				return
+			}
+
+			tp, err := set.Keys[0].Thumbprint(crypto.SHA256)
+			if !assert.NoError(t, err, "Thumbprint should succeed") {
+				return
+			}
+
+			encoded, err := buffer.Buffer(tp).Base64Encode()
+			if !assert.NoError(t, err, "Base64Encode should succeed") {
+				return
+			}
+
+			if !assert.Equal(t, d.expected, string(encoded), "thumbprint matches") {
+				return
+			}
+		})
+	}
+}
+
+func TestThumbprint_PrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "RSA key generated") {
+		return
+	}
+
+	privkey, err := NewRsaPrivateKey(key)
+	if !assert.NoError(t, err, "NewRsaPrivateKey should succeed") {
+		return
+	}
+	pubkey, err := NewRsaPublicKey(&key.PublicKey)
+	if !assert.NoError(t, err, "NewRsaPublicKey should succeed") {
+		return
+	}
+
+	for _, hash := range []crypto.Hash{crypto.SHA256, crypto.SHA512} {
+		tp1, err := privkey.Thumbprint(hash)
+		if !assert.NoError(t, err, "Thumbprint should succeed") {
+			return
+		}
+		tp2, err := pubkey.Thumbprint(hash)
+		if !assert.NoError(t, err, "Thumbprint should succeed") {
+			return
+		}
+		if !assert.Len(t, tp1, hash.Size(), "thumbprint size matches") {
+			return
+		}
+		if !assert.Equal(t, tp1, tp2, "private and public keys have the same thumbprint") {
+			return
+		}
+	}
+}
+
+func TestAssignKeyID(t *testing.T) {
+	set, err := ParseString(`{"kty":"oct","k":"GawgguFyGrWKav7AX4VKUg"}`)
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	key := set.Keys[0]
+
+	if !assert.NoError(t, AssignKeyID(key), "AssignKeyID should succeed") {
+		return
+	}
+	if !assert.Equal(t, "k1JnWRfC-5zzmL72vXIuBgTLfVROXBakS4OmGcrMCoc", key.Kid(), "kid is the thumbprint") {
+		return
+	}
+
+	// An existing kid is left alone
+	key.Set("kid", "mykey")
+	if !assert.NoError(t, AssignKeyID(key), "AssignKeyID should succeed") {
+		return
+	}
+	if !assert.Equal(t, "mykey", key.Kid(), "kid is left alone") {
+		return
+	}
+}
+
+func TestThumbprintURI(t *testing.T) {
+	// RFC 9278 Section 3
+	const uri = "urn:ietf:params:oauth:jwk-thumbprint:sha-256:NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"
+
+	set, err := ParseString(`{"keys":[
+		{"kty":"oct","k":"GawgguFyGrWKav7AX4VKUg"},
+		{"kty":"RSA","n":"0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw","e":"AQAB","alg":"RS256","kid":"2011-04-29"}
+	]}`)
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	s, err := ThumbprintURI(set.Keys[1], crypto.SHA256)
+	if !assert.NoError(t, err, "ThumbprintURI should succeed") {
+		return
+	}
+	if !assert.Equal(t, uri, s, "thumbprint URI matches") {
+		return
+	}
+
+	hash, tp, err := ParseThumbprintURI(uri)
+	if !assert.NoError(t, err, "ParseThumbprintURI should succeed") {
+		return
+	}
+	if !assert.Equal(t, crypto.SHA256, hash, "hash function matches") {
+		return
+	}
+	expected, err := set.Keys[1].Thumbprint(crypto.SHA256)
+	if !assert.NoError(t, err, "Thumbprint should succeed") {
+		return
+	}
+	if !assert.Equal(t, expected, tp, "thumbprint matches") {
+		return
+	}
+
+	keys := set.LookupThumbprintURI(uri)
+	if !assert.Len(t, keys, 1, "one key found") {
+		return
+	}
+	if !assert.Equal(t, "2011-04-29", keys[0].Kid(), "the RSA key is found") {
+		return
+	}
+
+	s, err = ThumbprintURI(set.Keys[0], crypto.SHA512)
+	if !assert.NoError(t, err, "ThumbprintURI should succeed") {
+		return
+	}
+	if !assert.Len(t, set.LookupThumbprintURI(s), 1, "one key found using sha-512") {
+		return
+	}
+
+	for _, invalid := range []string{
+		"",
+		"urn:ietf:params:oauth:jwk-thumbprint:NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs",
+		"urn:ietf:params:oauth:jwk-thumbprint:md5:NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs",
+		"urn:ietf:params:oauth:jwk-thumbprint:sha-512:NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs",
+		"urn:ietf:params:oauth:jwk-thumbprint:sha-256:!!!",
+	} {
+		if _, _, err := ParseThumbprintURI(invalid); !assert.Error(t, err, "ParseThumbprintURI should fail for '%s'", invalid) {
+			return
+		}
+		if !assert.Empty(t, set.LookupThumbprintURI(invalid), "no keys found for '%s'", invalid) {
+			return
+		}
+	}
+
+	if _, err := ThumbprintURI(set.Keys[0], crypto.SHA1); !assert.Error(t, err, "ThumbprintURI should fail with SHA-1") {
+		return
+	}
+}
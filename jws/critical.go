@@ -0,0 +1,81 @@
+package jws
+
+import (
+	"github.com/lestrrat/go-jwx/internal/critical"
+	"github.com/lestrrat/go-jwx/internal/debug"
+)
+
+// criticalHeaders holds the handlers for the extension header parameters
+// that may be listed in "crit". The header parameters defined in RFC 7515
+// must not appear in "crit"
+var criticalHeaders = critical.NewRegistry(
+	"alg",
+	"crit",
+	"cty",
+	"jku",
+	"jwk",
+	"kid",
+	"typ",
+	"x5c",
+	"x5t",
+	"x5t#S256",
+	"x5u",
+)
+
+func init() {
+	// RFC 7797 unencoded payload option
+	RegisterCriticalHeader("b64", func(v interface{}) error {
+		if _, ok := v.(bool); !ok {
+			return ErrInvalidHeaderValue
+		}
+		return nil
+	})
+}
+
+// RegisterCriticalHeader registers `h` as the handler for the extension
+// header parameter `name`. Messages that list `name` in their "crit"
+// header can only be verified if a handler has been registered for it,
+// and the handler accepts the value of the header parameter.
+// Header parameters defined in RFC 7515 can not be registered, and
+// attempting to do so panics.
+func RegisterCriticalHeader(name string, h CriticalHeaderHandler) {
+	criticalHeaders.Register(name, critical.Handler(h))
+}
+
+// UnregisterCriticalHeader removes the handler for `name`
+func UnregisterCriticalHeader(name string) {
+	criticalHeaders.Unregister(name)
+}
+
+func isCritical(h *Header, name string) bool {
+	for _, v := range h.Critical {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCritical processes the "crit" header as described in RFC 7515
+// Section 4.1.11. "crit" may only appear in the protected header, it
+// may not be empty nor contain header parameters defined in RFC 7515,
+// and each of the listed header parameters must be present in the
+// protected header and understood (i.e. have a registered handler)
+func checkCritical(protected *Header, unprotected *Header) error {
+	if unprotected != nil && unprotected.EssentialHeader != nil && unprotected.Critical != nil {
+		debug.Printf("'crit' found in unprotected header")
+		return ErrInvalidCriticalHeader
+	}
+
+	if protected == nil || protected.EssentialHeader == nil {
+		return nil
+	}
+
+	// RFC 7797 Section 6: "b64" must always be understood
+	if _, ok := protected.PrivateParams["b64"]; ok && !isCritical(protected, "b64") {
+		debug.Printf("'b64' is used but not listed in 'crit'")
+		return ErrInvalidCriticalHeader
+	}
+
+	return criticalHeaders.Check(protected.Critical, protected.PrivateParams)
+}
@@ -9,18 +9,25 @@ import (
 	"net/url"
 
 	"github.com/lestrrat/go-jwx/buffer"
+	"github.com/lestrrat/go-jwx/internal/critical"
 	"github.com/lestrrat/go-jwx/jwa"
 	"github.com/lestrrat/go-jwx/jwk"
+	"golang.org/x/crypto/ed25519"
 )
 
 var (
+	ErrAlgorithmNotAllowed       = errors.New("algorithm is not allowed")
 	ErrInvalidCompactPartsCount  = errors.New("compact JWS format must have three parts")
+	ErrInvalidCriticalHeader     = critical.ErrInvalidCriticalHeader
 	ErrInvalidHeaderValue        = errors.New("invalid value for header key")
 	ErrInvalidEcdsaSignatureSize = errors.New("invalid signature size of ecdsa algorithm")
 	ErrInvalidSignature          = errors.New("invalid signature")
+	ErrInvalidUnencodedPayload   = errors.New("payload can not be represented unencoded")
+	ErrKeyAlgorithmMismatch      = errors.New("key cannot be used with the algorithm")
 	ErrMissingPrivateKey         = errors.New("missing private key")
 	ErrMissingPublicKey          = errors.New("missing public key")
 	ErrUnsupportedAlgorithm      = errors.New("unspported algorithm")
+	ErrUnsupportedCriticalHeader = critical.ErrUnsupportedCriticalHeader
 )
 
 type EssentialHeader struct {
@@ -68,11 +75,86 @@ type PayloadSigner interface {
 	SignatureAlgorithm() jwa.SignatureAlgorithm
 }
 
+// HashSigner is implemented by PayloadSigners that sign the digest of
+// the signing input. The signing input can then be written to the hash
+// incrementally, which is what SignStream does
+type HashSigner interface {
+	NewHash() (hash.Hash, error)
+	SignHash(hash.Hash) ([]byte, error)
+}
+
 // Verifier is used to verify the signature against the payload
 type Verifier interface {
 	Verify(*Message) error
 }
 
+// KeyProvider returns the candidate keys that may be used to verify
+// a signature, based on the headers associated with it. The keys may
+// be either raw keys (e.g. *rsa.PublicKey, []byte) or jwk.Key values.
+type KeyProvider interface {
+	KeysFor(MergedHeader) ([]interface{}, error)
+}
+
+// KeyProviderFunc is a function that implements KeyProvider
+type KeyProviderFunc func(MergedHeader) ([]interface{}, error)
+
+// CriticalHeaderHandler validates the value of an extension header
+// parameter that is listed in the "crit" header. It should return an
+// error if the value is not acceptable
+type CriticalHeaderHandler func(value interface{}) error
+
+// VerifyOption configures the policy used by Verify, VerifyWithJKU,
+// VerifyWithJWK and VerifyWithKeyProvider
+type VerifyOption func(*verifyOptions)
+
+type verifyOptions struct {
+	allowed   []jwa.SignatureAlgorithm
+	allowNone bool
+}
+
+// PayloadVerifier verifies that `signature` is a valid signature for
+// the signing input `payload`
+type PayloadVerifier interface {
+	PayloadVerify(payload []byte, signature []byte) error
+}
+
+// HashVerifier is implemented by PayloadVerifiers that verify the
+// digest of the signing input. The signing input can then be written
+// to the hash incrementally, which is what VerifyStream does
+type HashVerifier interface {
+	NewHash() (hash.Hash, error)
+	VerifyHash(h hash.Hash, signature []byte) error
+}
+
+// SignerFactory creates a PayloadSigner for the given algorithm, using
+// `key` to sign. It should return an error if `key` is not of the type
+// that the algorithm requires
+type SignerFactory func(alg jwa.SignatureAlgorithm, key interface{}) (PayloadSigner, error)
+
+// VerifierFactory creates a PayloadVerifier for the given algorithm,
+// using `key` to verify. It should return an error if `key` is not of
+// the type that the algorithm requires
+type VerifierFactory func(alg jwa.SignatureAlgorithm, key interface{}) (PayloadVerifier, error)
+
+// PayloadSignFunc is a function that signs the signing input
+type PayloadSignFunc func([]byte) ([]byte, error)
+
+// GenericSign is a PayloadSigner that delegates the actual signature
+// generation to a PayloadSignFunc. It is meant to make it easy to
+// implement signers for algorithms registered via RegisterAlgorithm
+type GenericSign struct {
+	Public    *Header
+	Protected *Header
+	sign      PayloadSignFunc
+}
+
+// GenericVerify is a Verifier that uses a PayloadVerifier to verify
+// the signatures in a message
+type GenericVerify struct {
+	alg      jwa.SignatureAlgorithm
+	verifier PayloadVerifier
+}
+
 type RsaSign struct {
 	Public     *Header
 	Protected  *Header
@@ -85,6 +167,13 @@ type EcdsaSign struct {
 	PrivateKey *ecdsa.PrivateKey
 }
 
+// EdDSASign signs payloads using EdDSA. Only Ed25519 keys are supported
+type EdDSASign struct {
+	Public     *Header
+	Protected  *Header
+	PrivateKey ed25519.PrivateKey
+}
+
 type MergedHeader struct {
 	ProtectedHeader *EncodedHeader
 	PublicHeader    *Header
@@ -119,9 +208,17 @@ type Serializer interface {
 	Serialize(*Message) ([]byte, error)
 }
 
-type CompactSerialize struct{}
+// CompactSerialize serializes a message in compact serialization. If
+// Detached is true, the payload is omitted (RFC 7515 Appendix F)
+type CompactSerialize struct {
+	Detached bool
+}
+
+// JSONSerialize serializes a message in general JSON serialization. If
+// Detached is true, the payload is omitted (RFC 7515 Appendix F)
 type JSONSerialize struct {
-	Pretty bool
+	Pretty   bool
+	Detached bool
 }
 
 type RsaVerify struct {
@@ -135,3 +232,7 @@ type EcdsaVerify struct {
 	hash   crypto.Hash
 	pubkey *ecdsa.PublicKey
 }
+
+type EdDSAVerify struct {
+	pubkey ed25519.PublicKey
+}
@@ -11,18 +11,26 @@
 // contains whatever data you want to sign. `alg` is one of the
 // jwa.SignatureAlgorithm constants from package jwa. For RSA and
 // ECDSA family of algorithms, you will need to prepare a private key.
+// For EdDSA, you will need an ed25519.PrivateKey.
 // For HMAC family, you just need a []byte value. The `jws.Sign`
 // function will return the encoded JWS message on success.
 //
 // To verify, use `jws.Verify`. It will parse the `encodedjws` buffer
 // and verify the result using `algorithm` and `key`. Upon successful
 // verification, the original payload is returned, so you can work on it.
+//
+// All of the Verify* functions reject unsecured messages (alg = "none")
+// unless the `jws.WithAllowNone()` option is given, and the set of
+// acceptable algorithms can be narrowed down using
+// `jws.WithAllowedAlgorithms(...)`.
+//
+// Algorithms other than the ones defined in RFC 7518 (for example, ones
+// backed by an HSM) can be made available to all of the above, as well
+// as to MultiSign, by calling `jws.RegisterAlgorithm`.
 package jws
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -38,43 +46,32 @@ import (
 // generation process, you should manually create signers and tweak
 // the message.
 //
-//
+// `alg` may be any algorithm registered via RegisterAlgorithm. If given,
+// the first header in `hdrs` is merged into the public header, and the
+// second one into the protected header.
 func Sign(payload []byte, alg jwa.SignatureAlgorithm, key interface{}, hdrs ...*Header) ([]byte, error) {
-	var err error
-	var signer PayloadSigner
-	switch alg {
-	case jwa.RS256, jwa.RS384, jwa.RS512, jwa.PS256, jwa.PS384, jwa.PS512:
-		privkey, ok := key.(*rsa.PrivateKey)
-		if !ok {
-			return nil, errors.New("invalid private key: *rsa.PrivateKey required")
-		}
+	signer, err := newSignerWithHeaders(alg, key, hdrs)
+	if err != nil {
+		return nil, err
+	}
 
-		signer, err = NewRsaSign(alg, privkey)
-		if err != nil {
-			return nil, err
-		}
-	case jwa.HS256, jwa.HS384, jwa.HS512:
-		sharedkey, ok := key.([]byte)
-		if !ok {
-			return nil, errors.New("invalid private key: []byte required")
-		}
+	multisigner := NewMultiSign()
+	multisigner.AddSigner(signer)
+	msg, err := multisigner.Sign(payload)
+	if err != nil {
+		return nil, err
+	}
 
-		signer, err = NewHmacSign(alg, sharedkey)
-		if err != nil {
-			return nil, err
-		}
-	case jwa.ES256, jwa.ES384, jwa.ES512:
-		privkey, ok := key.(*ecdsa.PrivateKey)
-		if !ok {
-			return nil, errors.New("invalid private key: *ecdsa.PrivateKey required")
-		}
+	return CompactSerialize{}.Serialize(msg)
+}
 
-		signer, err = NewEcdsaSign(alg, privkey)
-		if err != nil {
-			return nil, err
-		}
-	default:
-		return nil, ErrUnsupportedAlgorithm
+// newSignerWithHeaders creates a PayloadSigner for `alg` and `key`. The
+// first header in `hdrs` is merged into the public header, and the second
+// one into the protected header
+func newSignerWithHeaders(alg jwa.SignatureAlgorithm, key interface{}, hdrs []*Header) (PayloadSigner, error) {
+	signer, err := NewPayloadSigner(alg, key)
+	if err != nil {
+		return nil, err
 	}
 
 	if len(hdrs) > 0 {
@@ -88,7 +85,7 @@ func Sign(payload []byte, alg jwa.SignatureAlgorithm, key interface{}, hdrs ...*
 	}
 
 	if len(hdrs) > 1 {
-		if protectedhdr := hdrs[0]; protectedhdr != nil {
+		if protectedhdr := hdrs[1]; protectedhdr != nil {
 			h, err := signer.ProtectedHeaders().Merge(protectedhdr)
 			if err != nil {
 				return nil, err
@@ -97,14 +94,7 @@ func Sign(payload []byte, alg jwa.SignatureAlgorithm, key interface{}, hdrs ...*
 		}
 	}
 
-	multisigner := NewMultiSign()
-	multisigner.AddSigner(signer)
-	msg, err := multisigner.Sign(payload)
-	if err != nil {
-		return nil, err
-	}
-
-	return CompactSerialize{}.Serialize(msg)
+	return signer, nil
 }
 
 // Verify checks if the given JWS message is verifiable using `alg` and `key`.
@@ -112,128 +102,199 @@ func Sign(payload []byte, alg jwa.SignatureAlgorithm, key interface{}, hdrs ...*
 // payload that was signed is returned. If you need more fine-grained
 // control of the verification process, manually call `Parse`, generate a
 // verifier, and call `Verify` on the parsed JWS message object.
-func Verify(buf []byte, alg jwa.SignatureAlgorithm, key interface{}) ([]byte, error) {
+//
+// `options` may be used to restrict the acceptable algorithms. Unsecured
+// messages (alg = "none") are rejected unless WithAllowNone is given, in
+// which case `key` is ignored.
+func Verify(buf []byte, alg jwa.SignatureAlgorithm, key interface{}, options ...VerifyOption) ([]byte, error) {
 	msg, err := Parse(buf)
 	if err != nil {
 		return nil, err
 	}
 
-	var verifier Verifier
-	switch alg {
-	case jwa.RS256, jwa.RS384, jwa.RS512, jwa.PS256, jwa.PS384, jwa.PS512:
-		pubkey, ok := key.(*rsa.PublicKey)
-		if !ok {
-			return nil, errors.New("invalid key: *rsa.PublicKey required")
-		}
+	if err := verifyMessage(msg, alg, key, options); err != nil {
+		return nil, err
+	}
+	return msg.Payload.Bytes(), nil
+}
 
-		rsaverify, err := NewRsaVerify(alg, pubkey)
-		if err != nil {
-			return nil, err
-		}
-		verifier = rsaverify
-	case jwa.HS256, jwa.HS384, jwa.HS512:
-		sharedkey, ok := key.([]byte)
-		if !ok {
-			return nil, errors.New("invalid key: []byte required")
-		}
+// VerifyDetached is the same as Verify, but it verifies a JWS message
+// whose payload has been detached (RFC 7515 Appendix F), such as
+// "header..signature", against `payload`
+func VerifyDetached(buf []byte, payload []byte, alg jwa.SignatureAlgorithm, key interface{}, options ...VerifyOption) error {
+	msg, err := parseDetached(buf, payload)
+	if err != nil {
+		return err
+	}
 
-		hmacverify, err := NewHmacVerify(alg, sharedkey)
-		if err != nil {
-			return nil, err
-		}
-		verifier = hmacverify
-	case jwa.ES256, jwa.ES384, jwa.ES512:
-		pubkey, ok := key.(*ecdsa.PublicKey)
-		if !ok {
-			return nil, errors.New("invalid key: *ecdsa.PublicKey required")
-		}
+	return verifyMessage(msg, alg, key, options)
+}
 
-		ecdsaverify, err := NewEcdsaVerify(alg, pubkey)
-		if err != nil {
-			return nil, err
-		}
-		verifier = ecdsaverify
-	default:
-		return nil, ErrUnsupportedAlgorithm
+func verifyMessage(msg *Message, alg jwa.SignatureAlgorithm, key interface{}, options []VerifyOption) error {
+	if !newVerifyOptions(options).isAllowed(alg) {
+		return ErrAlgorithmNotAllowed
 	}
 
-	if err := verifier.Verify(msg); err != nil {
-		return nil, err
+	if alg == jwa.NoSignature {
+		return verifyUnsecured(msg)
 	}
-	return msg.Payload.Bytes(), nil
+
+	if err := checkKeyAlgorithm(alg, key); err != nil {
+		return err
+	}
+
+	verifier, err := NewVerifier(alg, key)
+	if err != nil {
+		return err
+	}
+
+	return verifier.Verify(msg)
 }
 
 // VerifyWithJKU verifies the JWS message using a remote JWK
 // file represented in the url.
-func VerifyWithJKU(buf []byte, jwkurl string) ([]byte, error) {
+func VerifyWithJKU(buf []byte, jwkurl string, options ...VerifyOption) ([]byte, error) {
 	key, err := jwk.FetchHTTP(jwkurl)
 	if err != nil {
 		return nil, err
 	}
 
-	return VerifyWithJWK(buf, key)
+	return VerifyWithJWK(buf, key, options...)
+}
+
+// VerifyWithJWK verifies the JWS message using JWK keys. Keys whose "use"
+// is not "sig" are skipped. The algorithm specified in the protected header
+// of each signature is used for verification, and only keys whose "kty"
+// (and "alg", if specified) agree with that algorithm are tried.
+func VerifyWithJWK(buf []byte, keyset *jwk.Set, options ...VerifyOption) ([]byte, error) {
+	return VerifyWithKeyProvider(buf, jwkProvider(keyset), options...)
+}
+
+// VerifyDetachedWithJWK is the same as VerifyWithJWK, but it verifies
+// a JWS message whose payload has been detached against `payload`
+func VerifyDetachedWithJWK(buf []byte, payload []byte, keyset *jwk.Set, options ...VerifyOption) error {
+	return VerifyDetachedWithKeyProvider(buf, payload, jwkProvider(keyset), options...)
+}
+
+func jwkProvider(keyset *jwk.Set) KeyProvider {
+	return KeyProviderFunc(func(MergedHeader) ([]interface{}, error) {
+		var keys []interface{}
+		for _, key := range keyset.Keys {
+			if u := key.Use(); u != "" && u != string(jwk.ForSignature) {
+				continue
+			}
+			keys = append(keys, key)
+		}
+		return keys, nil
+	})
+}
+
+// KeysFor calls f(h)
+func (f KeyProviderFunc) KeysFor(h MergedHeader) ([]interface{}, error) {
+	return f(h)
 }
 
-// VerifyWithJWK verifies the JWS message using JWK keys
-func VerifyWithJWK(buf []byte, keyset *jwk.Set) ([]byte, error) {
+// VerifyWithKeyProvider verifies the JWS message using the keys returned
+// by `provider`. For each signature in the message, the provider is given
+// the headers associated with it (so it can look at "kid", "alg", "jku",
+// "x5t", the embedded "jwk", etc), and the signature is verified against
+// each of the keys it returns using the algorithm specified in the
+// protected header. Keys may be given as jwk.Key, in which case they are
+// checked against the algorithm and materialized before use.
+//
+// Signatures using algorithms not allowed by `options` are ignored.
+// If the provider returns an error, verification stops and the error
+// is returned.
+func VerifyWithKeyProvider(buf []byte, provider KeyProvider, options ...VerifyOption) ([]byte, error) {
 	m, err := Parse(buf)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, key := range keyset.Keys {
-		if u := key.Use(); u != "" && u != "enc" {
+	if err := verifyMessageWithKeyProvider(m, provider, options); err != nil {
+		return nil, err
+	}
+	return m.Payload.Bytes(), nil
+}
+
+// VerifyDetachedWithKeyProvider is the same as VerifyWithKeyProvider, but
+// it verifies a JWS message whose payload has been detached against `payload`
+func VerifyDetachedWithKeyProvider(buf []byte, payload []byte, provider KeyProvider, options ...VerifyOption) error {
+	m, err := parseDetached(buf, payload)
+	if err != nil {
+		return err
+	}
+
+	return verifyMessageWithKeyProvider(m, provider, options)
+}
+
+func verifyMessageWithKeyProvider(m *Message, provider KeyProvider, options []VerifyOption) error {
+	o := newVerifyOptions(options)
+	allowed := false
+	for _, sig := range m.Signatures {
+		hdr := sig.MergedHeaders()
+		alg := hdr.Algorithm()
+		if !o.isAllowed(alg) {
 			continue
 		}
+		allowed = true
 
-		keyval, err := key.Materialize()
-		if err != nil {
-			return nil, err
+		// Only verify against this particular signature
+		single := &Message{
+			Payload:    m.Payload,
+			Signatures: []Signature{sig},
 		}
 
-		alg := jwa.SignatureAlgorithm(key.Alg())
-
-		var verifier Verifier
-		switch key.Kty() {
-		case jwa.RSA:
-			pubkey, ok := keyval.(*rsa.PublicKey)
-			if !ok {
-				return nil, errors.New("invalid key: *rsa.PublicKey is required")
+		if alg == jwa.NoSignature {
+			if err := verifyUnsecured(single); err != nil {
+				continue
 			}
-			verifier, err = NewRsaVerify(alg, pubkey)
+			return nil
+		}
+
+		keys, err := provider.KeysFor(hdr)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			keyval, err := verificationKey(alg, key)
 			if err != nil {
-				return nil, err
+				continue
 			}
-		case jwa.EC:
-			pubkey, ok := keyval.(*ecdsa.PublicKey)
-			if !ok {
-				return nil, errors.New("invalid key: *ecdsa.PublicKey is required")
-			}
-			verifier, err = NewEcdsaVerify(alg, pubkey)
+
+			verifier, err := NewVerifier(alg, keyval)
 			if err != nil {
-				return nil, err
-			}
-		case jwa.OctetSeq:
-			sharedkey, ok := keyval.([]byte)
-			if !ok {
-				return nil, errors.New("invalid key: []byte is required")
+				continue
 			}
-			verifier, err = NewHmacVerify(alg, sharedkey)
-			if err != nil {
-				return nil, err
+
+			if err := verifier.Verify(single); err != nil {
+				continue
 			}
-		default:
-			continue
-		}
 
-		if err := verifier.Verify(m); err != nil {
-			continue
+			return nil
 		}
+	}
+
+	if !allowed {
+		return ErrAlgorithmNotAllowed
+	}
+	return errors.New("failed to verify")
+}
 
-		return m.Payload.Bytes(), nil
+// parseDetached parses a JWS message whose payload has been detached,
+// and attaches `payload` to it
+func parseDetached(buf []byte, payload []byte) (*Message, error) {
+	m, err := Parse(buf)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, errors.New("failed to verify")
+	if m.Payload.Len() > 0 {
+		return nil, errors.New("message is not detached: it already contains a payload")
+	}
+	m.Payload = buffer.Buffer(payload)
+	return m, nil
 }
 
 // Parse parses the given buffer and creates a jws.Message struct.
@@ -257,7 +318,8 @@ func ParseString(s string) (*Message, error) {
 
 func parseJSON(buf []byte) (*Message, error) {
 	m := struct {
-		*Message
+		Payload    json.RawMessage `json:"payload"`
+		Signatures []Signature     `json:"signatures"`
 		*Signature
 	}{}
 
@@ -265,22 +327,38 @@ func parseJSON(buf []byte) (*Message, error) {
 		return nil, err
 	}
 
+	msg := &Message{Signatures: m.Signatures}
+
 	// if the "signature" field exist, treat it as a flattened
 	if m.Signature != nil {
-		if len(m.Message.Signatures) != 0 {
+		if len(msg.Signatures) != 0 {
 			return nil, errors.New("invalid message: mixed flattened/full json serialization")
 		}
 
-		m.Message.Signatures = []Signature{*m.Signature}
+		msg.Signatures = []Signature{*m.Signature}
 	}
 
-	for _, sig := range m.Message.Signatures {
-		if sig.ProtectedHeader.Algorithm == "" {
-			sig.ProtectedHeader.Algorithm = jwa.NoSignature
+	// The payload is a base64 encoded string, unless "b64" is false, in
+	// which case it's the payload itself (RFC 7797). If it's missing, the
+	// payload has been detached
+	if len(m.Payload) > 0 && !bytes.Equal(m.Payload, []byte("null")) {
+		unencoded, err := msg.isUnencodedPayload()
+		if err != nil {
+			return nil, err
+		}
+
+		if unencoded {
+			var payload string
+			if err := json.Unmarshal(m.Payload, &payload); err != nil {
+				return nil, err
+			}
+			msg.Payload = buffer.Buffer(payload)
+		} else if err := json.Unmarshal(m.Payload, &msg.Payload); err != nil {
+			return nil, err
 		}
 	}
 
-	return m.Message, nil
+	return msg, nil
 }
 
 // parseCompact parses a JWS value serialized via compact serialization.
@@ -304,16 +382,24 @@ func parseCompact(buf []byte) (*Message, error) {
 	}
 	hdr.Source = hdrbuf
 
-	payload, err := buffer.FromBase64(parts[1])
-	if err != nil {
-		return nil, err
+	// An empty payload means that it has been detached. If "b64" is
+	// false, the payload is not base64 encoded (RFC 7797)
+	var payload buffer.Buffer
+	if hdr.isUnencodedPayload() {
+		payload = buffer.Buffer(parts[1])
+	} else {
+		payload, err = buffer.FromBase64(parts[1])
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	signature := make([]byte, enc.DecodedLen(len(parts[2])))
-	if _, err := enc.Decode(signature, parts[2]); err != nil {
+	n, err := enc.Decode(signature, parts[2])
+	if err != nil {
 		return nil, err
 	}
-	signature = bytes.TrimRight(signature, "\x00")
+	signature = signature[:n]
 
 	s := NewSignature()
 	s.Signature = signature
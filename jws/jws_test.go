@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"strings"
 	"testing"
 
@@ -122,6 +125,247 @@ func TestVerifyWithJWK(t *testing.T) {
 	}
 }
 
+func TestVerifyWithKeyProvider(t *testing.T) {
+	payload := []byte("Hello, World!")
+	tenants := map[string]*rsa.PrivateKey{}
+	for _, kid := range []string{"tenant-a", "tenant-b"} {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if !assert.NoError(t, err, "RSA key generated") {
+			return
+		}
+		tenants[kid] = key
+	}
+
+	provider := KeyProviderFunc(func(h MergedHeader) ([]interface{}, error) {
+		if !assert.Equal(t, jwa.RS256, h.Algorithm(), "alg is passed to the provider") {
+			return nil, errors.New("unexpected alg")
+		}
+		key, ok := tenants[h.KeyID()]
+		if !ok {
+			return nil, nil
+		}
+		return []interface{}{&key.PublicKey}, nil
+	})
+
+	for kid, key := range tenants {
+		protected := NewHeader()
+		protected.KeyID = kid
+		buf, err := Sign(payload, jwa.RS256, key, nil, protected)
+		if !assert.NoError(t, err, "Signature generated successfully") {
+			return
+		}
+
+		verified, err := VerifyWithKeyProvider(buf, provider)
+		if !assert.NoError(t, err, "Verify is successful") {
+			return
+		}
+		if !assert.Equal(t, payload, verified, "Verified payload is the same") {
+			return
+		}
+	}
+
+	// Signed by tenant-a, but claims to be tenant-b
+	protected := NewHeader()
+	protected.KeyID = "tenant-b"
+	buf, err := Sign(payload, jwa.RS256, tenants["tenant-a"], nil, protected)
+	if !assert.NoError(t, err, "Signature generated successfully") {
+		return
+	}
+	_, err = VerifyWithKeyProvider(buf, provider)
+	if !assert.Error(t, err, "Verify should fail with the wrong key") {
+		return
+	}
+
+	// Unknown kid
+	protected.KeyID = "tenant-c"
+	buf, err = Sign(payload, jwa.RS256, tenants["tenant-a"], nil, protected)
+	if !assert.NoError(t, err, "Signature generated successfully") {
+		return
+	}
+	_, err = VerifyWithKeyProvider(buf, provider)
+	if !assert.Error(t, err, "Verify should fail without keys") {
+		return
+	}
+
+	// Errors from the provider are propagated
+	providerErr := errors.New("provider failure")
+	_, err = VerifyWithKeyProvider(buf, KeyProviderFunc(func(MergedHeader) ([]interface{}, error) {
+		return nil, providerErr
+	}))
+	if !assert.Equal(t, providerErr, err, "provider error is returned") {
+		return
+	}
+}
+
+func TestVerifyWithKeyProvider_EmbeddedJwk(t *testing.T) {
+	payload := []byte("Hello, World!")
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "RSA key generated") {
+		return
+	}
+
+	jwkkey, err := jwk.NewRsaPublicKey(&key.PublicKey)
+	if !assert.NoError(t, err, "JWK public key generated") {
+		return
+	}
+
+	protected := NewHeader()
+	if !assert.NoError(t, protected.Set("jwk", jwkkey), "Set jwk header") {
+		return
+	}
+	buf, err := Sign(payload, jwa.RS256, key, nil, protected)
+	if !assert.NoError(t, err, "Signature generated successfully") {
+		return
+	}
+
+	verified, err := VerifyWithKeyProvider(buf, KeyProviderFunc(func(h MergedHeader) ([]interface{}, error) {
+		if h.Jwk() == nil {
+			return nil, errors.New("missing jwk header")
+		}
+		return []interface{}{h.Jwk()}, nil
+	}))
+	if !assert.NoError(t, err, "Verify is successful") {
+		return
+	}
+	if !assert.Equal(t, payload, verified, "Verified payload is the same") {
+		return
+	}
+}
+
+func TestVerify_AlgorithmPolicy(t *testing.T) {
+	payload := []byte("Hello, World!")
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "RSA key generated") {
+		return
+	}
+
+	t.Run("none is rejected by default", func(t *testing.T) {
+		s := `eyJhbGciOiJub25lIn0.eyJpc3MiOiJqb2UiLA0KICJleHAiOjEzMDA4MTkzODAsDQogImh0dHA6Ly9leGFtcGxlLmNvbS9pc19yb290Ijp0cnVlfQ.`
+		_, err := Verify([]byte(s), jwa.NoSignature, nil)
+		if !assert.Equal(t, ErrAlgorithmNotAllowed, err, "Verify should reject none") {
+			return
+		}
+
+		_, err = VerifyWithKeyProvider([]byte(s), KeyProviderFunc(func(MergedHeader) ([]interface{}, error) {
+			return nil, errors.New("provider should not be called")
+		}))
+		if !assert.Equal(t, ErrAlgorithmNotAllowed, err, "VerifyWithKeyProvider should reject none") {
+			return
+		}
+
+		verified, err := Verify([]byte(s), jwa.NoSignature, nil, WithAllowNone())
+		if !assert.NoError(t, err, "Verify should accept none when allowed") {
+			return
+		}
+		if !assert.Contains(t, string(verified), `"iss":"joe"`, "payload is returned") {
+			return
+		}
+	})
+
+	t.Run("allowed algorithms", func(t *testing.T) {
+		buf, err := Sign(payload, jwa.RS256, key)
+		if !assert.NoError(t, err, "Signature generated successfully") {
+			return
+		}
+
+		_, err = Verify(buf, jwa.RS256, &key.PublicKey, WithAllowedAlgorithms(jwa.ES256, jwa.PS256))
+		if !assert.Equal(t, ErrAlgorithmNotAllowed, err, "RS256 is not allowed") {
+			return
+		}
+
+		_, err = Verify(buf, jwa.RS256, &key.PublicKey, WithAllowedAlgorithms(jwa.ES256, jwa.RS256))
+		if !assert.NoError(t, err, "RS256 is allowed") {
+			return
+		}
+
+		jwkkey, err := jwk.NewRsaPublicKey(&key.PublicKey)
+		if !assert.NoError(t, err, "JWK public key generated") {
+			return
+		}
+		_, err = VerifyWithJWK(buf, &jwk.Set{Keys: []jwk.Key{jwkkey}}, WithAllowedAlgorithms(jwa.PS256))
+		if !assert.Equal(t, ErrAlgorithmNotAllowed, err, "RS256 is not allowed") {
+			return
+		}
+	})
+
+	t.Run("HMAC with public key bytes", func(t *testing.T) {
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if !assert.NoError(t, err, "public key marshaled") {
+			return
+		}
+		pemkey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+		buf, err := Sign(payload, jwa.HS256, pemkey)
+		if !assert.NoError(t, err, "Signature generated successfully") {
+			return
+		}
+
+		_, err = Verify(buf, jwa.HS256, pemkey)
+		if !assert.Equal(t, ErrKeyAlgorithmMismatch, err, "public key cannot be used as an HMAC secret") {
+			return
+		}
+
+		_, err = VerifyWithKeyProvider(buf, KeyProviderFunc(func(MergedHeader) ([]interface{}, error) {
+			return []interface{}{pemkey}, nil
+		}))
+		if !assert.Error(t, err, "public key cannot be used as an HMAC secret") {
+			return
+		}
+	})
+
+	t.Run("JWK type must match the algorithm", func(t *testing.T) {
+		buf, err := Sign(payload, jwa.HS256, []byte("secret"))
+		if !assert.NoError(t, err, "Signature generated successfully") {
+			return
+		}
+
+		rsakey, err := jwk.NewRsaPublicKey(&key.PublicKey)
+		if !assert.NoError(t, err, "JWK public key generated") {
+			return
+		}
+		_, err = VerifyWithJWK(buf, &jwk.Set{Keys: []jwk.Key{rsakey}})
+		if !assert.Error(t, err, "RSA key cannot verify HS256") {
+			return
+		}
+
+		octkey := &jwk.SymmetricKey{
+			EssentialHeader: &jwk.EssentialHeader{KeyType: jwa.OctetSeq},
+			Key:             buffer.Buffer("secret"),
+		}
+		verified, err := VerifyWithJWK(buf, &jwk.Set{Keys: []jwk.Key{rsakey, octkey}})
+		if !assert.NoError(t, err, "oct key verifies HS256") {
+			return
+		}
+		if !assert.Equal(t, payload, verified, "Verified payload is the same") {
+			return
+		}
+
+		octkey.KeyUsage = string(jwk.ForEncryption)
+		_, err = VerifyWithJWK(buf, &jwk.Set{Keys: []jwk.Key{octkey}})
+		if !assert.Error(t, err, "keys for encryption are not used") {
+			return
+		}
+	})
+
+	t.Run("missing alg", func(t *testing.T) {
+		s := `{"payload":"SGVsbG8","protected":"e30","signature":""}`
+		m, err := Parse([]byte(s))
+		if !assert.NoError(t, err, "Parse is successful") {
+			return
+		}
+		if !assert.Equal(t, jwa.SignatureAlgorithm(""), m.Signatures[0].MergedHeaders().Algorithm(), "alg is not defaulted to none") {
+			return
+		}
+
+		_, err = VerifyWithKeyProvider([]byte(s), KeyProviderFunc(func(MergedHeader) ([]interface{}, error) {
+			return nil, nil
+		}), WithAllowNone())
+		if !assert.Equal(t, ErrAlgorithmNotAllowed, err, "missing alg is rejected") {
+			return
+		}
+	})
+}
+
 func TestRoundtrip_RSACompact(t *testing.T) {
 	payload := []byte("Hello, World!")
 	for _, alg := range []jwa.SignatureAlgorithm{jwa.RS256, jwa.RS384, jwa.RS512, jwa.PS256, jwa.PS384, jwa.PS512} {
@@ -533,3 +777,276 @@ func TestSign_HeaderValues(t *testing.T) {
 		return
 	}
 }
+
+// https://tools.ietf.org/html/rfc8037#appendix-A.4
+func TestEncode_EdDSACompact(t *testing.T) {
+	const jwksrc = `{"kty":"OKP","crv":"Ed25519","d":"nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`
+	const expected = `eyJhbGciOiJFZERTQSJ9.RXhhbXBsZSBvZiBFZDI1NTE5IHNpZ25pbmc.hgyY0il_MGCjP0JzlnLWG1PPOt7-09PGcvMg3AIbQR6dWbhijcNR4ki4iylGjg5BhVsPt9g7sVvpAr_MuM0KAg`
+
+	set, err := jwk.ParseString(jwksrc)
+	if !assert.NoError(t, err, "Parsing jwk should succeed") {
+		return
+	}
+
+	privkey, err := set.Keys[0].Materialize()
+	if !assert.NoError(t, err, "Materialize should succeed") {
+		return
+	}
+
+	payload := []byte("Example of Ed25519 signing")
+	encoded, err := Sign(payload, jwa.EdDSA, privkey)
+	if !assert.NoError(t, err, "Sign should succeed") {
+		return
+	}
+
+	if !assert.Equal(t, expected, string(encoded), "Signature matches") {
+		return
+	}
+
+	pubkey, err := set.Keys[0].(*jwk.OKPPrivateKey).OKPPublicKey.Materialize()
+	if !assert.NoError(t, err, "Materialize should succeed") {
+		return
+	}
+
+	verified, err := Verify(encoded, jwa.EdDSA, pubkey)
+	if !assert.NoError(t, err, "Verify should succeed") {
+		return
+	}
+	if !assert.Equal(t, payload, verified, "Payload should match") {
+		return
+	}
+
+	pubjwk := set.Keys[0].(*jwk.OKPPrivateKey).OKPPublicKey
+	pubjwk.Algorithm = jwa.EdDSA.String()
+	verified, err = VerifyWithJWK(encoded, &jwk.Set{Keys: []jwk.Key{pubjwk}})
+	if !assert.NoError(t, err, "VerifyWithJWK should succeed") {
+		return
+	}
+	if !assert.Equal(t, payload, verified, "Payload should match") {
+		return
+	}
+
+	if _, err := Verify(encoded, jwa.EdDSA, privkey); !assert.Error(t, err, "Verify with a private key should fail") {
+		return
+	}
+}
+
+func TestVerify_Critical(t *testing.T) {
+	payload := []byte("Hello, World!")
+	key := []byte("secret")
+
+	sign := func(t *testing.T, public, protected *Header) []byte {
+		signer, err := NewHmacSign(jwa.HS256, key)
+		if !assert.NoError(t, err, "HMAC signer created") {
+			return nil
+		}
+		if public != nil {
+			signer.SetPublicHeaders(public)
+		}
+		if protected != nil {
+			h, err := signer.ProtectedHeaders().Merge(protected)
+			if !assert.NoError(t, err, "Merge protected headers") {
+				return nil
+			}
+			signer.SetProtectedHeaders(h)
+		}
+
+		ms := NewMultiSign()
+		ms.AddSigner(signer)
+		msg, err := ms.Sign(payload)
+		if !assert.NoError(t, err, "Sign is successful") {
+			return nil
+		}
+		buf, err := JSONSerialize{}.Serialize(msg)
+		if !assert.NoError(t, err, "Serialize is successful") {
+			return nil
+		}
+		return buf
+	}
+
+	newHeader := func(crit []string, params map[string]interface{}) *Header {
+		h := NewHeader()
+		h.Critical = crit
+		for k, v := range params {
+			h.Set(k, v)
+		}
+		return h
+	}
+
+	buf := sign(t, nil, newHeader([]string{"exp"}, map[string]interface{}{"exp": 100}))
+	_, err := Verify(buf, jwa.HS256, key)
+	if !assert.Equal(t, ErrUnsupportedCriticalHeader, err, "Verify should fail") {
+		return
+	}
+
+	RegisterCriticalHeader("exp", func(v interface{}) error {
+		if f, ok := v.(float64); !ok || f < 10 {
+			return errors.New("expired")
+		}
+		return nil
+	})
+	defer UnregisterCriticalHeader("exp")
+
+	if !assert.Panics(t, func() { RegisterCriticalHeader("kid", func(interface{}) error { return nil }) }, "standard headers can not be registered") {
+		return
+	}
+
+	verified, err := Verify(buf, jwa.HS256, key)
+	if !assert.NoError(t, err, "Verify is successful") {
+		return
+	}
+	if !assert.Equal(t, payload, verified, "Verified payload is the same") {
+		return
+	}
+
+	buf = sign(t, nil, newHeader([]string{"exp"}, map[string]interface{}{"exp": 1}))
+	_, err = Verify(buf, jwa.HS256, key)
+	if !assert.EqualError(t, err, "expired", "Verify should fail with the handler's error") {
+		return
+	}
+
+	buf = sign(t, nil, newHeader([]string{"exp"}, nil))
+	_, err = Verify(buf, jwa.HS256, key)
+	if !assert.Equal(t, ErrInvalidCriticalHeader, err, "listed header must be present") {
+		return
+	}
+
+	buf = sign(t, nil, newHeader([]string{"kid"}, map[string]interface{}{"kid": "foo"}))
+	_, err = Verify(buf, jwa.HS256, key)
+	if !assert.Equal(t, ErrInvalidCriticalHeader, err, "crit may not list standard headers") {
+		return
+	}
+
+	buf = sign(t, newHeader([]string{"exp"}, nil), newHeader(nil, map[string]interface{}{"exp": 100}))
+	_, err = Verify(buf, jwa.HS256, key)
+	if !assert.Equal(t, ErrInvalidCriticalHeader, err, "crit must be protected") {
+		return
+	}
+}
+
+// https://tools.ietf.org/html/rfc7797#section-4
+func TestVerify_UnencodedPayload(t *testing.T) {
+	const jwksrc = `{"kty":"oct","k":"AyM1SysPpbyDfgZld3umj1qzKObwVMkoqQ-EstJQLr_T-1qS0gZH75aKtMN3Yj0iPS4hcgUuTwjAzZr1Z9CAow"}`
+	const encoded = `eyJhbGciOiJIUzI1NiJ9.JC4wMg.5mvfOroL-g7HyqJoozehmsaqmvTYGEq5jTI1gVvoEoQ`
+	const detached = `eyJhbGciOiJIUzI1NiIsImI2NCI6ZmFsc2UsImNyaXQiOlsiYjY0Il19..A5dxf2s96_n5FLueVuW1Z_vh161FwXZC4YLPff6dmDY`
+	payload := []byte("$.02")
+
+	set, err := jwk.ParseString(jwksrc)
+	if !assert.NoError(t, err, "Parse JWK") {
+		return
+	}
+	key, err := set.Keys[0].Materialize()
+	if !assert.NoError(t, err, "Materialize JWK") {
+		return
+	}
+
+	verified, err := Verify([]byte(encoded), jwa.HS256, key)
+	if !assert.NoError(t, err, "Verify b64=true example") {
+		return
+	}
+	if !assert.Equal(t, payload, verified, "payload matches") {
+		return
+	}
+
+	if !assert.NoError(t, VerifyDetached([]byte(detached), payload, jwa.HS256, key), "VerifyDetached b64=false example") {
+		return
+	}
+	if !assert.NoError(t, VerifyDetachedWithJWK([]byte(detached), payload, set), "VerifyDetachedWithJWK b64=false example") {
+		return
+	}
+	if !assert.Error(t, VerifyDetached([]byte(detached), []byte("$.03"), jwa.HS256, key), "VerifyDetached with wrong payload") {
+		return
+	}
+	if !assert.Error(t, VerifyDetached([]byte(encoded), payload, jwa.HS256, key), "VerifyDetached with attached payload") {
+		return
+	}
+
+	// Generate the same message
+	protected := NewHeader()
+	protected.Set("b64", false)
+	signer, err := NewHmacSign(jwa.HS256, key.([]byte))
+	if !assert.NoError(t, err, "HMAC signer created") {
+		return
+	}
+	protected, err = signer.ProtectedHeaders().Merge(protected)
+	if !assert.NoError(t, err, "Merge protected headers") {
+		return
+	}
+	signer.SetProtectedHeaders(protected)
+
+	msg, err := NewMultiSign(signer).Sign(payload)
+	if !assert.NoError(t, err, "Sign is successful") {
+		return
+	}
+	if !assert.Equal(t, []string{"b64"}, msg.Signatures[0].ProtectedHeader.Critical, "b64 is added to crit") {
+		return
+	}
+
+	buf, err := CompactSerialize{Detached: true}.Serialize(msg)
+	if !assert.NoError(t, err, "CompactSerialize is successful") {
+		return
+	}
+	if !assert.Equal(t, 2, bytes.Count(buf, []byte{'.'}), "two dots") {
+		return
+	}
+	if !assert.Contains(t, string(buf), "..", "payload is detached") {
+		return
+	}
+	if !assert.NoError(t, VerifyDetached(buf, payload, jwa.HS256, key), "VerifyDetached is successful") {
+		return
+	}
+
+	// "$.02" contains a '.', so it can't be in compact form
+	_, err = CompactSerialize{}.Serialize(msg)
+	if !assert.Equal(t, ErrInvalidUnencodedPayload, err, "CompactSerialize should fail") {
+		return
+	}
+
+	buf, err = JSONSerialize{}.Serialize(msg)
+	if !assert.NoError(t, err, "JSONSerialize is successful") {
+		return
+	}
+	if !assert.Contains(t, string(buf), `"payload":"$.02"`, "payload is not encoded") {
+		return
+	}
+	verified, err = Verify(buf, jwa.HS256, key)
+	if !assert.NoError(t, err, "Verify is successful") {
+		return
+	}
+	if !assert.Equal(t, payload, verified, "payload matches") {
+		return
+	}
+
+	buf, err = JSONSerialize{Detached: true}.Serialize(msg)
+	if !assert.NoError(t, err, "JSONSerialize is successful") {
+		return
+	}
+	if !assert.NotContains(t, string(buf), `"payload"`, "payload is detached") {
+		return
+	}
+	if !assert.NoError(t, VerifyDetached(buf, payload, jwa.HS256, key), "VerifyDetached is successful") {
+		return
+	}
+}
+
+func TestVerify_UnencodedPayloadWithoutCrit(t *testing.T) {
+	key := []byte("secret")
+	hdr := []byte(`{"alg":"HS256","b64":false}`)
+	encodedHdr, _ := buffer.Buffer(hdr).Base64Encode()
+	siv := append(append(encodedHdr, '.'), "hello"...)
+	signer, err := NewHmacSign(jwa.HS256, key)
+	if !assert.NoError(t, err, "HMAC signer created") {
+		return
+	}
+	sig, err := signer.PayloadSign(siv)
+	if !assert.NoError(t, err, "PayloadSign is successful") {
+		return
+	}
+	encodedSig, _ := buffer.Buffer(sig).Base64Encode()
+	buf := append(append(siv, '.'), encodedSig...)
+
+	_, err = Verify(buf, jwa.HS256, key)
+	if !assert.Equal(t, ErrInvalidCriticalHeader, err, "b64 must be listed in crit") {
+		return
+	}
+}
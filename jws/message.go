@@ -8,6 +8,7 @@ import (
 	"github.com/lestrrat/go-jwx/buffer"
 	"github.com/lestrrat/go-jwx/internal/emap"
 	"github.com/lestrrat/go-jwx/jwa"
+	"github.com/lestrrat/go-jwx/jwk"
 )
 
 func NewHeader() *Header {
@@ -93,6 +94,12 @@ func (h *Header) Set(key string, value interface{}) error {
 			return ErrInvalidHeaderValue
 		}
 		h.X509Url = u
+	case "jwk":
+		v, ok := value.(jwk.Key)
+		if !ok {
+			return ErrInvalidHeaderValue
+		}
+		h.Jwk = v
 	default:
 		h.PrivateParams[key] = value
 	}
@@ -127,6 +134,14 @@ func (h1 *EssentialHeader) Merge(h2 *EssentialHeader) {
 		h1.ContentType = h2.ContentType
 	}
 
+	if h2.Critical != nil {
+		h1.Critical = h2.Critical
+	}
+
+	if h2.Jwk != nil {
+		h1.Jwk = h2.Jwk
+	}
+
 	if h2.JwkSetURL != nil {
 		h1.JwkSetURL = h2.JwkSetURL
 	}
@@ -176,6 +191,8 @@ func (h1 *Header) Copy(h2 *Header) error {
 func (h1 *EssentialHeader) Copy(h2 *EssentialHeader) {
   h1.Algorithm = h2.Algorithm
   h1.ContentType = h2.ContentType
+	h1.Critical = h2.Critical
+	h1.Jwk = h2.Jwk
 	h1.JwkSetURL = h2.JwkSetURL
   h1.KeyID = h2.KeyID
   h1.Type = h2.Type
@@ -204,16 +221,25 @@ func (h *EssentialHeader) Construct(m map[string]interface{}) error {
 	if alg, err := r.GetString("alg"); err == nil {
 		h.Algorithm = jwa.SignatureAlgorithm(alg)
 	}
-	if h.Algorithm == "" {
-		h.Algorithm = jwa.NoSignature
-	}
 	h.ContentType, _ = r.GetString("cty")
 	h.KeyID, _ = r.GetString("kid")
 	h.Type, _ = r.GetString("typ")
 	h.X509CertThumbprint, _ = r.GetString("x5t")
 	h.X509CertThumbprintS256, _ = r.GetString("x5t#256")
-	if v, err := r.GetStringSlice("crit"); err != nil {
-		h.Critical = v
+	if v, ok := m["crit"]; ok {
+		delete(m, "crit")
+		list, ok := v.([]interface{})
+		if !ok {
+			return ErrInvalidHeaderValue
+		}
+		h.Critical = make([]string, 0, len(list))
+		for _, name := range list {
+			s, ok := name.(string)
+			if !ok {
+				return ErrInvalidHeaderValue
+			}
+			h.Critical = append(h.Critical, s)
+		}
 	}
 	if v, err := r.GetStringSlice("x5c"); err != nil {
 		h.X509CertChain = v
@@ -232,9 +258,74 @@ func (h *EssentialHeader) Construct(m map[string]interface{}) error {
 		}
 	}
 
+	if v, ok := m["jwk"]; ok {
+		delete(m, "jwk")
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		set, err := jwk.Parse(buf)
+		if err != nil {
+			return err
+		}
+		if len(set.Keys) != 1 {
+			return errors.New("expected a single JWK in 'jwk'")
+		}
+		h.Jwk = set.Keys[0]
+	}
+
 	return nil
 }
 
+// isUnencodedPayload returns true if the header contains "b64": false,
+// which means that the payload is used as is (i.e. without base64 encoding
+// it) in the signing input. See RFC 7797
+func (h *Header) isUnencodedPayload() bool {
+	if h == nil || h.PrivateParams == nil {
+		return false
+	}
+	v, ok := h.PrivateParams["b64"].(bool)
+	return ok && !v
+}
+
+// isUnencodedPayload returns true if the signatures in the message use
+// the unencoded payload option. It is an error for the signatures to
+// disagree on the value of "b64", as the same payload is shared
+func (m Message) isUnencodedPayload() (bool, error) {
+	var unencoded bool
+	for i, sig := range m.Signatures {
+		var v bool
+		if sig.ProtectedHeader != nil {
+			v = sig.ProtectedHeader.isUnencodedPayload()
+		}
+		if i > 0 && v != unencoded {
+			return false, errors.New("all signatures must use the same value for 'b64'")
+		}
+		unencoded = v
+	}
+	return unencoded, nil
+}
+
+// signingInput creates the JWS Signing Input from the (already base64
+// encoded) protected header and the payload. The payload is base64
+// encoded unless the header specifies "b64": false
+func signingInput(protected *Header, encodedHeader []byte, payload buffer.Buffer) ([]byte, error) {
+	var encodedPayload []byte
+	if protected.isUnencodedPayload() {
+		encodedPayload = payload.Bytes()
+	} else {
+		var err error
+		encodedPayload, err = payload.Base64Encode()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	siv := make([]byte, 0, len(encodedHeader)+len(encodedPayload)+1)
+	siv = append(append(append(siv, encodedHeader...), '.'), encodedPayload...)
+	return siv, nil
+}
+
 func (h Header) Base64Encode() ([]byte, error) {
 	b, err := json.Marshal(h)
 	if err != nil {
@@ -310,7 +401,56 @@ func (h MergedHeader) Algorithm() jwa.SignatureAlgorithm {
 	if hp := h.ProtectedHeader; hp != nil {
 		return hp.Algorithm
 	}
-	return jwa.NoSignature
+	return ""
+}
+
+func (h MergedHeader) JwkSetURL() *url.URL {
+	if hp := h.ProtectedHeader; hp != nil {
+		if hp.JwkSetURL != nil {
+			return hp.JwkSetURL
+		}
+	}
+
+	if hp := h.PublicHeader; hp != nil {
+		if hp.JwkSetURL != nil {
+			return hp.JwkSetURL
+		}
+	}
+
+	return nil
+}
+
+func (h MergedHeader) X509CertThumbprint() string {
+	if hp := h.ProtectedHeader; hp != nil {
+		if hp.X509CertThumbprint != "" {
+			return hp.X509CertThumbprint
+		}
+	}
+
+	if hp := h.PublicHeader; hp != nil {
+		if hp.X509CertThumbprint != "" {
+			return hp.X509CertThumbprint
+		}
+	}
+
+	return ""
+}
+
+// Jwk returns the public key embedded in the "jwk" header, if any
+func (h MergedHeader) Jwk() jwk.Key {
+	if hp := h.ProtectedHeader; hp != nil {
+		if hp.Jwk != nil {
+			return hp.Jwk
+		}
+	}
+
+	if hp := h.PublicHeader; hp != nil {
+		if hp.Jwk != nil {
+			return hp.Jwk
+		}
+	}
+
+	return nil
 }
 
 // LookupSignature looks up a particular signature entry using
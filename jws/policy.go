@@ -0,0 +1,147 @@
+package jws
+
+import (
+	"bytes"
+
+	"github.com/lestrrat/go-jwx/jwa"
+	"github.com/lestrrat/go-jwx/jwk"
+)
+
+// WithAllowedAlgorithms restricts the algorithms that are accepted
+// during verification to `algs`. If not specified, any registered
+// algorithm except for "none" is accepted
+func WithAllowedAlgorithms(algs ...jwa.SignatureAlgorithm) VerifyOption {
+	return func(o *verifyOptions) {
+		o.allowed = algs
+	}
+}
+
+// WithAllowNone allows unsecured JWS messages (alg = "none") to be
+// accepted during verification. Messages with "none" are rejected
+// unless this option is given, regardless of WithAllowedAlgorithms
+func WithAllowNone() VerifyOption {
+	return func(o *verifyOptions) {
+		o.allowNone = true
+	}
+}
+
+func newVerifyOptions(options []VerifyOption) *verifyOptions {
+	o := &verifyOptions{}
+	for _, option := range options {
+		option(o)
+	}
+	return o
+}
+
+func (o *verifyOptions) isAllowed(alg jwa.SignatureAlgorithm) bool {
+	switch alg {
+	case "":
+		return false
+	case jwa.NoSignature:
+		return o.allowNone
+	}
+
+	if len(o.allowed) == 0 {
+		return true
+	}
+
+	for _, a := range o.allowed {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// keyTypeForAlgorithm returns the JWK key type that must be used with
+// `alg`. The second return value is false for algorithms that are not
+// defined in RFC 7518 / RFC 8037
+func keyTypeForAlgorithm(alg jwa.SignatureAlgorithm) (jwa.KeyType, bool) {
+	switch alg {
+	case jwa.HS256, jwa.HS384, jwa.HS512:
+		return jwa.OctetSeq, true
+	case jwa.RS256, jwa.RS384, jwa.RS512, jwa.PS256, jwa.PS384, jwa.PS512:
+		return jwa.RSA, true
+	case jwa.ES256, jwa.ES384, jwa.ES512:
+		return jwa.EC, true
+	case jwa.EdDSA:
+		return jwa.OKP, true
+	}
+	return "", false
+}
+
+// verificationKey checks that `key` may be used to verify signatures
+// created using `alg`, and returns the raw key. jwk.Key values are
+// materialized after checking that their "kty" and "alg" match `alg`
+func verificationKey(alg jwa.SignatureAlgorithm, key interface{}) (interface{}, error) {
+	if jwkkey, ok := key.(jwk.Key); ok {
+		if a := jwkkey.Alg(); a != "" && a != alg.String() {
+			return nil, ErrKeyAlgorithmMismatch
+		}
+		if kty, ok := keyTypeForAlgorithm(alg); ok && jwkkey.Kty() != kty {
+			return nil, ErrKeyAlgorithmMismatch
+		}
+
+		keyval, err := jwkkey.Materialize()
+		if err != nil {
+			return nil, err
+		}
+		key = keyval
+	}
+
+	if err := checkKeyAlgorithm(alg, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// checkKeyAlgorithm refuses keys that are obviously not meant to be
+// used with `alg`. The signer/verifier factories already check the
+// type of the key, but HMAC keys are just bytes, so we also refuse
+// the textual representation of public keys being used as HMAC
+// secrets (the classic RS256 -> HS256 confusion)
+func checkKeyAlgorithm(alg jwa.SignatureAlgorithm, key interface{}) error {
+	switch alg {
+	case jwa.HS256, jwa.HS384, jwa.HS512:
+		if b, ok := key.([]byte); ok && looksLikePublicKey(b) {
+			return ErrKeyAlgorithmMismatch
+		}
+	}
+	return nil
+}
+
+var publicKeyPrefixes = [][]byte{
+	[]byte("-----BEGIN "),
+	[]byte("ssh-rsa "),
+	[]byte("ssh-ed25519 "),
+	[]byte("ecdsa-sha2-"),
+}
+
+func looksLikePublicKey(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	for _, prefix := range publicKeyPrefixes {
+		if bytes.HasPrefix(b, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyUnsecured checks that the message contains an unsecured
+// signature, i.e. one with alg = "none" and an empty signature
+func verifyUnsecured(m *Message) error {
+	for _, sig := range m.Signatures {
+		if sig.MergedHeaders().Algorithm() != jwa.NoSignature {
+			continue
+		}
+		if sig.Signature.Len() != 0 {
+			continue
+		}
+		var protected *Header
+		if sig.ProtectedHeader != nil {
+			protected = sig.ProtectedHeader.Header
+		}
+		return checkCritical(protected, sig.PublicHeader)
+	}
+	return ErrInvalidSignature
+}
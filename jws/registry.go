@@ -0,0 +1,202 @@
+package jws
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"sync"
+
+	"github.com/lestrrat/go-jwx/jwa"
+	"golang.org/x/crypto/ed25519"
+)
+
+type algorithmEntry struct {
+	signer   SignerFactory
+	verifier VerifierFactory
+}
+
+var algorithms = struct {
+	sync.RWMutex
+	entries map[jwa.SignatureAlgorithm]algorithmEntry
+}{
+	entries: map[jwa.SignatureAlgorithm]algorithmEntry{},
+}
+
+func init() {
+	for _, alg := range []jwa.SignatureAlgorithm{jwa.RS256, jwa.RS384, jwa.RS512, jwa.PS256, jwa.PS384, jwa.PS512} {
+		RegisterAlgorithm(alg, newRsaSigner, newRsaVerifier)
+	}
+	for _, alg := range []jwa.SignatureAlgorithm{jwa.HS256, jwa.HS384, jwa.HS512} {
+		RegisterAlgorithm(alg, newHmacSigner, newHmacVerifier)
+	}
+	for _, alg := range []jwa.SignatureAlgorithm{jwa.ES256, jwa.ES384, jwa.ES512} {
+		RegisterAlgorithm(alg, newEcdsaSigner, newEcdsaVerifier)
+	}
+	RegisterAlgorithm(jwa.EdDSA, newEdDSASigner, newEdDSAVerifier)
+}
+
+// RegisterAlgorithm registers the factories used to create signers and
+// verifiers for `alg`. Once registered, the algorithm can be used with
+// Sign, Verify, VerifyWithJWK and MultiSign.AddSignerFor. Registering an
+// algorithm that is already registered (including the built-in ones)
+// replaces the previous factories. Either factory may be nil, in which
+// case the algorithm can only be used for verifying or signing,
+// respectively.
+func RegisterAlgorithm(alg jwa.SignatureAlgorithm, sf SignerFactory, vf VerifierFactory) {
+	algorithms.Lock()
+	defer algorithms.Unlock()
+	algorithms.entries[alg] = algorithmEntry{signer: sf, verifier: vf}
+}
+
+// UnregisterAlgorithm removes `alg` from the list of registered algorithms
+func UnregisterAlgorithm(alg jwa.SignatureAlgorithm) {
+	algorithms.Lock()
+	defer algorithms.Unlock()
+	delete(algorithms.entries, alg)
+}
+
+func lookupAlgorithm(alg jwa.SignatureAlgorithm) (algorithmEntry, bool) {
+	algorithms.RLock()
+	defer algorithms.RUnlock()
+	e, ok := algorithms.entries[alg]
+	return e, ok
+}
+
+// NewPayloadSigner creates a PayloadSigner for `alg` using the
+// registered SignerFactory
+func NewPayloadSigner(alg jwa.SignatureAlgorithm, key interface{}) (PayloadSigner, error) {
+	e, ok := lookupAlgorithm(alg)
+	if !ok || e.signer == nil {
+		return nil, ErrUnsupportedAlgorithm
+	}
+	return e.signer(alg, key)
+}
+
+// NewVerifier creates a Verifier for `alg` using the registered
+// VerifierFactory
+func NewVerifier(alg jwa.SignatureAlgorithm, key interface{}) (Verifier, error) {
+	v, err := newPayloadVerifier(alg, key)
+	if err != nil {
+		return nil, err
+	}
+	return NewGenericVerify(alg, v), nil
+}
+
+func newPayloadVerifier(alg jwa.SignatureAlgorithm, key interface{}) (PayloadVerifier, error) {
+	e, ok := lookupAlgorithm(alg)
+	if !ok || e.verifier == nil {
+		return nil, ErrUnsupportedAlgorithm
+	}
+	return e.verifier(alg, key)
+}
+
+// NewGenericSign creates a new GenericSign that signs payloads using `f`
+func NewGenericSign(alg jwa.SignatureAlgorithm, f PayloadSignFunc) *GenericSign {
+	protectedhdr := NewHeader()
+	protectedhdr.Algorithm = alg
+	return &GenericSign{
+		Public:    NewHeader(),
+		Protected: protectedhdr,
+		sign:      f,
+	}
+}
+
+func (s GenericSign) PayloadSign(payload []byte) ([]byte, error) {
+	return s.sign(payload)
+}
+
+func (s GenericSign) SignatureAlgorithm() jwa.SignatureAlgorithm {
+	return s.Protected.Algorithm
+}
+
+func (s GenericSign) PublicHeaders() *Header {
+	return s.Public
+}
+
+func (s GenericSign) ProtectedHeaders() *Header {
+	return s.Protected
+}
+
+func (s *GenericSign) SetPublicHeaders(h *Header) {
+	s.Public = h
+}
+
+func (s *GenericSign) SetProtectedHeaders(h *Header) {
+	s.Protected = h
+}
+
+// NewGenericVerify creates a new GenericVerify that verifies the
+// signatures for `alg` using `v`
+func NewGenericVerify(alg jwa.SignatureAlgorithm, v PayloadVerifier) *GenericVerify {
+	return &GenericVerify{alg: alg, verifier: v}
+}
+
+// Verify checks that the message contains a signature for the algorithm
+// that can be verified. This fulfills the `Verifier` interface
+func (v GenericVerify) Verify(m *Message) error {
+	return doMessageVerify(v.alg, v.verifier, m)
+}
+
+func newRsaSigner(alg jwa.SignatureAlgorithm, key interface{}) (PayloadSigner, error) {
+	privkey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid private key: *rsa.PrivateKey required")
+	}
+	return NewRsaSign(alg, privkey)
+}
+
+func newRsaVerifier(alg jwa.SignatureAlgorithm, key interface{}) (PayloadVerifier, error) {
+	pubkey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("invalid key: *rsa.PublicKey required")
+	}
+	return NewRsaVerify(alg, pubkey)
+}
+
+func newHmacSigner(alg jwa.SignatureAlgorithm, key interface{}) (PayloadSigner, error) {
+	sharedkey, ok := key.([]byte)
+	if !ok {
+		return nil, errors.New("invalid private key: []byte required")
+	}
+	return NewHmacSign(alg, sharedkey)
+}
+
+func newHmacVerifier(alg jwa.SignatureAlgorithm, key interface{}) (PayloadVerifier, error) {
+	sharedkey, ok := key.([]byte)
+	if !ok {
+		return nil, errors.New("invalid key: []byte required")
+	}
+	return NewHmacVerify(alg, sharedkey)
+}
+
+func newEcdsaSigner(alg jwa.SignatureAlgorithm, key interface{}) (PayloadSigner, error) {
+	privkey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid private key: *ecdsa.PrivateKey required")
+	}
+	return NewEcdsaSign(alg, privkey)
+}
+
+func newEcdsaVerifier(alg jwa.SignatureAlgorithm, key interface{}) (PayloadVerifier, error) {
+	pubkey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("invalid key: *ecdsa.PublicKey required")
+	}
+	return NewEcdsaVerify(alg, pubkey)
+}
+
+func newEdDSASigner(alg jwa.SignatureAlgorithm, key interface{}) (PayloadSigner, error) {
+	privkey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid private key: ed25519.PrivateKey required")
+	}
+	return NewEdDSASign(alg, privkey)
+}
+
+func newEdDSAVerifier(alg jwa.SignatureAlgorithm, key interface{}) (PayloadVerifier, error) {
+	pubkey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("invalid key: ed25519.PublicKey required")
+	}
+	return NewEdDSAVerify(alg, pubkey)
+}
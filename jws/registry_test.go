@@ -0,0 +1,148 @@
+package jws
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/lestrrat/go-jwx/jwa"
+	"github.com/lestrrat/go-jwx/jwk"
+	"github.com/stretchr/testify/assert"
+)
+
+// A made up algorithm, which signs using the reversed HMAC-SHA256 digest
+const reversedHS256 jwa.SignatureAlgorithm = "X-REVERSED-HS256"
+
+func reversedHmac(key, payload []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(payload)
+	b := h.Sum(nil)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
+
+type reversedHmacVerify []byte
+
+func (v reversedHmacVerify) PayloadVerify(payload, signature []byte) error {
+	if !hmac.Equal(signature, reversedHmac(v, payload)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func registerReversedHS256() {
+	RegisterAlgorithm(
+		reversedHS256,
+		func(alg jwa.SignatureAlgorithm, key interface{}) (PayloadSigner, error) {
+			sharedkey, ok := key.([]byte)
+			if !ok {
+				return nil, errors.New("invalid private key: []byte required")
+			}
+			return NewGenericSign(alg, func(payload []byte) ([]byte, error) {
+				return reversedHmac(sharedkey, payload), nil
+			}), nil
+		},
+		func(alg jwa.SignatureAlgorithm, key interface{}) (PayloadVerifier, error) {
+			sharedkey, ok := key.([]byte)
+			if !ok {
+				return nil, errors.New("invalid key: []byte required")
+			}
+			return reversedHmacVerify(sharedkey), nil
+		},
+	)
+}
+
+func TestRegisterAlgorithm(t *testing.T) {
+	registerReversedHS256()
+	defer UnregisterAlgorithm(reversedHS256)
+
+	payload := []byte("Hello, World!")
+	key := []byte("Avracadabra")
+
+	buf, err := Sign(payload, reversedHS256, key)
+	if !assert.NoError(t, err, "Sign with a registered algorithm should succeed") {
+		return
+	}
+
+	verified, err := Verify(buf, reversedHS256, key)
+	if !assert.NoError(t, err, "Verify with a registered algorithm should succeed") {
+		return
+	}
+	if !assert.Equal(t, payload, verified, "Verified payload is the same") {
+		return
+	}
+
+	if _, err := Verify(buf, reversedHS256, []byte("wrong key")); !assert.Error(t, err, "Verify with the wrong key should fail") {
+		return
+	}
+
+	if _, err := Verify(buf, jwa.HS256, key); !assert.Error(t, err, "Verify with a different algorithm should fail") {
+		return
+	}
+
+	jwkkey := &jwk.SymmetricKey{
+		EssentialHeader: &jwk.EssentialHeader{
+			Algorithm: reversedHS256.String(),
+			KeyType:   jwa.OctetSeq,
+		},
+		Key: key,
+	}
+	verified, err = VerifyWithJWK(buf, &jwk.Set{Keys: []jwk.Key{jwkkey}})
+	if !assert.NoError(t, err, "VerifyWithJWK with a registered algorithm should succeed") {
+		return
+	}
+	if !assert.Equal(t, payload, verified, "Verified payload is the same") {
+		return
+	}
+
+	ms := NewMultiSign()
+	s, err := ms.AddSignerFor(reversedHS256, key)
+	if !assert.NoError(t, err, "AddSignerFor should succeed") {
+		return
+	}
+	s.PublicHeaders().Set("kid", "reversed")
+	if _, err := ms.AddSignerFor(jwa.HS256, key); !assert.NoError(t, err, "AddSignerFor should succeed") {
+		return
+	}
+
+	m, err := ms.Sign(payload)
+	if !assert.NoError(t, err, "MultiSign should succeed") {
+		return
+	}
+	if !assert.Len(t, m.Signatures, 2, "There should be 2 signatures") {
+		return
+	}
+	if !assert.Equal(t, reversedHS256, m.Signatures[0].ProtectedHeader.Algorithm, "alg matches") {
+		return
+	}
+
+	for _, alg := range []jwa.SignatureAlgorithm{reversedHS256, jwa.HS256} {
+		v, err := NewVerifier(alg, key)
+		if !assert.NoError(t, err, "NewVerifier should succeed") {
+			return
+		}
+		if !assert.NoError(t, v.Verify(m), "Verify should succeed for %s", alg) {
+			return
+		}
+	}
+
+	UnregisterAlgorithm(reversedHS256)
+	if _, err := Sign(payload, reversedHS256, key); !assert.Equal(t, ErrUnsupportedAlgorithm, err, "Sign with an unregistered algorithm should fail") {
+		return
+	}
+	if _, err := Verify(buf, reversedHS256, key); !assert.Equal(t, ErrUnsupportedAlgorithm, err, "Verify with an unregistered algorithm should fail") {
+		return
+	}
+}
+
+func TestSign_KeyTypeMismatch(t *testing.T) {
+	if _, err := Sign([]byte("Hello, World!"), jwa.RS256, []byte("Avracadabra")); !assert.Error(t, err, "Sign with the wrong type of key should fail") {
+		return
+	}
+	if _, err := Verify([]byte(exampleCompactSerialization), jwa.ES256, []byte("Avracadabra")); !assert.Error(t, err, "Verify with the wrong type of key should fail") {
+		return
+	}
+}
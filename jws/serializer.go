@@ -1,8 +1,10 @@
 package jws
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"unicode/utf8"
 
 	"github.com/lestrrat/go-jwx/buffer"
 )
@@ -28,9 +30,20 @@ func (s CompactSerialize) Serialize(m *Message) ([]byte, error) {
 		return nil, err
 	}
 
-	b64payload, err := m.Payload.Base64Encode()
-	if err != nil {
-		return nil, err
+	var b64payload []byte
+	if !s.Detached {
+		if hdr.isUnencodedPayload() {
+			// RFC 7797 Section 5.2: the payload may not contain '.'
+			if bytes.IndexByte(m.Payload, '.') > -1 {
+				return nil, ErrInvalidUnencodedPayload
+			}
+			b64payload = m.Payload.Bytes()
+		} else {
+			b64payload, err = m.Payload.Base64Encode()
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 	b64signature, err := buffer.Buffer(signature.Signature).Base64Encode()
 	if err != nil {
@@ -43,8 +56,31 @@ func (s CompactSerialize) Serialize(m *Message) ([]byte, error) {
 
 // Serialize converts the mssage into a JWE JSON serialize format byte buffer
 func (s JSONSerialize) Serialize(m *Message) ([]byte, error) {
+	unencoded, err := m.isUnencodedPayload()
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := struct {
+		Payload    interface{} `json:"payload,omitempty"`
+		Signatures []Signature `json:"signatures"`
+	}{
+		Signatures: m.Signatures,
+	}
+
+	switch {
+	case s.Detached:
+	case unencoded:
+		if !utf8.Valid(m.Payload) {
+			return nil, ErrInvalidUnencodedPayload
+		}
+		proxy.Payload = string(m.Payload)
+	default:
+		proxy.Payload = m.Payload
+	}
+
 	if s.Pretty {
-		return json.MarshalIndent(m, "", "  ")
+		return json.MarshalIndent(proxy, "", "  ")
 	}
-	return json.Marshal(m)
-}
\ No newline at end of file
+	return json.Marshal(proxy)
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/lestrrat/go-jwx/buffer"
 	"github.com/lestrrat/go-jwx/internal/debug"
 	"github.com/lestrrat/go-jwx/jwa"
+	"golang.org/x/crypto/ed25519"
 )
 
 // NewSigner creates a new MultiSign object with the given PayloadSigners.
@@ -39,34 +40,32 @@ func (m *MultiSign) SignString(payload string) (*Message, error) {
 }
 
 // Sign takes a payload, and creates a JWS signed message.
+//
+// If the protected headers of a signer contain "b64": false, the payload
+// is signed as is, without base64 encoding it (RFC 7797). In that case
+// "b64" is added to the "crit" header automatically, and all signers
+// must agree on the value of "b64"
 func (m *MultiSign) Sign(payload []byte) (*Message, error) {
-	encoded, err := buffer.Buffer(payload).Base64Encode()
-	if err != nil {
-		return nil, err
-	}
-
 	msg := &Message{
 		Payload:    buffer.Buffer(payload),
 		Signatures: []Signature{},
 	}
 	for _, signer := range m.Signers {
-		protected, err := NewHeader().Merge(signer.PublicHeaders())
+		protected, err := signingHeader(signer)
 		if err != nil {
 			return nil, err
 		}
-		protected, err = protected.Merge(signer.ProtectedHeaders())
+
+		protbuf, err := protected.Base64Encode()
 		if err != nil {
 			return nil, err
 		}
-		protected.Algorithm = signer.SignatureAlgorithm()
 
-		protbuf, err := protected.Base64Encode()
+		siv, err := signingInput(protected, protbuf, msg.Payload)
 		if err != nil {
 			return nil, err
 		}
 
-		siv := append(append(protbuf, '.'), encoded...)
-
 		sigbuf, err := signer.PayloadSign(siv)
 		if err != nil {
 			return nil, err
@@ -98,14 +97,48 @@ func (m *MultiSign) Sign(payload []byte) (*Message, error) {
 		msg.Signatures = append(msg.Signatures, sig)
 	}
 
+	if _, err := msg.isUnencodedPayload(); err != nil {
+		return nil, err
+	}
+
 	return msg, nil
 }
 
+// signingHeader creates the protected header that is used to sign
+// with `signer`
+func signingHeader(signer PayloadSigner) (*Header, error) {
+	protected, err := NewHeader().Merge(signer.PublicHeaders())
+	if err != nil {
+		return nil, err
+	}
+	protected, err = protected.Merge(signer.ProtectedHeaders())
+	if err != nil {
+		return nil, err
+	}
+	protected.Algorithm = signer.SignatureAlgorithm()
+	if _, ok := protected.PrivateParams["b64"]; ok && !isCritical(protected, "b64") {
+		protected.Critical = append(append([]string{}, protected.Critical...), "b64")
+	}
+	return protected, nil
+}
+
 // AddSigner takes a PayloadSigner and appends it to the list of signers
 func (m *MultiSign) AddSigner(s PayloadSigner) {
 	m.Signers = append(m.Signers, s)
 }
 
+// AddSignerFor creates a PayloadSigner for `alg` and `key` using the
+// factory registered via RegisterAlgorithm, and appends it to the
+// list of signers
+func (m *MultiSign) AddSignerFor(alg jwa.SignatureAlgorithm, key interface{}) (PayloadSigner, error) {
+	s, err := NewPayloadSigner(alg, key)
+	if err != nil {
+		return nil, err
+	}
+	m.AddSigner(s)
+	return s, nil
+}
+
 // NewRsaSign creates a signer that signs payloads using the given private key
 func NewRsaSign(alg jwa.SignatureAlgorithm, key *rsa.PrivateKey) (*RsaSign, error) {
 	switch alg {
@@ -163,7 +196,28 @@ func rsaHashForAlg(alg jwa.SignatureAlgorithm) (crypto.Hash, error) {
 // Sign generates a sign based on the Algorithm instance variable.
 // This fulfills the `Signer` interface
 func (s RsaSign) PayloadSign(payload []byte) ([]byte, error) {
-	hash, err := rsaHashForAlg(s.SignatureAlgorithm())
+	h, err := s.NewHash()
+	if err != nil {
+		return nil, err
+	}
+	h.Write(payload)
+	return s.SignHash(h)
+}
+
+// NewHash creates the hash used to calculate the digest of the signing
+// input. This fulfills the `HashSigner` interface
+func (s RsaSign) NewHash() (hash.Hash, error) {
+	hfunc, err := rsaHashForAlg(s.SignatureAlgorithm())
+	if err != nil {
+		return nil, ErrUnsupportedAlgorithm
+	}
+	return hfunc.New(), nil
+}
+
+// SignHash signs the digest of the signing input that has been written
+// to `h`. This fulfills the `HashSigner` interface
+func (s RsaSign) SignHash(h hash.Hash) ([]byte, error) {
+	hfunc, err := rsaHashForAlg(s.SignatureAlgorithm())
 	if err != nil {
 		return nil, ErrUnsupportedAlgorithm
 	}
@@ -173,14 +227,11 @@ func (s RsaSign) PayloadSign(payload []byte) ([]byte, error) {
 		return nil, ErrMissingPrivateKey
 	}
 
-	h := hash.New()
-	h.Write(payload)
-
 	switch s.SignatureAlgorithm() {
 	case jwa.RS256, jwa.RS384, jwa.RS512:
-		return rsa.SignPKCS1v15(rand.Reader, privkey, hash, h.Sum(nil))
+		return rsa.SignPKCS1v15(rand.Reader, privkey, hfunc, h.Sum(nil))
 	case jwa.PS256, jwa.PS384, jwa.PS512:
-		return rsa.SignPSS(rand.Reader, privkey, hash, h.Sum(nil), &rsa.PSSOptions{
+		return rsa.SignPSS(rand.Reader, privkey, hfunc, h.Sum(nil), &rsa.PSSOptions{
 			SaltLength: rsa.PSSSaltLengthAuto,
 		})
 	default:
@@ -244,7 +295,29 @@ func ecdsaHashForAlg(alg jwa.SignatureAlgorithm) (crypto.Hash, error) {
 // Sign generates a sign based on the Algorithm instance variable.
 // This fulfills the `PayloadSigner` interface
 func (sign EcdsaSign) PayloadSign(payload []byte) ([]byte, error) {
-	hash, err := ecdsaHashForAlg(sign.SignatureAlgorithm())
+	h, err := sign.NewHash()
+	if err != nil {
+		return nil, err
+	}
+	h.Write(payload)
+	debug.Printf("payload = %s", payload)
+	return sign.SignHash(h)
+}
+
+// NewHash creates the hash used to calculate the digest of the signing
+// input. This fulfills the `HashSigner` interface
+func (sign EcdsaSign) NewHash() (hash.Hash, error) {
+	hfunc, err := ecdsaHashForAlg(sign.SignatureAlgorithm())
+	if err != nil {
+		return nil, err
+	}
+	return hfunc.New(), nil
+}
+
+// SignHash signs the digest of the signing input that has been written
+// to `h`. This fulfills the `HashSigner` interface
+func (sign EcdsaSign) SignHash(h hash.Hash) ([]byte, error) {
+	hfunc, err := ecdsaHashForAlg(sign.SignatureAlgorithm())
 	if err != nil {
 		return nil, err
 	}
@@ -254,16 +327,14 @@ func (sign EcdsaSign) PayloadSign(payload []byte) ([]byte, error) {
 		return nil, errors.New("cannot proceed with Sign(): no private key available")
 	}
 
-	keysiz := hash.Size()
+	keysiz := hfunc.Size()
 	curveBits := privkey.Curve.Params().BitSize
 	if curveBits != keysiz*8 {
 		return nil, errors.New("key size does not match curve bit size")
 	}
 
-	h := hash.New()
-	h.Write(payload)
 	signed := h.Sum(nil)
-	debug.Printf("payload = %s, signed -> %x", payload, signed)
+	debug.Printf("signed -> %x", signed)
 
 	r, s, err := ecdsa.Sign(rand.Reader, privkey, signed)
 	if err != nil {
@@ -315,11 +386,24 @@ func hmacHashForAlg(alg jwa.SignatureAlgorithm) (func() hash.Hash, error) {
 }
 
 func (s HmacSign) PayloadSign(payload []byte) ([]byte, error) {
-	hfunc := s.hash
-	h := hmac.New(hfunc, s.Key)
+	h, err := s.NewHash()
+	if err != nil {
+		return nil, err
+	}
 	h.Write(payload)
-	b := h.Sum(nil)
-	return b, nil
+	return s.SignHash(h)
+}
+
+// NewHash creates the HMAC used to calculate the signature.
+// This fulfills the `HashSigner` interface
+func (s HmacSign) NewHash() (hash.Hash, error) {
+	return hmac.New(s.hash, s.Key), nil
+}
+
+// SignHash returns the MAC of the signing input that has been written
+// to `h`. This fulfills the `HashSigner` interface
+func (s HmacSign) SignHash(h hash.Hash) ([]byte, error) {
+	return h.Sum(nil), nil
 }
 
 func (s HmacSign) SignatureAlgorithm() jwa.SignatureAlgorithm {
@@ -341,3 +425,53 @@ func (s *HmacSign) SetPublicHeaders(h *Header) {
 func (s *HmacSign) SetProtectedHeaders(h *Header) {
 	s.Protected = h
 }
+
+// NewEdDSASign creates a signer that signs payloads using the given
+// Ed25519 private key
+func NewEdDSASign(alg jwa.SignatureAlgorithm, key ed25519.PrivateKey) (*EdDSASign, error) {
+	if alg != jwa.EdDSA {
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, ErrMissingPrivateKey
+	}
+
+	pubhdr := NewHeader()
+	protectedhdr := NewHeader()
+	protectedhdr.Algorithm = alg
+	return &EdDSASign{
+		PrivateKey: key,
+		Protected:  protectedhdr,
+		Public:     pubhdr,
+	}, nil
+}
+
+func (s EdDSASign) SignatureAlgorithm() jwa.SignatureAlgorithm {
+	return s.Protected.Algorithm
+}
+
+func (s EdDSASign) PublicHeaders() *Header {
+	return s.Public
+}
+
+func (s EdDSASign) ProtectedHeaders() *Header {
+	return s.Protected
+}
+
+func (s *EdDSASign) SetPublicHeaders(h *Header) {
+	s.Public = h
+}
+
+func (s *EdDSASign) SetProtectedHeaders(h *Header) {
+	s.Protected = h
+}
+
+// PayloadSign generates the signature for the given payload.
+// This fulfills the `PayloadSigner` interface
+func (s EdDSASign) PayloadSign(payload []byte) ([]byte, error) {
+	if len(s.PrivateKey) != ed25519.PrivateKeySize {
+		return nil, ErrMissingPrivateKey
+	}
+	return ed25519.Sign(s.PrivateKey, payload), nil
+}
@@ -0,0 +1,306 @@
+package jws
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/lestrrat/go-jwx/buffer"
+	"github.com/lestrrat/go-jwx/internal/streamutil"
+	"github.com/lestrrat/go-jwx/jwa"
+)
+
+const (
+	// maxStreamHeaderSize is the maximum size of the (base64url encoded)
+	// protected header that VerifyStream reads into memory
+	maxStreamHeaderSize = 1024 * 1024
+	// maxStreamSignatureSize is the maximum size of the (base64url
+	// encoded) signature that VerifyStream reads into memory
+	maxStreamSignatureSize = 8 * 1024
+)
+
+// SignStream is the same as Sign, but it reads the payload from `src`,
+// and writes the JWS message in compact serialization to `dst`. The
+// payload is never held in memory in its entirety, as long as the signer
+// for `alg` implements HashSigner (all algorithms except for EdDSA do).
+// Otherwise the signing input is buffered in memory.
+func SignStream(dst io.Writer, src io.Reader, alg jwa.SignatureAlgorithm, key interface{}, hdrs ...*Header) error {
+	signer, err := newSignerWithHeaders(alg, key, hdrs)
+	if err != nil {
+		return err
+	}
+
+	return signStream(dst, src, signer, false)
+}
+
+// SignStreamDetached is the same as SignStream, but the payload is not
+// included in the result, i.e. the JWS message is returned in the
+// "header..signature" form. Use VerifyStreamDetached or VerifyDetached
+// to verify it.
+func SignStreamDetached(src io.Reader, alg jwa.SignatureAlgorithm, key interface{}, hdrs ...*Header) ([]byte, error) {
+	signer, err := newSignerWithHeaders(alg, key, hdrs)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := signStream(&buf, src, signer, true); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func signStream(dst io.Writer, src io.Reader, signer PayloadSigner, detached bool) error {
+	protected, err := signingHeader(signer)
+	if err != nil {
+		return err
+	}
+
+	hdrbuf, err := protected.Base64Encode()
+	if err != nil {
+		return err
+	}
+
+	siv, sign := newStreamSigner(signer)
+	siv.Write(hdrbuf)
+	siv.Write([]byte{'.'})
+
+	if _, err := dst.Write(append(hdrbuf, '.')); err != nil {
+		return err
+	}
+
+	out := siv
+	if !detached {
+		out = io.MultiWriter(siv, dst)
+	}
+
+	if protected.isUnencodedPayload() {
+		if !detached {
+			// RFC 7797 Section 5.2: the payload may not contain '.'
+			out = dotRejectWriter{out}
+		}
+		if _, err := io.Copy(out, src); err != nil {
+			return err
+		}
+	} else {
+		enc := base64.NewEncoder(base64.RawURLEncoding, out)
+		if _, err := io.Copy(enc, src); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+	}
+
+	signature, err := sign()
+	if err != nil {
+		return err
+	}
+
+	sigbuf, err := buffer.Buffer(signature).Base64Encode()
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(append([]byte{'.'}, sigbuf...))
+	return err
+}
+
+// VerifyStream is the same as Verify, but it reads the JWS message in
+// compact serialization from `src`, and writes the payload to `dst`.
+//
+// The payload is written to `dst` as it is being read, i.e. BEFORE the
+// signature has been verified. You must discard whatever has been written
+// to `dst` unless VerifyStream returns a nil error.
+//
+// The payload is never held in memory in its entirety, except for EdDSA:
+// Ed25519 signatures can not be verified incrementally, so the entire
+// signing input is buffered in memory. The protected header and the
+// signature are read into memory, and VerifyStream fails if they are
+// larger than 1 MiB and 8 KiB respectively.
+func VerifyStream(dst io.Writer, src io.Reader, alg jwa.SignatureAlgorithm, key interface{}, options ...VerifyOption) error {
+	r := bufio.NewReader(src)
+
+	hdrbuf, err := streamutil.ReadBytes(r, '.', maxStreamHeaderSize)
+	if err != nil {
+		if err == io.EOF {
+			return ErrInvalidCompactPartsCount
+		}
+		return err
+	}
+	hdrbuf = bytes.TrimSpace(hdrbuf[:len(hdrbuf)-1])
+
+	decoded, err := buffer.FromBase64(hdrbuf)
+	if err != nil {
+		return err
+	}
+	protected := NewHeader()
+	if err := json.Unmarshal(decoded.Bytes(), protected); err != nil {
+		return err
+	}
+
+	v, err := newStreamVerifyPayloadVerifier(alg, key, protected, nil, options)
+	if err != nil {
+		return err
+	}
+
+	siv, verify := newStreamVerifier(v)
+	siv.Write(hdrbuf)
+	siv.Write([]byte{'.'})
+
+	payload := streamutil.NewSegmentReader(r)
+	tee := io.TeeReader(payload, siv)
+	if protected.isUnencodedPayload() {
+		_, err = io.Copy(dst, tee)
+	} else {
+		_, err = io.Copy(dst, base64.NewDecoder(base64.RawURLEncoding, tee))
+	}
+	if err != nil {
+		return err
+	}
+	if !payload.Found() {
+		return ErrInvalidCompactPartsCount
+	}
+
+	sigbuf, err := streamutil.ReadAll(r, maxStreamSignatureSize)
+	if err != nil {
+		return err
+	}
+	sigbuf = bytes.TrimSpace(sigbuf)
+	if bytes.IndexByte(sigbuf, '.') > -1 {
+		return ErrInvalidCompactPartsCount
+	}
+
+	signature, err := buffer.FromBase64(sigbuf)
+	if err != nil {
+		return err
+	}
+
+	return verify(signature.Bytes())
+}
+
+// VerifyStreamDetached is the same as VerifyDetached, but it reads the
+// detached payload from `payload`. `buf` must contain exactly one
+// signature.
+func VerifyStreamDetached(buf []byte, payload io.Reader, alg jwa.SignatureAlgorithm, key interface{}, options ...VerifyOption) error {
+	m, err := parseDetached(buf, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(m.Signatures) != 1 {
+		return errors.New("streaming verification requires exactly one signature")
+	}
+	sig := m.Signatures[0]
+	if sig.ProtectedHeader == nil || sig.ProtectedHeader.Header == nil {
+		return errors.New("missing protected header")
+	}
+
+	v, err := newStreamVerifyPayloadVerifier(alg, key, sig.ProtectedHeader.Header, sig.PublicHeader, options)
+	if err != nil {
+		return err
+	}
+
+	var hdrbuf []byte
+	if sig.ProtectedHeader.Source.Len() > 0 {
+		hdrbuf, err = sig.ProtectedHeader.Source.Base64Encode()
+	} else {
+		hdrbuf, err = sig.ProtectedHeader.Base64Encode()
+	}
+	if err != nil {
+		return err
+	}
+
+	siv, verify := newStreamVerifier(v)
+	siv.Write(hdrbuf)
+	siv.Write([]byte{'.'})
+
+	if sig.ProtectedHeader.isUnencodedPayload() {
+		if _, err := io.Copy(siv, payload); err != nil {
+			return err
+		}
+	} else {
+		enc := base64.NewEncoder(base64.RawURLEncoding, siv)
+		if _, err := io.Copy(enc, payload); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+	}
+
+	return verify(sig.Signature.Bytes())
+}
+
+// newStreamVerifyPayloadVerifier applies the same checks that Verify
+// does on a message before creating a PayloadVerifier for `alg` and `key`
+func newStreamVerifyPayloadVerifier(alg jwa.SignatureAlgorithm, key interface{}, protected, public *Header, options []VerifyOption) (PayloadVerifier, error) {
+	if !newVerifyOptions(options).isAllowed(alg) {
+		return nil, ErrAlgorithmNotAllowed
+	}
+
+	if alg == jwa.NoSignature {
+		return nil, errors.New("streaming verification of unsecured messages is not supported")
+	}
+
+	if protected.Algorithm != alg {
+		return nil, errors.New("algorithm in the protected header does not match")
+	}
+
+	if err := checkCritical(protected, public); err != nil {
+		return nil, err
+	}
+
+	if err := checkKeyAlgorithm(alg, key); err != nil {
+		return nil, err
+	}
+
+	return newPayloadVerifier(alg, key)
+}
+
+// newStreamSigner returns a writer to which the signing input should be
+// written, and a function that computes the signature once all of the
+// signing input has been written
+func newStreamSigner(s PayloadSigner) (io.Writer, func() ([]byte, error)) {
+	if hs, ok := s.(HashSigner); ok {
+		h, err := hs.NewHash()
+		if err != nil {
+			return ioutil.Discard, func() ([]byte, error) { return nil, err }
+		}
+		return h, func() ([]byte, error) { return hs.SignHash(h) }
+	}
+
+	var buf bytes.Buffer
+	return &buf, func() ([]byte, error) { return s.PayloadSign(buf.Bytes()) }
+}
+
+// newStreamVerifier returns a writer to which the signing input should be
+// written, and a function that verifies the signature once all of the
+// signing input has been written
+func newStreamVerifier(v PayloadVerifier) (io.Writer, func([]byte) error) {
+	if hv, ok := v.(HashVerifier); ok {
+		h, err := hv.NewHash()
+		if err != nil {
+			return ioutil.Discard, func([]byte) error { return err }
+		}
+		return h, func(signature []byte) error { return hv.VerifyHash(h, signature) }
+	}
+
+	var buf bytes.Buffer
+	return &buf, func(signature []byte) error { return v.PayloadVerify(buf.Bytes(), signature) }
+}
+
+// dotRejectWriter fails when a '.' is written to it
+type dotRejectWriter struct {
+	io.Writer
+}
+
+func (w dotRejectWriter) Write(p []byte) (int, error) {
+	if bytes.IndexByte(p, '.') > -1 {
+		return 0, ErrInvalidUnencodedPayload
+	}
+	return w.Writer.Write(p)
+}
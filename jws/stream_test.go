@@ -0,0 +1,188 @@
+package jws
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/lestrrat/go-jwx/internal/streamutil"
+	"github.com/lestrrat/go-jwx/jwa"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+// onlyReader hides any other interface (e.g. io.WriterTo) that the
+// underlying reader implements, so that the data is read in chunks
+type onlyReader struct {
+	io.Reader
+}
+
+func TestStream_Roundtrip(t *testing.T) {
+	payload := make([]byte, 1024*1024+3)
+	if _, err := rand.Read(payload); !assert.NoError(t, err, "payload generated") {
+		return
+	}
+
+	rsakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "RSA key generated") {
+		return
+	}
+	ecdsakey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err, "ECDSA key generated") {
+		return
+	}
+	edpub, edpriv, err := ed25519.GenerateKey(rand.Reader)
+	if !assert.NoError(t, err, "Ed25519 key generated") {
+		return
+	}
+
+	data := []struct {
+		alg     jwa.SignatureAlgorithm
+		signkey interface{}
+		verkey  interface{}
+	}{
+		{jwa.HS256, []byte("secret"), []byte("secret")},
+		{jwa.RS256, rsakey, &rsakey.PublicKey},
+		{jwa.PS384, rsakey, &rsakey.PublicKey},
+		{jwa.ES256, ecdsakey, &ecdsakey.PublicKey},
+		{jwa.EdDSA, edpriv, edpub}, // not a HashSigner, so it's buffered
+	}
+
+	for _, d := range data {
+		t.Run(d.alg.String(), func(t *testing.T) {
+			var signed bytes.Buffer
+			if !assert.NoError(t, SignStream(&signed, onlyReader{bytes.NewReader(payload)}, d.alg, d.signkey), "SignStream is successful") {
+				return
+			}
+
+			verified, err := Verify(signed.Bytes(), d.alg, d.verkey)
+			if !assert.NoError(t, err, "Verify is successful") {
+				return
+			}
+			if !assert.Equal(t, payload, verified, "payload matches") {
+				return
+			}
+
+			var out bytes.Buffer
+			if !assert.NoError(t, VerifyStream(&out, onlyReader{bytes.NewReader(signed.Bytes())}, d.alg, d.verkey), "VerifyStream is successful") {
+				return
+			}
+			if !assert.Equal(t, payload, out.Bytes(), "payload matches") {
+				return
+			}
+
+			buf, err := Sign(payload, d.alg, d.signkey)
+			if !assert.NoError(t, err, "Sign is successful") {
+				return
+			}
+			out.Reset()
+			if !assert.NoError(t, VerifyStream(&out, bytes.NewReader(buf), d.alg, d.verkey), "VerifyStream is successful") {
+				return
+			}
+			if !assert.Equal(t, payload, out.Bytes(), "payload matches") {
+				return
+			}
+
+			detached, err := SignStreamDetached(onlyReader{bytes.NewReader(payload)}, d.alg, d.signkey)
+			if !assert.NoError(t, err, "SignStreamDetached is successful") {
+				return
+			}
+			if !assert.Contains(t, string(detached), "..", "payload is detached") {
+				return
+			}
+			if !assert.NoError(t, VerifyStreamDetached(detached, onlyReader{bytes.NewReader(payload)}, d.alg, d.verkey), "VerifyStreamDetached is successful") {
+				return
+			}
+			if !assert.NoError(t, VerifyDetached(detached, payload, d.alg, d.verkey), "VerifyDetached is successful") {
+				return
+			}
+		})
+	}
+}
+
+func TestStream_Tampered(t *testing.T) {
+	key := []byte("secret")
+	payload := bytes.Repeat([]byte("Lorem ipsum "), 10000)
+
+	var signed bytes.Buffer
+	if !assert.NoError(t, SignStream(&signed, bytes.NewReader(payload), jwa.HS256, key), "SignStream is successful") {
+		return
+	}
+
+	tampered := append([]byte{}, signed.Bytes()...)
+	i := bytes.IndexByte(tampered, '.') + 100
+	tampered[i] ^= 0x01
+	if !assert.Error(t, VerifyStream(ioutil.Discard, bytes.NewReader(tampered), jwa.HS256, key), "VerifyStream should fail") {
+		return
+	}
+
+	if !assert.Error(t, VerifyStream(ioutil.Discard, bytes.NewReader(signed.Bytes()), jwa.HS384, key), "VerifyStream should fail with the wrong algorithm") {
+		return
+	}
+
+	parts := bytes.Split(signed.Bytes(), []byte{'.'})
+	if !assert.Equal(t, ErrInvalidCompactPartsCount, VerifyStream(ioutil.Discard, bytes.NewReader(bytes.Join(parts[:2], []byte{'.'})), jwa.HS256, key), "VerifyStream should fail with missing parts") {
+		return
+	}
+
+	// The header and the signature are read into memory, so their size
+	// is limited
+	if !assert.Equal(t, streamutil.ErrTooLarge, VerifyStream(ioutil.Discard, bytes.NewReader(bytes.Repeat([]byte{'A'}, maxStreamHeaderSize+1)), jwa.HS256, key), "VerifyStream should fail with a huge header") {
+		return
+	}
+	huge := append(append([]byte{}, signed.Bytes()...), bytes.Repeat([]byte{'A'}, maxStreamSignatureSize)...)
+	if !assert.Equal(t, streamutil.ErrTooLarge, VerifyStream(ioutil.Discard, bytes.NewReader(huge), jwa.HS256, key), "VerifyStream should fail with a huge signature") {
+		return
+	}
+
+	detached, err := SignStreamDetached(bytes.NewReader(payload), jwa.HS256, key)
+	if !assert.NoError(t, err, "SignStreamDetached is successful") {
+		return
+	}
+	if !assert.Error(t, VerifyStreamDetached(detached, bytes.NewReader(payload[1:]), jwa.HS256, key), "VerifyStreamDetached should fail") {
+		return
+	}
+}
+
+func TestStream_UnencodedPayload(t *testing.T) {
+	key := []byte("secret")
+	payload := []byte("$.02")
+
+	protected := NewHeader()
+	protected.Set("b64", false)
+
+	detached, err := SignStreamDetached(bytes.NewReader(payload), jwa.HS256, key, nil, protected)
+	if !assert.NoError(t, err, "SignStreamDetached is successful") {
+		return
+	}
+
+	// Must be the same as the non-streaming version
+	if !assert.NoError(t, VerifyDetached(detached, payload, jwa.HS256, key), "VerifyDetached is successful") {
+		return
+	}
+	if !assert.NoError(t, VerifyStreamDetached(detached, bytes.NewReader(payload), jwa.HS256, key), "VerifyStreamDetached is successful") {
+		return
+	}
+
+	// "$.02" can not be used in compact serialization
+	if !assert.Equal(t, ErrInvalidUnencodedPayload, SignStream(ioutil.Discard, bytes.NewReader(payload), jwa.HS256, key, nil, protected), "SignStream should fail") {
+		return
+	}
+
+	var signed bytes.Buffer
+	if !assert.NoError(t, SignStream(&signed, bytes.NewReader([]byte("hello")), jwa.HS256, key, nil, protected), "SignStream is successful") {
+		return
+	}
+	var out bytes.Buffer
+	if !assert.NoError(t, VerifyStream(&out, bytes.NewReader(signed.Bytes()), jwa.HS256, key), "VerifyStream is successful") {
+		return
+	}
+	if !assert.Equal(t, "hello", out.String(), "payload matches") {
+		return
+	}
+}
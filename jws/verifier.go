@@ -5,24 +5,25 @@ import (
 	"crypto/hmac"
 	"crypto/rsa"
 	"errors"
+	"hash"
 	"math/big"
 
 	"github.com/lestrrat/go-jwx/internal/debug"
 	"github.com/lestrrat/go-jwx/jwa"
+	"golang.org/x/crypto/ed25519"
 )
 
-type payloadVerifier interface {
-	PayloadVerify([]byte, []byte) error
-}
-
-func doMessageVerify(alg jwa.SignatureAlgorithm, v payloadVerifier, m *Message) error {
+func doMessageVerify(alg jwa.SignatureAlgorithm, v PayloadVerifier, m *Message) error {
 	var err error
-	payload, err := m.Payload.Base64Encode()
-	if err != nil {
-		return err
-	}
+	var critErr error
 	for _, sig := range m.Signatures {
-		if sig.ProtectedHeader.Algorithm != alg {
+		if sig.ProtectedHeader == nil || sig.ProtectedHeader.Algorithm != alg {
+			continue
+		}
+
+		if err := checkCritical(sig.ProtectedHeader.Header, sig.PublicHeader); err != nil {
+			debug.Printf("Critical header check failed: %s", err)
+			critErr = err
 			continue
 		}
 
@@ -38,7 +39,10 @@ func doMessageVerify(alg jwa.SignatureAlgorithm, v payloadVerifier, m *Message)
 				continue
 			}
 		}
-		siv := append(append(phbuf, '.'), payload...)
+		siv, err := signingInput(sig.ProtectedHeader.Header, phbuf, m.Payload)
+		if err != nil {
+			continue
+		}
 
 		debug.Printf("siv = '%s'", siv)
 		if err := v.PayloadVerify(siv, sig.Signature.Bytes()); err != nil {
@@ -49,6 +53,9 @@ func doMessageVerify(alg jwa.SignatureAlgorithm, v payloadVerifier, m *Message)
 		return nil
 	}
 
+	if critErr != nil {
+		return critErr
+	}
 	return errors.New("none of the signatures could be verified")
 }
 
@@ -72,10 +79,26 @@ func NewRsaVerify(alg jwa.SignatureAlgorithm, key *rsa.PublicKey) (*RsaVerify, e
 }
 
 func (v RsaVerify) PayloadVerify(payload, signature []byte) error {
+	h, err := v.NewHash()
+	if err != nil {
+		return err
+	}
+	h.Write(payload)
+	return v.VerifyHash(h, signature)
+}
+
+// NewHash creates the hash used to calculate the digest of the signing
+// input. This fulfills the `HashVerifier` interface
+func (v RsaVerify) NewHash() (hash.Hash, error) {
+	return v.hash.New(), nil
+}
+
+// VerifyHash verifies `signature` against the digest of the signing
+// input that has been written to `h`. This fulfills the `HashVerifier`
+// interface
+func (v RsaVerify) VerifyHash(h hash.Hash, signature []byte) error {
 	pubkey := v.pubkey
 	hfunc := v.hash
-	h := hfunc.New()
-	h.Write(payload)
 
 	var err error
 	switch v.alg {
@@ -123,9 +146,27 @@ func (v EcdsaVerify) Verify(m *Message) error {
 }
 
 func (v EcdsaVerify) PayloadVerify(payload, signature []byte) error {
+	h, err := v.NewHash()
+	if err != nil {
+		return err
+	}
+	h.Write(payload)
+	debug.Printf("payload -> %s", payload)
+	return v.VerifyHash(h, signature)
+}
+
+// NewHash creates the hash used to calculate the digest of the signing
+// input. This fulfills the `HashVerifier` interface
+func (v EcdsaVerify) NewHash() (hash.Hash, error) {
+	return v.hash.New(), nil
+}
+
+// VerifyHash verifies `signature` against the digest of the signing
+// input that has been written to `h`. This fulfills the `HashVerifier`
+// interface
+func (v EcdsaVerify) VerifyHash(h hash.Hash, signature []byte) error {
 	pubkey := v.pubkey
-	hfunc := v.hash
-	keysiz := hfunc.Size()
+	keysiz := v.hash.Size()
 	if len(signature) != 2*keysiz {
 		return ErrInvalidEcdsaSignatureSize
 	}
@@ -133,11 +174,9 @@ func (v EcdsaVerify) PayloadVerify(payload, signature []byte) error {
 	rv := (&big.Int{}).SetBytes(signature[:keysiz])
 	sv := (&big.Int{}).SetBytes(signature[keysiz:])
 
-	h := hfunc.New()
-	h.Write(payload)
 	signed := h.Sum(nil)
 
-	debug.Printf("payload -> %s, signed -> %x", payload, signed)
+	debug.Printf("signed -> %x", signed)
 
 	if !ecdsa.Verify(pubkey, signed, rv, sv) {
 		return ErrInvalidSignature
@@ -145,6 +184,31 @@ func (v EcdsaVerify) PayloadVerify(payload, signature []byte) error {
 	return nil
 }
 
+func NewEdDSAVerify(alg jwa.SignatureAlgorithm, key ed25519.PublicKey) (*EdDSAVerify, error) {
+	if alg != jwa.EdDSA {
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	if len(key) != ed25519.PublicKeySize {
+		return nil, ErrMissingPublicKey
+	}
+
+	return &EdDSAVerify{pubkey: key}, nil
+}
+
+// Verify checks that signature generated for `payload` matches `signature`.
+// This fulfills the `Verifier` interface
+func (v EdDSAVerify) Verify(m *Message) error {
+	return doMessageVerify(jwa.EdDSA, v, m)
+}
+
+func (v EdDSAVerify) PayloadVerify(payload, signature []byte) error {
+	if !ed25519.Verify(v.pubkey, payload, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
 type HmacVerify struct {
 	signer *HmacSign
 }
@@ -164,7 +228,24 @@ func (v HmacVerify) Verify(m *Message) error {
 }
 
 func (v HmacVerify) PayloadVerify(payload, mac []byte) error {
-	expected, err := v.signer.PayloadSign(payload)
+	h, err := v.NewHash()
+	if err != nil {
+		return err
+	}
+	h.Write(payload)
+	return v.VerifyHash(h, mac)
+}
+
+// NewHash creates the HMAC used to calculate the expected signature.
+// This fulfills the `HashVerifier` interface
+func (v HmacVerify) NewHash() (hash.Hash, error) {
+	return v.signer.NewHash()
+}
+
+// VerifyHash compares `mac` against the MAC of the signing input that
+// has been written to `h`. This fulfills the `HashVerifier` interface
+func (v HmacVerify) VerifyHash(h hash.Hash, mac []byte) error {
+	expected, err := v.signer.SignHash(h)
 	if err != nil {
 		return err
 	}
@@ -3,6 +3,8 @@ package jwt
 import (
 	"encoding/json"
 	"log"
+
+	"github.com/lestrrat/go-jwx/jwa"
 )
 
 func ExampleClaimSet() {
@@ -22,3 +24,30 @@ func ExampleClaimSet() {
 	log.Printf("aud     -> '%v'", c.Get("aud").([]string))
 	log.Printf("private -> '%s'", c.Get("https://github.com/lestrrat").(string))
 }
+
+func ExampleSign() {
+	c := NewClaimSet()
+	c.Set("sub", "123456789")
+	c.Set("aud", "foo")
+
+	sharedkey := []byte("Avracadabra")
+	token, err := Sign(c, jwa.HS256, sharedkey)
+	if err != nil {
+		log.Printf("failed to sign claims: %s", err)
+		return
+	}
+
+	verified, err := Parse(token, WithVerify(jwa.HS256, sharedkey))
+	if err != nil {
+		log.Printf("failed to parse token: %s", err)
+		return
+	}
+
+	if err := verified.Validate(WithAudience("foo")); err != nil {
+		log.Printf("failed to validate token: %s", err)
+		return
+	}
+
+	log.Printf("sub -> '%s'", verified.Get("sub").(string))
+	log.Printf("aud -> '%v'", verified.Get("aud").([]string))
+}
@@ -3,32 +3,99 @@ package jwt
 import (
 	"errors"
 	"time"
+
+	"github.com/lestrrat/go-jwx/jwa"
+	"github.com/lestrrat/go-jwx/jwk"
 )
 
-// NumericDate represents the date format used in the 'nbf' claim
+// NumericDate represents the date format used in the 'exp', 'iat' and
+// 'nbf' claims. It is encoded as a JSON number representing the seconds
+// since the epoch, which may contain a fractional part.
+// See https://tools.ietf.org/html/rfc7519#section-2
 type NumericDate struct {
 	time.Time
 }
 
-// ErrInvalidValue is returned when an invalid type is passed to
-// a known claim (i.e. those defined in EssentialClaims
-var ErrInvalidValue = errors.New("invalid value for key")
+var (
+	// ErrInvalidValue is returned when an invalid type is passed to
+	// a known claim (i.e. those defined in EssentialClaims
+	ErrInvalidValue = errors.New("invalid value for key")
+	// ErrMissingVerification is returned by Parse when neither a key
+	// nor a key set to verify the token with was given
+	ErrMissingVerification = errors.New("no key specified to verify the token")
+	// ErrNotNestedJWT is returned by Parse when the decrypted JWE
+	// message does not declare a nested JWT in its 'cty' header
+	ErrNotNestedJWT = errors.New("encrypted token does not contain a nested JWT ('cty' header must be \"JWT\")")
+
+	// The following errors are returned by ClaimSet.Validate, so that
+	// callers can tell exactly which check the claim set failed
+	ErrTokenExpired        = errors.New("token is expired ('exp' check failed)")
+	ErrTokenNotYetValid    = errors.New("token is not valid yet ('nbf' check failed)")
+	ErrTokenIssuedInFuture = errors.New("token is issued in the future ('iat' check failed)")
+	ErrTokenTooOld         = errors.New("token is too old ('iat' check failed)")
+	ErrMissingIssuedAt     = errors.New("token does not have an 'iat' claim")
+	ErrInvalidIssuer       = errors.New("'iss' claim does not match")
+	ErrInvalidAudience     = errors.New("'aud' claim does not contain an accepted audience")
+	ErrInvalidSubject      = errors.New("'sub' claim does not match")
+)
 
+// numericDateFmt is the format that NumericDate used to be (incorrectly)
+// encoded in. It is only used to read values produced by older versions
 const numericDateFmt = "2006-01-02T15:04:05Z UTC"
 
 // EssentialClaims contains the set of known set of claims in JWT spec.
 type EssentialClaims struct {
 	Audience   []string     `json:"aud,omitempty"` // https://tools.ietf.org/html/rfc7519#section-4.1.3
-	Expiration int64        `json:"exp,omitempty"` // https://tools.ietf.org/html/rfc7519#section-4.1.4
-	IssuedAt   int64        `json:"iat,omitempty"` // https://tools.ietf.org/html/rfc7519#section-4.1.6
+	Expiration *NumericDate `json:"exp,omitempty"` // https://tools.ietf.org/html/rfc7519#section-4.1.4
+	IssuedAt   *NumericDate `json:"iat,omitempty"` // https://tools.ietf.org/html/rfc7519#section-4.1.6
 	Issuer     string       `json:"iss,omitempty"` // https://tools.ietf.org/html/rfc7519#section-4.1.1
-	JwtID      string       `json:"jtu,omitempty"` // https://tools.ietf.org/html/rfc7519#section-4.1.7
+	JwtID      string       `json:"jti,omitempty"` // https://tools.ietf.org/html/rfc7519#section-4.1.7
 	NotBefore  *NumericDate `json:"nbf,omitempty"` // https://tools.ietf.org/html/rfc7519#section-4.1.5
 	Subject    string       `json:"sub,omitempty"` // https://tools.ietf.org/html/rfc7519#section-4.1.2
 }
 
-// ClaimSet holds an arbitrary claim set
+// ClaimSet holds an arbitrary claim set.
+//
+// If CustomClaims is set to a pointer to a struct, the private claims
+// that match its fields (as determined by their json tags) are decoded
+// into and encoded from that struct, instead of PrivateClaims. Claims
+// that do not match any field are still stored in PrivateClaims.
+// The struct must not use the names of the claims in EssentialClaims.
 type ClaimSet struct {
 	*EssentialClaims `json:"-"`
 	PrivateClaims    map[string]interface{} `json:"-"`
+	CustomClaims     interface{}            `json:"-"`
+}
+
+// ParseOption specifies how Parse should verify the signature of a token
+type ParseOption func(*parseOptions)
+
+type parseOptions struct {
+	alg        jwa.SignatureAlgorithm
+	key        interface{}
+	keyset     *jwk.Set
+	decryptalg jwa.KeyEncryptionAlgorithm
+	decryptkey interface{}
+	custom     interface{}
+}
+
+// Clock is used by ClaimSet.Validate to determine the current time
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc is an adapter to allow ordinary functions to be used as a Clock
+type ClockFunc func() time.Time
+
+// ValidateOption specifies the checks that ClaimSet.Validate should
+// perform in addition to the time based ones
+type ValidateOption func(*validateOptions)
+
+type validateOptions struct {
+	audience []string
+	clock    Clock
+	issuer   string
+	maxAge   time.Duration
+	skew     time.Duration
+	subject  string
 }
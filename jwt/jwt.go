@@ -1,32 +1,338 @@
 // Package jwt implements JSON Web Tokens as described in https://tools.ietf.org/html/rfc7519
+//
+// If you just want to create and consume signed tokens, the only things
+// that you would need to use are the following functions:
+//
+//     jwt.Sign(claimset, algorithm, key)
+//     jwt.Parse(token, jwt.WithVerify(algorithm, key))
+//
+// Both are thin wrappers around the jws package, so the same types of
+// keys that jws.Sign and jws.Verify accept can be used here.
+//
+// Nested (signed, then encrypted) tokens are created with jwt.SignAndEncrypt,
+// and consumed by passing jwt.WithDecrypt to jwt.Parse in addition to the
+// verification option.
 package jwt
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lestrrat/go-jwx/internal/emap"
+	"github.com/lestrrat/go-jwx/jwa"
+	"github.com/lestrrat/go-jwx/jwe"
+	"github.com/lestrrat/go-jwx/jwk"
+	"github.com/lestrrat/go-jwx/jws"
 )
 
+// Sign generates a signed JWT in JWS compact serialization from the
+// given claim set, using `alg` and `key`. See jws.Sign for the type
+// of key required for each algorithm.
+func Sign(c *ClaimSet, alg jwa.SignatureAlgorithm, key interface{}) ([]byte, error) {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := jws.NewHeader()
+	hdr.Type = "JWT"
+	return jws.Sign(buf, alg, key, hdr)
+}
+
+// SignAndEncrypt generates a nested JWT: the claim set is first signed
+// using `sigalg` and `sigkey` as is done in Sign, and the resulting token
+// is then encrypted in JWE compact serialization using `keyalg`, `key`
+// and `contentalg` (see jwe.Encrypt). The "cty" header of the JWE
+// message is set to "JWT" to mark the payload as a nested JWT.
+func SignAndEncrypt(c *ClaimSet, sigalg jwa.SignatureAlgorithm, sigkey interface{}, keyalg jwa.KeyEncryptionAlgorithm, key interface{}, contentalg jwa.ContentEncryptionAlgorithm) ([]byte, error) {
+	signed, err := Sign(c, sigalg, sigkey)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := jwe.NewHeader()
+	hdr.ContentType = "JWT"
+	return jwe.Encrypt(signed, keyalg, key, contentalg, jwa.NoCompress, hdr)
+}
+
+// Parse verifies the signature of the given token, and creates a ClaimSet
+// from its payload. You must specify how to verify the token by passing
+// either WithVerify or WithKeySet, otherwise ErrMissingVerification
+// is returned.
+//
+// If WithDecrypt is given, the token is treated as a nested JWT: it is
+// decrypted first, and the inner token is verified as described above.
+func Parse(buf []byte, options ...ParseOption) (*ClaimSet, error) {
+	var o parseOptions
+	for _, option := range options {
+		option(&o)
+	}
+
+	if o.keyset == nil && o.key == nil {
+		return nil, ErrMissingVerification
+	}
+
+	if o.decryptkey != nil {
+		var err error
+		buf, err = decryptNested(buf, o.decryptalg, o.decryptkey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var payload []byte
+	var err error
+	switch {
+	case o.keyset != nil:
+		payload, err = jws.VerifyWithJWK(buf, o.keyset)
+	default:
+		payload, err = jws.Verify(buf, o.alg, o.key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewClaimSet()
+	c.CustomClaims = o.custom
+	if err := json.Unmarshal(payload, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// decryptNested decrypts the JWE message in `buf`, and returns the
+// nested JWT contained in it
+func decryptNested(buf []byte, alg jwa.KeyEncryptionAlgorithm, key interface{}) ([]byte, error) {
+	msg, err := jwe.Parse(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isNestedJWT(msg) {
+		return nil, ErrNotNestedJWT
+	}
+
+	return msg.Decrypt(alg, key)
+}
+
+// isNestedJWT checks if the "cty" header of the message is "JWT".
+// Only the protected header is consulted: the unprotected and the
+// per-recipient headers are not integrity protected, and could be
+// altered without invalidating the message
+func isNestedJWT(msg *jwe.Message) bool {
+	if msg.ProtectedHeader == nil || msg.ProtectedHeader.Header == nil {
+		return false
+	}
+
+	h := msg.ProtectedHeader.Header
+	if h.EssentialHeader == nil {
+		return false
+	}
+	// Media types are case insensitive (RFC 7519, section 5.2)
+	return strings.EqualFold(h.ContentType, "JWT")
+}
+
+// ParseString is the same as Parse, but takes a string
+func ParseString(s string, options ...ParseOption) (*ClaimSet, error) {
+	return Parse([]byte(s), options...)
+}
+
+// WithVerify specifies that the token should be verified using
+// `alg` and `key`, as is done in jws.Verify
+func WithVerify(alg jwa.SignatureAlgorithm, key interface{}) ParseOption {
+	return func(o *parseOptions) {
+		o.alg = alg
+		o.key = key
+	}
+}
+
+// WithKeySet specifies that the token should be verified using the
+// keys in the given JWK set, as is done in jws.VerifyWithJWK
+func WithKeySet(set *jwk.Set) ParseOption {
+	return func(o *parseOptions) {
+		o.keyset = set
+	}
+}
+
+// WithDecrypt specifies that the token is a nested JWT, which must
+// be decrypted using `alg` and `key` (as is done in jwe.Decrypt)
+// before its signature is verified
+func WithDecrypt(alg jwa.KeyEncryptionAlgorithm, key interface{}) ParseOption {
+	return func(o *parseOptions) {
+		o.decryptalg = alg
+		o.decryptkey = key
+	}
+}
+
+// WithCustomClaims specifies a pointer to a struct that the private
+// claims of the token should be decoded into. It is stored in the
+// CustomClaims field of the resulting ClaimSet
+func WithCustomClaims(v interface{}) ParseOption {
+	return func(o *parseOptions) {
+		o.custom = v
+	}
+}
+
+// NewNumericDate creates a new NumericDate from the given time
+func NewNumericDate(t time.Time) *NumericDate {
+	// Strip the monotonic clock reading and the location, so that
+	// values compare the same after a round trip through JSON
+	return &NumericDate{t.Round(0).UTC()}
+}
+
+// numericDateFromValue creates a NumericDate from the various types
+// that can be used to represent a date
+// audienceFromValue converts the value of the 'aud' claim, which is
+// either a single string or an array of strings, to a string slice.
+// JSON arrays are decoded as []interface{} by encoding/json
+func audienceFromValue(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case []string:
+		return v, nil
+	case []interface{}:
+		aud := make([]string, len(v))
+		for i, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, ErrInvalidValue
+			}
+			aud[i] = s
+		}
+		return aud, nil
+	default:
+		return nil, ErrInvalidValue
+	}
+}
+
+func numericDateFromValue(value interface{}) (*NumericDate, error) {
+	switch v := value.(type) {
+	case NumericDate:
+		return NewNumericDate(v.Time), nil
+	case *NumericDate:
+		if v == nil {
+			return nil, ErrInvalidValue
+		}
+		return NewNumericDate(v.Time), nil
+	case time.Time:
+		return NewNumericDate(v), nil
+	case int64:
+		return NewNumericDate(time.Unix(v, 0)), nil
+	case int:
+		return NewNumericDate(time.Unix(int64(v), 0)), nil
+	case float64:
+		// float64 is what encoding/json gives us for JSON numbers. It
+		// can't represent nanoseconds accurately, so round to microseconds
+		sec := math.Floor(v)
+		usec := math.Floor((v-sec)*1e6 + 0.5)
+		return NewNumericDate(time.Unix(int64(sec), int64(usec)*1000)), nil
+	case json.Number:
+		t, err := parseNumericDate(v.String())
+		if err != nil {
+			return nil, err
+		}
+		return NewNumericDate(t), nil
+	case string:
+		// Values encoded by older versions of this library
+		t, err := time.Parse(numericDateFmt, v)
+		if err != nil {
+			return nil, err
+		}
+		return NewNumericDate(t), nil
+	}
+	return nil, ErrInvalidValue
+}
+
+// parseNumericDate parses a JSON number literal into a time.Time,
+// without going through float64 so that fractional seconds are kept
+func parseNumericDate(s string) (time.Time, error) {
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		n, err := numericDateFromValue(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return n.Time, nil
+	}
+
+	intpart, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intpart, frac = s[:i], s[i+1:]
+	}
+
+	sec, err := strconv.ParseInt(intpart, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var nsec int64
+	if frac != "" {
+		if strings.Trim(frac, "0123456789") != "" {
+			return time.Time{}, fmt.Errorf("invalid numeric date '%s'", s)
+		}
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		frac += strings.Repeat("0", 9-len(frac))
+		nsec, _ = strconv.ParseInt(frac, 10, 64)
+		if strings.HasPrefix(intpart, "-") {
+			nsec = -nsec
+		}
+	}
+
+	return time.Unix(sec, nsec), nil
+}
+
+// String returns the string representation of this instant, as it
+// appears in JSON
+func (n NumericDate) String() string {
+	sec := n.Unix()
+	nsec := int64(n.Nanosecond())
+	if nsec == 0 {
+		return strconv.FormatInt(sec, 10)
+	}
+
+	sign := ""
+	if sec < 0 {
+		// Unix() rounds towards negative infinity, so -0.5 is
+		// represented as sec = -1, nsec = 500000000
+		sign = "-"
+		sec = -(sec + 1)
+		nsec = 1e9 - nsec
+	}
+	frac := strings.TrimRight(fmt.Sprintf("%09d", nsec), "0")
+	return sign + strconv.FormatInt(sec, 10) + "." + frac
+}
+
 // MarshalJSON generates JSON representation of this instant
 func (n NumericDate) MarshalJSON() ([]byte, error) {
-	return json.Marshal(n.UTC().Format(numericDateFmt))
+	return []byte(n.String()), nil
 }
 
 // UnmarshalJSON parses the JSON representation and initializes this NumericDate
 func (n *NumericDate) UnmarshalJSON(data []byte) error {
-	var s string
-	if err := json.Unmarshal(data, &s); err != nil {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
 		return err
 	}
 
-	t, err := time.Parse(numericDateFmt, s)
+	nd, err := numericDateFromValue(v)
 	if err != nil {
 		return err
 	}
 
-	*n = NumericDate{t}
+	*n = *nd
 	return nil
 }
 
@@ -43,18 +349,39 @@ func (c *ClaimSet) MarshalJSON() ([]byte, error) {
 	// Reverting time back for machines whose time is not perfectly in sync.
 	// If client machine's time is in the future according
 	// to Google servers, an access token will not be issued.
-	now := time.Now().Add(-10 * time.Second)
-	if c.IssuedAt == 0 {
-		c.IssuedAt = now.Unix()
+	now := time.Now().Add(-10 * time.Second).Truncate(time.Second)
+	if c.IssuedAt == nil {
+		c.IssuedAt = NewNumericDate(now)
 	}
-	if c.Expiration == 0 {
-		c.Expiration = now.Add(time.Hour).Unix()
+	if c.Expiration == nil {
+		c.Expiration = NewNumericDate(now.Add(time.Hour))
 	}
-	if c.Expiration < c.IssuedAt {
-		return nil, fmt.Errorf("invalid expiration = %v; must be later than issued_at = %v", c.Expiration, c.IssuedAt)
+	if c.Expiration.Before(c.IssuedAt.Time) {
+		return nil, fmt.Errorf("invalid expiration = %s; must be later than issued_at = %s", c.Expiration, c.IssuedAt)
+	}
+
+	private := c.PrivateClaims
+	if c.CustomClaims != nil {
+		buf, err := json.Marshal(c.CustomClaims)
+		if err != nil {
+			return nil, err
+		}
+
+		m := map[string]interface{}{}
+		if err := json.Unmarshal(buf, &m); err != nil {
+			return nil, err
+		}
+
+		// Values in CustomClaims take precedence over PrivateClaims
+		for k, v := range c.PrivateClaims {
+			if _, ok := m[k]; !ok {
+				m[k] = v
+			}
+		}
+		private = m
 	}
 
-	return emap.MergeMarshal(c.EssentialClaims, c.PrivateClaims)
+	return emap.MergeMarshal(c.EssentialClaims, private)
 }
 
 // UnmarshalJSON parses the JSON representation and initializes this ClaimSet
@@ -65,27 +392,87 @@ func (c *ClaimSet) UnmarshalJSON(data []byte) error {
 	if c.PrivateClaims == nil {
 		c.PrivateClaims = map[string]interface{}{}
 	}
-	return emap.MergeUnmarshal(data, c.EssentialClaims, &c.PrivateClaims)
+	if err := emap.MergeUnmarshal(data, c.EssentialClaims, &c.PrivateClaims); err != nil {
+		return err
+	}
+
+	if c.CustomClaims != nil {
+		if err := json.Unmarshal(data, c.CustomClaims); err != nil {
+			return err
+		}
+
+		// Whatever was decoded into CustomClaims should not appear
+		// in PrivateClaims as well. encoding/json matches the member
+		// names case-insensitively, so do the same here
+		names := emap.FieldNames(c.CustomClaims)
+		for k := range c.PrivateClaims {
+			for _, name := range names {
+				if strings.EqualFold(k, name) {
+					delete(c.PrivateClaims, k)
+					break
+				}
+			}
+		}
+	}
+	return nil
 }
 
 // Construct takes a map and initializes the essential claims with its values
 func (c *EssentialClaims) Construct(m map[string]interface{}) error {
 	r := emap.Hmap(m)
-	c.Audience, _ = r.GetStringSlice("aud")
-	c.Expiration, _ = r.GetInt64("exp")
-	c.IssuedAt, _ = r.GetInt64("iat")
-	c.Issuer, _ = r.GetString("iss")
-	c.JwtID, _ = r.GetString("jti")
-	if v, err := r.GetString("nbf"); err != nil {
-		if v != "" {
-			t, err := time.Parse(numericDateFmt, v)
-			if err != nil {
-				return err
-			}
-			c.NotBefore = &NumericDate{t}
+	if v, ok := r["aud"]; ok {
+		delete(r, "aud")
+
+		aud, err := audienceFromValue(v)
+		if err != nil {
+			return fmt.Errorf("invalid value for 'aud': %s", err)
+		}
+		c.Audience = aud
+	}
+
+	for _, name := range []string{"iss", "jti", "sub"} {
+		v, ok := r[name]
+		if !ok {
+			continue
+		}
+		delete(r, name)
+
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("invalid value for '%s': expected a string", name)
+		}
+
+		switch name {
+		case "iss":
+			c.Issuer = s
+		case "jti":
+			c.JwtID = s
+		case "sub":
+			c.Subject = s
+		}
+	}
+
+	for _, name := range []string{"exp", "iat", "nbf"} {
+		v, ok := r[name]
+		if !ok {
+			continue
+		}
+		delete(r, name)
+
+		n, err := numericDateFromValue(v)
+		if err != nil {
+			return fmt.Errorf("invalid value for '%s': %s", name, err)
+		}
+
+		switch name {
+		case "exp":
+			c.Expiration = n
+		case "iat":
+			c.IssuedAt = n
+		case "nbf":
+			c.NotBefore = n
 		}
 	}
-	c.Subject, _ = r.GetString("sub")
 	return nil
 }
 
@@ -122,30 +509,28 @@ func (c *ClaimSet) Get(key string) interface{} {
 // is asserted. Otherwise it is assumed to be a private claim as is.
 //
 // Set returns an error if a known essential claim name is used and its type
-// does not match with the type given in `value`.
+// does not match with the type given in `value`. The time based claims
+// ('exp', 'iat' and 'nbf') accept NumericDate, *NumericDate, time.Time,
+// and the number of seconds since the epoch as int, int64 or float64.
 // If you want to rely on compile time check for types, you should be
 // assigning values directly to the struct.
 func (c *ClaimSet) Set(key string, value interface{}) error {
 	switch key {
 	case "aud":
-		// for "aud", we allow either a string or a string slice
-		switch value.(type) {
-		case []string:
-			c.Audience = value.([]string)
-		case string:
-			c.Audience = []string{value.(string)}
-		default:
+		v, err := audienceFromValue(value)
+		if err != nil {
 			return ErrInvalidValue
 		}
+		c.Audience = v
 	case "exp":
-		v, ok := value.(int64)
-		if !ok {
+		v, err := numericDateFromValue(value)
+		if err != nil {
 			return ErrInvalidValue
 		}
 		c.Expiration = v
 	case "iat":
-		v, ok := value.(int64)
-		if !ok {
+		v, err := numericDateFromValue(value)
+		if err != nil {
 			return ErrInvalidValue
 		}
 		c.IssuedAt = v
@@ -162,17 +547,11 @@ func (c *ClaimSet) Set(key string, value interface{}) error {
 		}
 		c.JwtID = v
 	case "nbf":
-		switch value.(type) {
-		case NumericDate:
-			v := value.(NumericDate)
-			c.NotBefore = &NumericDate{v.Time}
-		case *NumericDate:
-			c.NotBefore = value.(*NumericDate)
-		case time.Time:
-			c.NotBefore = &NumericDate{value.(time.Time)}
-		default:
+		v, err := numericDateFromValue(value)
+		if err != nil {
 			return ErrInvalidValue
 		}
+		c.NotBefore = v
 	case "sub":
 		v, ok := value.(string)
 		if !ok {
@@ -0,0 +1,125 @@
+package jwt
+
+import "time"
+
+// Now returns the current time by calling the function itself
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// Validate checks the claim set against the current time, and optionally
+// against the expected values given in `options`.
+//
+// 'exp', 'nbf' and 'iat' are always checked if they are present in the
+// claim set. The other claims are only checked when the corresponding
+// option is given. The first check that fails determines the returned
+// error, which is one of the ErrToken*, ErrInvalid* or ErrMissing*
+// errors defined in this package.
+func (c *ClaimSet) Validate(options ...ValidateOption) error {
+	o := validateOptions{
+		clock: ClockFunc(time.Now),
+	}
+	for _, option := range options {
+		option(&o)
+	}
+
+	now := o.clock.Now()
+
+	if c.Expiration != nil {
+		// The current time MUST be before the expiration time
+		if !now.Before(c.Expiration.Add(o.skew)) {
+			return ErrTokenExpired
+		}
+	}
+
+	if c.NotBefore != nil {
+		if now.Add(o.skew).Before(c.NotBefore.Time) {
+			return ErrTokenNotYetValid
+		}
+	}
+
+	if c.IssuedAt != nil {
+		iat := c.IssuedAt.Time
+		if now.Add(o.skew).Before(iat) {
+			return ErrTokenIssuedInFuture
+		}
+
+		if o.maxAge > 0 && now.Sub(iat) > o.maxAge+o.skew {
+			return ErrTokenTooOld
+		}
+	} else if o.maxAge > 0 {
+		return ErrMissingIssuedAt
+	}
+
+	if o.issuer != "" && c.Issuer != o.issuer {
+		return ErrInvalidIssuer
+	}
+
+	if o.subject != "" && c.Subject != o.subject {
+		return ErrInvalidSubject
+	}
+
+	if len(o.audience) > 0 && !c.hasAudience(o.audience) {
+		return ErrInvalidAudience
+	}
+
+	return nil
+}
+
+func (c *ClaimSet) hasAudience(accepted []string) bool {
+	for _, aud := range c.Audience {
+		for _, v := range accepted {
+			if aud == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WithClock specifies the Clock used to determine the current time.
+// By default time.Now is used
+func WithClock(c Clock) ValidateOption {
+	return func(o *validateOptions) {
+		o.clock = c
+	}
+}
+
+// WithAcceptableSkew specifies the amount of clock skew that is tolerated
+// when checking the 'exp', 'nbf' and 'iat' claims
+func WithAcceptableSkew(d time.Duration) ValidateOption {
+	return func(o *validateOptions) {
+		o.skew = d
+	}
+}
+
+// WithIssuer specifies the value that the 'iss' claim must have
+func WithIssuer(s string) ValidateOption {
+	return func(o *validateOptions) {
+		o.issuer = s
+	}
+}
+
+// WithAudience specifies the audiences that are accepted. The 'aud'
+// claim must contain at least one of them
+func WithAudience(aud ...string) ValidateOption {
+	return func(o *validateOptions) {
+		o.audience = append(o.audience, aud...)
+	}
+}
+
+// WithSubject specifies the value that the 'sub' claim must have
+func WithSubject(s string) ValidateOption {
+	return func(o *validateOptions) {
+		o.subject = s
+	}
+}
+
+// WithMaxAge specifies how long after its 'iat' claim a token is still
+// considered valid. When this option is given, the 'iat' claim becomes
+// required
+func WithMaxAge(d time.Duration) ValidateOption {
+	return func(o *validateOptions) {
+		o.maxAge = d
+	}
+}
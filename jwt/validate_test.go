@@ -0,0 +1,116 @@
+package jwt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lestrrat/go-jwx/jwa"
+	"github.com/lestrrat/go-jwx/jws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate_Time(t *testing.T) {
+	now := time.Unix(1300819380, 0)
+	clock := WithClock(ClockFunc(func() time.Time { return now }))
+
+	c := NewClaimSet()
+	c.Set("iat", now.Add(-time.Hour).Unix())
+	c.Set("exp", now.Add(time.Minute).Unix())
+	c.Set("nbf", now.Add(-time.Minute))
+	if !assert.NoError(t, c.Validate(clock), "Validate should succeed") {
+		return
+	}
+
+	c.Set("exp", now.Unix())
+	if !assert.Equal(t, ErrTokenExpired, c.Validate(clock), "exp == now should be expired") {
+		return
+	}
+	if !assert.NoError(t, c.Validate(clock, WithAcceptableSkew(time.Second)), "exp within skew should succeed") {
+		return
+	}
+
+	c.Set("exp", now.Add(time.Hour).Unix())
+	c.Set("nbf", now.Add(time.Minute))
+	if !assert.Equal(t, ErrTokenNotYetValid, c.Validate(clock), "nbf in the future should fail") {
+		return
+	}
+	if !assert.NoError(t, c.Validate(clock, WithAcceptableSkew(2*time.Minute)), "nbf within skew should succeed") {
+		return
+	}
+
+	c.NotBefore = nil
+	if !assert.Equal(t, ErrTokenTooOld, c.Validate(clock, WithMaxAge(time.Minute)), "iat older than max age should fail") {
+		return
+	}
+
+	c.Set("iat", now.Add(time.Minute).Unix())
+	if !assert.Equal(t, ErrTokenIssuedInFuture, c.Validate(clock), "iat in the future should fail") {
+		return
+	}
+
+	c.IssuedAt = nil
+	if !assert.Equal(t, ErrMissingIssuedAt, c.Validate(clock, WithMaxAge(time.Minute)), "max age without iat should fail") {
+		return
+	}
+}
+
+func TestValidate_Claims(t *testing.T) {
+	c := NewClaimSet()
+	c.Set("iss", "joe")
+	c.Set("sub", "foobar@example.com")
+	c.Set("aud", []string{"foo", "bar"})
+
+	if !assert.NoError(t, c.Validate(WithIssuer("joe"), WithSubject("foobar@example.com"), WithAudience("baz", "bar")), "Validate should succeed") {
+		return
+	}
+
+	if !assert.Equal(t, ErrInvalidIssuer, c.Validate(WithIssuer("jane")), "wrong issuer should fail") {
+		return
+	}
+
+	if !assert.Equal(t, ErrInvalidSubject, c.Validate(WithSubject("jane@example.com")), "wrong subject should fail") {
+		return
+	}
+
+	if !assert.Equal(t, ErrInvalidAudience, c.Validate(WithAudience("baz")), "wrong audience should fail") {
+		return
+	}
+}
+
+func TestValidate_ParsedAudience(t *testing.T) {
+	sharedkey := []byte("Avracadabra")
+
+	c1 := NewClaimSet()
+	c1.Set("aud", []string{"foo", "bar"})
+	token, err := Sign(c1, jwa.HS256, sharedkey)
+	if !assert.NoError(t, err, "Sign should succeed") {
+		return
+	}
+
+	// RFC 7519 Section 4.1.3: 'aud' may also be a single string
+	single, err := jws.Sign([]byte(`{"aud":"foo"}`), jwa.HS256, sharedkey)
+	if !assert.NoError(t, err, "jws.Sign should succeed") {
+		return
+	}
+
+	for _, buf := range [][]byte{token, single} {
+		c2, err := Parse(buf, WithVerify(jwa.HS256, sharedkey))
+		if !assert.NoError(t, err, "Parse should succeed") {
+			return
+		}
+		if !assert.NoError(t, c2.Validate(WithAudience("foo")), "Validate should succeed") {
+			return
+		}
+		if !assert.Equal(t, ErrInvalidAudience, c2.Validate(WithAudience("baz")), "wrong audience should fail") {
+			return
+		}
+	}
+
+	invalid, err := jws.Sign([]byte(`{"aud":["foo",1]}`), jwa.HS256, sharedkey)
+	if !assert.NoError(t, err, "jws.Sign should succeed") {
+		return
+	}
+	if _, err := Parse(invalid, WithVerify(jwa.HS256, sharedkey)); !assert.Error(t, err, "Parse with an invalid 'aud' should fail") {
+		return
+	}
+}
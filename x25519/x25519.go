@@ -0,0 +1,76 @@
+// Package x25519 provides the key types for X25519 (https://tools.ietf.org/html/rfc7748),
+// so that they can be used as JWKs of type "OKP" (https://tools.ietf.org/html/rfc8037),
+// and for ECDH-ES key agreement in JWE.
+package x25519
+
+import (
+	"crypto"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// PublicKeySize is the size, in bytes, of public keys
+	PublicKeySize = 32
+	// PrivateKeySize is the size, in bytes, of private keys
+	PrivateKeySize = 32
+)
+
+// PublicKey is the type of X25519 public keys
+type PublicKey []byte
+
+// PrivateKey is the type of X25519 private keys (the 32 byte scalar)
+type PrivateKey []byte
+
+// GenerateKey generates a public/private key pair using entropy from `rand`
+func GenerateKey(rand io.Reader) (PublicKey, PrivateKey, error) {
+	priv := make([]byte, PrivateKeySize)
+	if _, err := io.ReadFull(rand, priv); err != nil {
+		return nil, nil, err
+	}
+
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return PublicKey(pub), PrivateKey(priv), nil
+}
+
+// Public returns the PublicKey corresponding to this private key
+func (k PrivateKey) Public() crypto.PublicKey {
+	pub, err := k.PublicKey()
+	if err != nil {
+		return nil
+	}
+	return pub
+}
+
+// PublicKey returns the PublicKey corresponding to this private key
+func (k PrivateKey) PublicKey() (PublicKey, error) {
+	if len(k) != PrivateKeySize {
+		return nil, errors.New("invalid private key size")
+	}
+
+	pub, err := curve25519.X25519(k, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return PublicKey(pub), nil
+}
+
+// SharedSecret computes the shared secret between this private key
+// and `pubkey`. An error is returned if the result is all zeros,
+// which happens when `pubkey` is a low order point
+func (k PrivateKey) SharedSecret(pubkey PublicKey) ([]byte, error) {
+	if len(k) != PrivateKeySize {
+		return nil, errors.New("invalid private key size")
+	}
+	if len(pubkey) != PublicKeySize {
+		return nil, errors.New("invalid public key size")
+	}
+
+	return curve25519.X25519(k, pubkey)
+}
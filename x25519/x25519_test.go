@@ -0,0 +1,63 @@
+package x25519
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// https://tools.ietf.org/html/rfc7748#section-6.1
+func TestSharedSecret_RFC7748(t *testing.T) {
+	alicepriv := PrivateKey(mustDecodeHex("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"))
+	alicepub := PublicKey(mustDecodeHex("8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"))
+	bobpriv := PrivateKey(mustDecodeHex("5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb"))
+	bobpub := PublicKey(mustDecodeHex("de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"))
+	expected := mustDecodeHex("4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742")
+
+	if !assert.Equal(t, alicepub, alicepriv.Public(), "Alice's public key matches") {
+		return
+	}
+	if !assert.Equal(t, bobpub, bobpriv.Public(), "Bob's public key matches") {
+		return
+	}
+
+	z, err := alicepriv.SharedSecret(bobpub)
+	if !assert.NoError(t, err, "SharedSecret should succeed") {
+		return
+	}
+	if !assert.Equal(t, expected, z, "shared secret matches (Alice)") {
+		return
+	}
+
+	z, err = bobpriv.SharedSecret(alicepub)
+	if !assert.NoError(t, err, "SharedSecret should succeed") {
+		return
+	}
+	if !assert.Equal(t, expected, z, "shared secret matches (Bob)") {
+		return
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	pub, priv, err := GenerateKey(rand.Reader)
+	if !assert.NoError(t, err, "GenerateKey should succeed") {
+		return
+	}
+	if !assert.Equal(t, pub, priv.Public(), "public key matches") {
+		return
+	}
+
+	if _, err := priv.SharedSecret(make(PublicKey, PublicKeySize)); !assert.Error(t, err, "SharedSecret with a low order point should fail") {
+		return
+	}
+}